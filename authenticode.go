@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Object identifiers specific to Authenticode signatures.
+var (
+	oidSpcIndirectData   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidSpcStatementType  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 11}
+	oidSpcSpOpusInfo     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 12}
+	oidSpcPEImageData    = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	oidSpcIndividualCode = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 21}
+	oidSpcRFC3161        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+)
+
+// WIN_CERTIFICATE header fields of Authenticode signatures.
+const (
+	winCertRevision = 0x0200
+	winCertTypePKCS = 0x0002
+)
+
+// signWindowsArtifacts Authenticode signs every Windows executable and library,
+// replacing any previous signature.
+func signWindowsArtifacts(ctx context.Context, artifacts []Artifact, signer *codeSigner, timestampURL, mode string) error {
+	if mode == "archive" || mode == "c-archive" {
+		return nil
+	}
+	for _, artifact := range artifacts {
+		if artifact.Target.OS != "windows" {
+			continue
+		}
+		if err := signPE(ctx, artifact.Path, signer, timestampURL); err != nil {
+			return fmt.Errorf("failed to sign %s: %w", artifact.Path, err)
+		}
+	}
+	return nil
+}
+
+// verifyWindowsSignatures checks the Authenticode signature of every Windows
+// executable and library, printing the signer and timestamp of each.
+func verifyWindowsSignatures(artifacts []Artifact, mode string) error {
+	if mode == "archive" || mode == "c-archive" {
+		return nil
+	}
+	var problems []string
+	for _, artifact := range artifacts {
+		if artifact.Target.OS != "windows" {
+			continue
+		}
+		signer, stamped, err := verifyPE(artifact.Path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", artifact.Path, err))
+			continue
+		}
+		if stamped.IsZero() {
+			fmt.Printf("%s: signed by %s\n", artifact.Path, signer.Subject)
+		} else {
+			fmt.Printf("%s: signed by %s, timestamped %s\n", artifact.Path, signer.Subject, stamped.UTC().Format(time.RFC3339))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid Authenticode signatures:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// peLayout are the offsets of the PE header fields excluded from the
+// Authenticode hash.
+type peLayout struct {
+	Checksum int // Offset of the optional header CheckSum field
+	Security int // Offset of the certificate table data directory entry
+}
+
+// parsePELayout locates the checksum and certificate table fields of a PE file.
+func parsePELayout(data []byte) (peLayout, error) {
+	if len(data) < 0x40 || data[0] != 'M' || data[1] != 'Z' {
+		return peLayout{}, errors.New("not a PE file")
+	}
+	header := int(binary.LittleEndian.Uint32(data[0x3c:]))
+	if header+26 > len(data) || string(data[header:header+4]) != "PE\x00\x00" {
+		return peLayout{}, errors.New("not a PE file")
+	}
+	optional := header + 24
+
+	var dirs int
+	switch binary.LittleEndian.Uint16(data[optional:]) {
+	case 0x10b: // PE32
+		dirs = optional + 96
+	case 0x20b: // PE32+
+		dirs = optional + 112
+	default:
+		return peLayout{}, errors.New("unknown PE optional header")
+	}
+	if dirs+5*8 > len(data) || binary.LittleEndian.Uint32(data[dirs-4:]) < 5 {
+		return peLayout{}, errors.New("PE file has no certificate table directory")
+	}
+	return peLayout{Checksum: optional + 64, Security: dirs + 4*8}, nil
+}
+
+// certificateTable returns the offset and size of the certificate table.
+func (l peLayout) certificateTable(data []byte) (int, int) {
+	return int(binary.LittleEndian.Uint32(data[l.Security:])), int(binary.LittleEndian.Uint32(data[l.Security+4:]))
+}
+
+// authenticodeHash hashes the image up to the certificate table, skipping the
+// checksum and the certificate table directory entry.
+func authenticodeHash(data []byte, layout peLayout, hash crypto.Hash) []byte {
+	h := hash.New()
+	h.Write(data[:layout.Checksum])
+	h.Write(data[layout.Checksum+4 : layout.Security])
+	h.Write(data[layout.Security+8:])
+	return h.Sum(nil)
+}
+
+// peChecksum computes the optional header checksum of a PE image.
+func peChecksum(data []byte, offset int) uint32 {
+	var sum uint64
+	for i := 0; i+1 < len(data); i += 2 {
+		if i == offset || i == offset+2 {
+			continue
+		}
+		sum += uint64(binary.LittleEndian.Uint16(data[i:]))
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	if len(data)%2 == 1 {
+		sum += uint64(data[len(data)-1])
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return uint32(sum) + uint32(len(data))
+}
+
+// signPE embeds an Authenticode signature into a PE file, replacing an
+// existing one.
+func signPE(ctx context.Context, path string, signer *codeSigner, timestampURL string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	layout, err := parsePELayout(data)
+	if err != nil {
+		return err
+	}
+	if offset, size := layout.certificateTable(data); size != 0 {
+		if offset+size != len(data) {
+			return errors.New("existing certificate table is not at the end of the file")
+		}
+		data = data[:offset]
+	}
+	// The certificate table must be 8 byte aligned, the padding is hashed
+	for len(data)%8 != 0 {
+		data = append(data, 0)
+	}
+	signature, err := authenticodeSignature(ctx, signer, authenticodeHash(data, layout, crypto.SHA256), timestampURL)
+	if err != nil {
+		return err
+	}
+	entry := binary.LittleEndian.AppendUint32(nil, 0)
+	entry = binary.LittleEndian.AppendUint16(entry, winCertRevision)
+	entry = binary.LittleEndian.AppendUint16(entry, winCertTypePKCS)
+	entry = append(entry, signature...)
+	for len(entry)%8 != 0 {
+		entry = append(entry, 0)
+	}
+	binary.LittleEndian.PutUint32(entry, uint32(len(entry)))
+
+	binary.LittleEndian.PutUint32(data[layout.Security:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[layout.Security+4:], uint32(len(entry)))
+	data = append(data, entry...)
+	binary.LittleEndian.PutUint32(data[layout.Checksum:], peChecksum(data, layout.Checksum))
+
+	return os.WriteFile(path, data, info.Mode())
+}
+
+// spcIndirectData encodes the SpcIndirectDataContent of a PE image hash.
+func spcIndirectData(digest []byte) ([]byte, error) {
+	// SpcPeImageData with no flags and the customary "<<<Obsolete>>>" file link
+	var obsolete []byte
+	for _, c := range utf16.Encode([]rune("<<<Obsolete>>>")) {
+		obsolete = binary.BigEndian.AppendUint16(obsolete, c)
+	}
+	link, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: obsolete})
+	if err != nil {
+		return nil, err
+	}
+	if link, err = asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: link}); err != nil {
+		return nil, err
+	}
+	if link, err = asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: link}); err != nil {
+		return nil, err
+	}
+	image, err := asn1.Marshal(struct {
+		Flags asn1.BitString
+		File  asn1.RawValue
+	}{asn1.BitString{}, asn1.RawValue{FullBytes: link}})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		Data struct {
+			Type  asn1.ObjectIdentifier
+			Value asn1.RawValue
+		}
+		Digest struct {
+			Algorithm pkix.AlgorithmIdentifier
+			Digest    []byte
+		}
+	}{
+		Data: struct {
+			Type  asn1.ObjectIdentifier
+			Value asn1.RawValue
+		}{oidSpcPEImageData, asn1.RawValue{FullBytes: image}},
+		Digest: struct {
+			Algorithm pkix.AlgorithmIdentifier
+			Digest    []byte
+		}{pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}, digest},
+	})
+}
+
+// authenticodeSignature creates the PKCS#7 SignedData of an Authenticode
+// signature over the image hash, timestamped if a timestamp server is given.
+func authenticodeSignature(ctx context.Context, signer *codeSigner, digest []byte, timestampURL string) ([]byte, error) {
+	content, err := spcIndirectData(digest)
+	if err != nil {
+		return nil, err
+	}
+	// The message digest covers the content without its SEQUENCE header
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	extra := []signedAttribute{
+		{oidSpcSpOpusInfo, struct{}{}},
+		{oidSpcStatementType, []asn1.ObjectIdentifier{oidSpcIndividualCode}},
+	}
+	return signer.signPKCS7(ctx, oidSpcIndirectData, content, raw.Bytes, extra, timestampURL, oidSpcRFC3161)
+}
+
+// verifyPE checks the embedded Authenticode signature of a PE file against
+// its contents, returning the signing certificate and the timestamp, if any.
+func verifyPE(path string) (*x509.Certificate, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	layout, err := parsePELayout(data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	offset, size := layout.certificateTable(data)
+	if size == 0 {
+		return nil, time.Time{}, errors.New("not signed")
+	}
+	if size < 8 || offset+size > len(data) {
+		return nil, time.Time{}, errors.New("certificate table out of bounds")
+	}
+	entry := data[offset : offset+size]
+	length := int(binary.LittleEndian.Uint32(entry))
+	if length < 8 || length > len(entry) || binary.LittleEndian.Uint16(entry[4:]) != winCertRevision || binary.LittleEndian.Uint16(entry[6:]) != winCertTypePKCS {
+		return nil, time.Time{}, errors.New("unsupported certificate table entry")
+	}
+	sd, err := parseSignedData(entry[8:length], nil)
+	if err != nil {
+		// Padding may follow the PKCS#7 structure, retry without it
+		var raw asn1.RawValue
+		if _, uerr := asn1.Unmarshal(entry[8:length], &raw); uerr != nil {
+			return nil, time.Time{}, err
+		}
+		if sd, err = parseSignedData(raw.FullBytes, nil); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	if !sd.ContentType.Equal(oidSpcIndirectData) {
+		return nil, time.Time{}, errors.New("signature holds no Authenticode content")
+	}
+	// SpcIndirectDataContent: the image data followed by the image digest
+	var (
+		image  asn1.RawValue
+		digest struct {
+			Algorithm pkix.AlgorithmIdentifier
+			Digest    []byte
+		}
+	)
+	rest, err := asn1.Unmarshal(sd.Content, &image)
+	if err == nil {
+		_, err = asn1.Unmarshal(rest, &digest)
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("malformed Authenticode content: %w", err)
+	}
+	hash, ok := digestAlgorithms[digest.Algorithm.Algorithm.String()]
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("unsupported image digest algorithm %v", digest.Algorithm.Algorithm)
+	}
+	if !bytes.Equal(authenticodeHash(data[:offset], layout, hash), digest.Digest) {
+		return nil, time.Time{}, errors.New("image hash doesn't match the signature, the file was modified after signing")
+	}
+	var stamped time.Time
+	if token, ok := sd.Unsigned[oidSpcRFC3161.String()]; ok {
+		stamp, err := parseSignedData(token, nil)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("invalid timestamp: %w", err)
+		}
+		if stamped, err = checkTimestamp(stamp, sd.Signature); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return sd.Signer, stamped, nil
+}
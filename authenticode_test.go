@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSigner creates a code signer with a self-signed ECDSA certificate.
+func newTestSigner(t *testing.T, name string) *codeSigner {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &codeSigner{Key: key, Chain: []*x509.Certificate{cert}}
+}
+
+// newTestTSA starts an RFC 3161 timestamp server stamping every request at
+// the given time, or rejecting them with the given status if non-zero.
+func newTestTSA(t *testing.T, stamped time.Time, status int) *httptest.Server {
+	t.Helper()
+
+	signer := newTestSigner(t, "xgo test TSA")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/timestamp-query" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var request struct {
+			Version        int
+			MessageImprint struct {
+				Algorithm pkix.AlgorithmIdentifier
+				Digest    []byte
+			}
+			Nonce   *big.Int
+			CertReq bool `asn1:"optional"`
+		}
+		if _, err := asn1.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		statusInfo, _ := asn1.Marshal(struct{ Status int }{status})
+		if status != 0 {
+			response, _ := asn1.Marshal(struct{ Status asn1.RawValue }{asn1.RawValue{FullBytes: statusInfo}})
+			w.Write(response)
+			return
+		}
+		info, err := asn1.Marshal(struct {
+			Version        int
+			Policy         asn1.ObjectIdentifier
+			MessageImprint struct {
+				Algorithm pkix.AlgorithmIdentifier
+				Digest    []byte
+			}
+			Serial  *big.Int
+			GenTime time.Time `asn1:"generalized"`
+			Nonce   *big.Int
+		}{1, asn1.ObjectIdentifier{1, 2, 3, 4}, request.MessageImprint, big.NewInt(1), stamped, request.Nonce})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		content, _ := asn1.Marshal(info)
+		token, err := signer.signPKCS7(r.Context(), oidTSTInfo, content, info, nil, "", nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response, _ := asn1.Marshal(struct {
+			Status asn1.RawValue
+			Token  asn1.RawValue
+		}{asn1.RawValue{FullBytes: statusInfo}, asn1.RawValue{FullBytes: token}})
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// writeTestPE writes a minimal PE32+ image with an empty certificate table
+// followed by some code bytes.
+func writeTestPE(t *testing.T) string {
+	t.Helper()
+
+	data := make([]byte, 0x40)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], 0x40)
+
+	// PE signature and COFF header of an amd64 image without sections
+	data = append(data, "PE\x00\x00"...)
+	coff := make([]byte, 20)
+	binary.LittleEndian.PutUint16(coff[0:], 0x8664)
+	binary.LittleEndian.PutUint16(coff[16:], 240)
+	data = append(data, coff...)
+
+	// PE32+ optional header with all 16 data directories
+	optional := make([]byte, 240)
+	binary.LittleEndian.PutUint16(optional[0:], 0x20b)
+	binary.LittleEndian.PutUint32(optional[108:], 16)
+	data = append(data, optional...)
+
+	for i := 0; i < 333; i++ {
+		data = append(data, byte(i*7))
+	}
+	path := filepath.Join(t.TempDir(), "test.exe")
+	if err := os.WriteFile(path, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Tests that a signed and timestamped PE image verifies, and that the
+// signature and checksum are embedded as Authenticode expects.
+func TestSignPERoundTrip(t *testing.T) {
+	var (
+		signer  = newTestSigner(t, "xgo test signer")
+		stamped = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		tsa     = newTestTSA(t, stamped, 0)
+		path    = writeTestPE(t)
+	)
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signPE(context.Background(), path, signer, tsa.URL); err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	cert, timestamp, err := verifyPE(path)
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if !cert.Equal(signer.Chain[0]) {
+		t.Errorf("signer mismatch: have %s, want %s", cert.Subject, signer.Chain[0].Subject)
+	}
+	if !timestamp.Equal(stamped) {
+		t.Errorf("timestamp mismatch: have %v, want %v", timestamp, stamped)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, err := parsePELayout(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, size := layout.certificateTable(data)
+	if offset%8 != 0 || size%8 != 0 || offset+size != len(data) {
+		t.Errorf("certificate table at %d+%d not aligned to the end of the %d byte file", offset, size, len(data))
+	}
+	if !bytes.Equal(data[layout.Security+8:len(original)], original[layout.Security+8:]) {
+		t.Errorf("image contents changed by signing")
+	}
+	if have, want := binary.LittleEndian.Uint32(data[layout.Checksum:]), peChecksum(data, layout.Checksum); have != want {
+		t.Errorf("checksum mismatch: have %#x, want %#x", have, want)
+	}
+	// Signing again must replace the signature rather than append another
+	if err := signPE(context.Background(), path, signer, ""); err != nil {
+		t.Fatalf("failed to re-sign: %v", err)
+	}
+	resigned, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, size := layout.certificateTable(resigned); offset+size != len(resigned) {
+		t.Errorf("re-signed certificate table at %d+%d, want it at %d", offset, size, offset)
+	}
+	if _, timestamp, err := verifyPE(path); err != nil || !timestamp.IsZero() {
+		t.Errorf("re-signed image: have timestamp %v and error %v, want none", timestamp, err)
+	}
+}
+
+// Tests that modifying a signed PE image invalidates its signature.
+func TestVerifyPETampered(t *testing.T) {
+	path := writeTestPE(t)
+	if err := signPE(context.Background(), path, newTestSigner(t, "xgo test signer"), ""); err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	signed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, err := parsePELayout(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, _ := layout.certificateTable(signed)
+
+	// The signer's signature ends the PKCS#7 structure, ahead of the padding
+	var signature asn1.RawValue
+	if _, err := asn1.Unmarshal(signed[offset+8:], &signature); err != nil {
+		t.Fatal(err)
+	}
+	end := offset + 8 + len(signature.FullBytes)
+
+	tests := []struct {
+		name   string
+		tamper func(data []byte)
+		err    string
+	}{
+		{"code", func(data []byte) { data[offset-1] ^= 0xff }, "modified after signing"},
+		{"header", func(data []byte) { data[0x50] ^= 0xff }, "modified after signing"},
+		{"signature", func(data []byte) { data[end-2] ^= 0xff }, "signature verification failed"},
+	}
+	for _, tt := range tests {
+		data := append([]byte{}, signed...)
+		tt.tamper(data)
+		if err := os.WriteFile(path, data, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := verifyPE(path)
+		if err == nil {
+			t.Errorf("%s: tampered image verified", tt.name)
+		} else if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error mismatch: have %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	// The checksum is excluded from the image hash, so fixing it up is fine
+	data := append([]byte{}, signed...)
+	binary.LittleEndian.PutUint32(data[layout.Checksum:], 0)
+	if err := os.WriteFile(path, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := verifyPE(path); err != nil {
+		t.Errorf("image with cleared checksum failed to verify: %v", err)
+	}
+}
+
+// Tests that a rejected timestamp request fails the signing.
+func TestSignPETimestampRejected(t *testing.T) {
+	tsa := newTestTSA(t, time.Now(), 2)
+	err := signPE(context.Background(), writeTestPE(t), newTestSigner(t, "xgo test signer"), tsa.URL)
+	if err == nil || !strings.Contains(err.Error(), "status 2") {
+		t.Errorf("error mismatch: have %v, want a rejection", err)
+	}
+}
+
+// Tests the PE checksum against hand computed values.
+func TestPEChecksum(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		offset int
+		sum    uint32
+	}{
+		{[]byte{1, 0, 2, 0}, 100, 3 + 4},
+		{[]byte{1, 0, 2, 0, 0xff, 0xff, 0xff, 0xff}, 4, 3 + 8},   // checksum field skipped
+		{[]byte{0xff, 0xff, 0x02, 0x00}, 100, 2 + 4},             // carry folded back in
+		{[]byte{0x34, 0x12, 0x05}, 100, 0x1234 + 0x05 + 3},       // odd trailing byte
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0x01, 0x00}, 100, 1 + 6}, // 0xffff + 0xffff + 1 folds to 1
+	}
+	for i, tt := range tests {
+		if sum := peChecksum(tt.data, tt.offset); sum != tt.sum {
+			t.Errorf("test %d: checksum mismatch: have %#x, want %#x", i, sum, tt.sum)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// elfArch describes the ELF header fields expected for a Go architecture.
+type elfArch struct {
+	Machine elf.Machine
+	Class   elf.Class
+	Data    elf.Data
+}
+
+// elfArchs maps Go architectures to their ELF machine, class and endianness.
+var elfArchs = map[string]elfArch{
+	"386":      {elf.EM_386, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"amd64":    {elf.EM_X86_64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"arm":      {elf.EM_ARM, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"arm64":    {elf.EM_AARCH64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"loong64":  {elf.EM_LOONGARCH, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"mips":     {elf.EM_MIPS, elf.ELFCLASS32, elf.ELFDATA2MSB},
+	"mipsle":   {elf.EM_MIPS, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"mips64":   {elf.EM_MIPS, elf.ELFCLASS64, elf.ELFDATA2MSB},
+	"mips64le": {elf.EM_MIPS, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"ppc64":    {elf.EM_PPC64, elf.ELFCLASS64, elf.ELFDATA2MSB},
+	"ppc64le":  {elf.EM_PPC64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"riscv64":  {elf.EM_RISCV, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"s390x":    {elf.EM_S390, elf.ELFCLASS64, elf.ELFDATA2MSB},
+}
+
+// peMachines maps Go architectures to their PE machine type.
+var peMachines = map[string]uint16{
+	"386":   pe.IMAGE_FILE_MACHINE_I386,
+	"amd64": pe.IMAGE_FILE_MACHINE_AMD64,
+	"arm":   pe.IMAGE_FILE_MACHINE_ARMNT,
+	"arm64": pe.IMAGE_FILE_MACHINE_ARM64,
+}
+
+// machoCpus maps Go architectures to their Mach-O CPU type.
+var machoCpus = map[string]macho.Cpu{
+	"amd64": macho.CpuAmd64,
+	"arm64": macho.CpuArm64,
+}
+
+// ARM EABI float ABI flags in the ELF header (e_flags).
+const (
+	elfARMFloatSoft = 0x200
+	elfARMFloatHard = 0x400
+)
+
+// checkArtifacts verifies that every artifact is a binary for the target its
+// name claims, reporting all mismatches at once.
+func checkArtifacts(artifacts []Artifact, mode string) error {
+	var problems []string
+	for _, artifact := range artifacts {
+		if err := checkArtifact(artifact, mode); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", filepath.Base(artifact.Path), err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d outputs don't match their target:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// checkArtifact verifies the file format, machine and ABI of a single artifact
+// and, for c-shared libraries, that it exports the functions of its header.
+func checkArtifact(artifact Artifact, mode string) error {
+	switch mode {
+	case "archive":
+		// Go archives hold Go objects, not native code
+		return nil
+	case "c-archive":
+		return checkArchive(artifact.Path, artifact.Target)
+	}
+	file, err := os.Open(artifact.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := checkObject(file, artifact.Target); err != nil {
+		return err
+	}
+	if mode != "c-shared" || artifact.Header == "" {
+		return nil
+	}
+	wanted, err := headerExports(artifact.Header)
+	if err != nil {
+		return err
+	}
+	exports, err := binaryExports(file, artifact.Target)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, name := range wanted {
+		if !exports[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("exported functions missing from the library: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkObject verifies that an executable, library or object file matches the
+// format, machine, endianness and float ABI of the target.
+func checkObject(r io.ReaderAt, target Target) error {
+	switch target.OS {
+	case "windows":
+		file, err := pe.NewFile(r)
+		if err != nil {
+			return fmt.Errorf("not a PE file: %w", err)
+		}
+		defer file.Close()
+
+		if want, ok := peMachines[target.GoArch]; ok && file.Machine != want {
+			return fmt.Errorf("PE machine is %#x, expected %#x for %s", file.Machine, want, target.GoArch)
+		}
+		return nil
+
+	case "darwin", "ios":
+		file, err := macho.NewFile(r)
+		if err != nil {
+			return fmt.Errorf("not a Mach-O file: %w", err)
+		}
+		defer file.Close()
+
+		if want, ok := machoCpus[target.GoArch]; ok && file.Cpu != want {
+			return fmt.Errorf("Mach-O CPU is %v, expected %v", file.Cpu, want)
+		}
+		return nil
+
+	default:
+		file, err := elf.NewFile(r)
+		if err != nil {
+			return fmt.Errorf("not an ELF file: %w", err)
+		}
+		defer file.Close()
+
+		want, ok := elfArchs[target.GoArch]
+		if !ok {
+			return nil
+		}
+		if file.Machine != want.Machine {
+			return fmt.Errorf("ELF machine is %v, expected %v", file.Machine, want.Machine)
+		}
+		if file.Class != want.Class {
+			return fmt.Errorf("ELF class is %v, expected %v", file.Class, want.Class)
+		}
+		if file.Data != want.Data {
+			return fmt.Errorf("ELF byte order is %v, expected %v", file.Data, want.Data)
+		}
+		if file.Machine == elf.EM_ARM && target.FloatABI != "" {
+			// The Go linker leaves the float ABI unset unless cgo objects carry one
+			flags, err := elfFlags(r, file)
+			if err != nil {
+				return err
+			}
+			switch {
+			case flags&elfARMFloatHard != 0 && target.FloatABI != "hard":
+				return fmt.Errorf("uses the hard-float ABI, expected %s-float", target.FloatABI)
+			case flags&elfARMFloatSoft != 0 && target.FloatABI != "soft":
+				return fmt.Errorf("uses the soft-float ABI, expected %s-float", target.FloatABI)
+			}
+		}
+		return nil
+	}
+}
+
+// elfFlags reads the processor specific flags (e_flags) of an ELF header, which
+// debug/elf doesn't expose.
+func elfFlags(r io.ReaderAt, file *elf.File) (uint32, error) {
+	offset := int64(36)
+	if file.Class == elf.ELFCLASS64 {
+		offset = 48
+	}
+	var buf [4]byte
+	if _, err := r.ReadAt(buf[:], offset); err != nil {
+		return 0, fmt.Errorf("failed to read ELF flags: %w", err)
+	}
+	return file.ByteOrder.Uint32(buf[:]), nil
+}
+
+// checkArchive verifies every native object within a static archive.
+func checkArchive(path string, target Target) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte("!<arch>\n")) {
+		return errors.New("not an ar archive")
+	}
+	checked := 0
+	for data = data[8:]; len(data) >= 60; {
+		name := strings.TrimSpace(string(data[:16]))
+		size, err := strconv.Atoi(strings.TrimSpace(string(data[48:58])))
+		if err != nil || size < 0 || 60+size > len(data) {
+			return errors.New("malformed ar archive")
+		}
+		member := data[60 : 60+size]
+		if data = data[60+size:]; size%2 == 1 && len(data) > 0 {
+			data = data[1:]
+		}
+		// BSD archives store long member names in front of the contents
+		if rest, ok := strings.CutPrefix(name, "#1/"); ok {
+			if n, err := strconv.Atoi(rest); err == nil && n <= len(member) {
+				name, member = strings.TrimRight(string(member[:n]), "\x00"), member[n:]
+			}
+		}
+		// Skip symbol tables, name tables and Go metadata
+		if name == "/" || name == "//" || name == "/SYM64/" || strings.HasPrefix(name, "__.") {
+			continue
+		}
+		if !isNativeObject(member, target) {
+			continue
+		}
+		if err := checkObject(bytes.NewReader(member), target); err != nil {
+			return fmt.Errorf("archive member %s: %w", strings.TrimSuffix(name, "/"), err)
+		}
+		checked++
+	}
+	if checked == 0 {
+		return errors.New("no native objects in archive")
+	}
+	return nil
+}
+
+// isNativeObject reports whether an archive member looks like an object file
+// of the target's format. COFF objects have no magic, so any member of a
+// Windows archive is considered one.
+func isNativeObject(member []byte, target Target) bool {
+	switch target.OS {
+	case "windows":
+		return len(member) >= 20
+	case "darwin", "ios":
+		return len(member) >= 4 && (binary.LittleEndian.Uint32(member) == macho.Magic64 || binary.LittleEndian.Uint32(member) == macho.Magic32)
+	default:
+		return bytes.HasPrefix(member, []byte(elf.ELFMAG))
+	}
+}
+
+// headerExportPattern matches the function declarations cgo writes to the
+// header of c-shared and c-archive outputs.
+var headerExportPattern = regexp.MustCompile(`^extern\s.*?\b([A-Za-z_][A-Za-z0-9_]*)\s*\(`)
+
+// headerExports returns the functions declared by a cgo generated header after
+// its boilerplate prologue, i.e. the //export-ed functions.
+func headerExports(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		names    []string
+		exported bool
+	)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "End of boilerplate cgo prologue") {
+			exported = true
+			continue
+		}
+		if match := headerExportPattern.FindStringSubmatch(line); exported && match != nil {
+			names = append(names, match[1])
+		}
+	}
+	return names, scanner.Err()
+}
+
+// binaryExports returns the names of the functions a shared library exports.
+func binaryExports(r io.ReaderAt, target Target) (map[string]bool, error) {
+	exports := make(map[string]bool)
+
+	switch target.OS {
+	case "windows":
+		file, err := pe.NewFile(r)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		names, err := peExports(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			exports[name] = true
+		}
+	case "darwin", "ios":
+		file, err := macho.NewFile(r)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		if file.Symtab != nil {
+			for _, sym := range file.Symtab.Syms {
+				// External symbols defined in a section (N_EXT | N_SECT)
+				if sym.Type&0x01 != 0 && sym.Type&0x0e == 0x0e {
+					exports[strings.TrimPrefix(sym.Name, "_")] = true
+				}
+			}
+		}
+	default:
+		file, err := elf.NewFile(r)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		syms, err := file.DynamicSymbols()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dynamic symbols: %w", err)
+		}
+		for _, sym := range syms {
+			bind := elf.ST_BIND(sym.Info)
+			if sym.Section != elf.SHN_UNDEF && (bind == elf.STB_GLOBAL || bind == elf.STB_WEAK) {
+				exports[sym.Name] = true
+			}
+		}
+	}
+	return exports, nil
+}
+
+// peExports returns the names in the export directory of a PE file, which
+// debug/pe doesn't parse.
+func peExports(file *pe.File) ([]string, error) {
+	var dirs []pe.DataDirectory
+	switch header := file.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		dirs = header.DataDirectory[:header.NumberOfRvaAndSizes]
+	case *pe.OptionalHeader64:
+		dirs = header.DataDirectory[:header.NumberOfRvaAndSizes]
+	}
+	if len(dirs) <= pe.IMAGE_DIRECTORY_ENTRY_EXPORT || dirs[pe.IMAGE_DIRECTORY_ENTRY_EXPORT].VirtualAddress == 0 {
+		return nil, nil
+	}
+	// Resolve relative virtual addresses to the contents of their section
+	at := func(rva uint32) []byte {
+		for _, section := range file.Sections {
+			size := max(section.VirtualSize, section.Size)
+			if rva >= section.VirtualAddress && rva < section.VirtualAddress+size {
+				data, err := section.Data()
+				if err != nil || int(rva-section.VirtualAddress) >= len(data) {
+					return nil
+				}
+				return data[rva-section.VirtualAddress:]
+			}
+		}
+		return nil
+	}
+	directory := at(dirs[pe.IMAGE_DIRECTORY_ENTRY_EXPORT].VirtualAddress)
+	if len(directory) < 40 {
+		return nil, errors.New("malformed PE export directory")
+	}
+	count := binary.LittleEndian.Uint32(directory[24:])
+	table := at(binary.LittleEndian.Uint32(directory[32:]))
+	if uint64(len(table)) < uint64(count)*4 {
+		return nil, errors.New("malformed PE export name table")
+	}
+	names := make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		name := at(binary.LittleEndian.Uint32(table[i*4:]))
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			names = append(names, string(name[:end]))
+		}
+	}
+	return names, nil
+}
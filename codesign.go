@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// adhocSigning is the -sign-darwin value requesting an ad-hoc signature.
+const adhocSigning = "adhoc"
+
+// Mach-O load commands and code signature constants, from the xnu cs_blobs.h
+// and the Go linker's ad-hoc signer.
+const (
+	lcSegment64       = 0x19
+	lcCodeSignature   = 0x1d
+	machoHeaderSize64 = 32
+
+	csMagicCodeDirectory     = 0xfade0c02
+	csMagicEmbeddedSignature = 0xfade0cc0
+	csMagicBlobWrapper       = 0xfade0b01
+
+	csSlotCodeDirectory = 0
+	csSlotRequirements  = 2
+	csSlotSignature     = 0x10000
+
+	csHashTypeSHA256 = 2
+	csFlagAdhoc      = 0x2
+	csExecSegMain    = 0x1
+
+	codeDirectoryVersion = 0x20400
+	codeDirectorySize    = 88
+	codePageBits         = 12
+
+	// linkeditAlign is the alignment of the __LINKEDIT segment's VM size, the
+	// page size of arm64 (and a multiple of that of amd64)
+	linkeditAlign = 0x4000
+)
+
+// emptyRequirements is a requirements blob holding no requirements, as written
+// by codesign for ad-hoc signatures.
+var emptyRequirements = []byte{0xfa, 0xde, 0x0c, 0x01, 0, 0, 0, 12, 0, 0, 0, 0}
+
+// signDarwinArtifacts signs every macOS executable and library with an
+// ad-hoc signature, or with the certificate if one is given, replacing any
+// previous signature. Universal binaries are merged from signed slices, so
+// this runs before merging.
+func signDarwinArtifacts(ctx context.Context, artifacts []Artifact, signer *codeSigner, timestampURL, mode string) error {
+	if mode == "archive" || mode == "c-archive" {
+		return nil
+	}
+	for _, artifact := range artifacts {
+		if artifact.Target.OS != "darwin" || artifact.Target.Arch == universalArch {
+			continue
+		}
+		if err := signMachO(ctx, artifact.Path, signer, timestampURL); err != nil {
+			return fmt.Errorf("failed to sign %s: %w", artifact.Path, err)
+		}
+	}
+	return nil
+}
+
+// verifyDarwinSignatures checks the code signature of every macOS executable
+// and library (of every slice for universal binaries), printing the signer and
+// timestamp of each.
+func verifyDarwinSignatures(artifacts []Artifact, mode string) error {
+	if mode == "archive" || mode == "c-archive" {
+		return nil
+	}
+	var problems []string
+	for _, artifact := range artifacts {
+		if artifact.Target.OS != "darwin" {
+			continue
+		}
+		signer, stamped, err := verifyMachOFile(artifact.Path)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", artifact.Path, err))
+		case signer == nil:
+			fmt.Printf("%s: ad-hoc signed\n", artifact.Path)
+		case stamped.IsZero():
+			fmt.Printf("%s: signed by %s\n", artifact.Path, signer.Subject)
+		default:
+			fmt.Printf("%s: signed by %s, timestamped %s\n", artifact.Path, signer.Subject, stamped.UTC().Format(time.RFC3339))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid code signatures:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// signMachO writes a code signature into a thin 64 bit Mach-O file, appending
+// it to the __LINKEDIT segment and adding an LC_CODE_SIGNATURE load command
+// if there is none yet. Without a signer, the signature is ad-hoc.
+func signMachO(ctx context.Context, path string, signer *codeSigner, timestampURL string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) >= 4 && binary.BigEndian.Uint32(data) == macho.MagicFat {
+		return errors.New("universal binaries must be signed per slice before merging")
+	}
+	file, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("not a Mach-O file: %w", err)
+	}
+	if file.Magic != macho.Magic64 {
+		return errors.New("only 64 bit Mach-O files can be signed")
+	}
+	order := file.ByteOrder
+
+	// Locate the load commands to patch
+	var (
+		offset    = machoHeaderSize64
+		linkedit  = -1
+		signature = -1
+		text      *macho.Segment
+	)
+	for _, load := range file.Loads {
+		raw := load.Raw()
+		switch order.Uint32(raw) {
+		case lcSegment64:
+			switch segment := load.(*macho.Segment); segment.Name {
+			case "__LINKEDIT":
+				linkedit = offset
+			case "__TEXT":
+				text = segment
+			}
+		case lcCodeSignature:
+			signature = offset
+		}
+		offset += len(raw)
+	}
+	if linkedit < 0 || text == nil {
+		return errors.New("no __TEXT or __LINKEDIT segment")
+	}
+	if signature >= 0 {
+		// Drop the previous signature, it's at the end of __LINKEDIT
+		if end := order.Uint32(data[signature+8:]); int(end) <= len(data) {
+			data = data[:end]
+		}
+	} else {
+		// Add the load command into the padding before the first section
+		first := uint64(len(data))
+		for _, section := range file.Sections {
+			if section.Offset != 0 && uint64(section.Offset) < first {
+				first = uint64(section.Offset)
+			}
+		}
+		end := machoHeaderSize64 + int(file.Cmdsz)
+		if uint64(end+16) > first || !bytes.Equal(data[end:end+16], make([]byte, 16)) {
+			return errors.New("no room for a code signature load command, link with -headerpad")
+		}
+		signature = end
+		order.PutUint32(data[signature:], lcCodeSignature)
+		order.PutUint32(data[signature+4:], 16)
+		order.PutUint32(data[16:], file.Ncmd+1)
+		order.PutUint32(data[20:], file.Cmdsz+16)
+	}
+	// The signature is 16 byte aligned, the padding is covered by the hashes
+	for len(data)%16 != 0 {
+		data = append(data, 0)
+	}
+	codeLimit := len(data)
+
+	var team string
+	if signer != nil && len(signer.Chain[0].Subject.OrganizationalUnit) > 0 {
+		team = signer.Chain[0].Subject.OrganizationalUnit[0]
+	}
+	id := filepath.Base(path)
+	size := codeSignatureSize(codeLimit, id, team, signer, timestampURL)
+
+	// Grow __LINKEDIT over the signature and point the load command at it
+	fileoff := order.Uint64(data[linkedit+40:])
+	filesize := uint64(codeLimit+size) - fileoff
+	order.PutUint64(data[linkedit+32:], (filesize+linkeditAlign-1)&^(linkeditAlign-1))
+	order.PutUint64(data[linkedit+48:], filesize)
+	order.PutUint32(data[signature+8:], uint32(codeLimit))
+	order.PutUint32(data[signature+12:], uint32(size))
+
+	directory := codeDirectory(data, id, team, signer == nil, text.Offset, text.Filesz, file.Type == macho.TypeExec)
+	blobs := []codeBlob{{csSlotCodeDirectory, directory}, {csSlotRequirements, emptyRequirements}}
+	if signer != nil {
+		cms, err := signer.signPKCS7(ctx, oidData, nil, directory, []signedAttribute{{oidSigningTime, time.Now().UTC()}}, timestampURL, oidTimeStampToken)
+		if err != nil {
+			return err
+		}
+		wrapper := binary.BigEndian.AppendUint32(nil, csMagicBlobWrapper)
+		wrapper = binary.BigEndian.AppendUint32(wrapper, uint32(8+len(cms)))
+		blobs = append(blobs, codeBlob{csSlotSignature, append(wrapper, cms...)})
+	}
+	blob := superBlob(blobs)
+	if len(blob) > size {
+		return fmt.Errorf("signature of %d bytes exceeds the %d bytes reserved for it", len(blob), size)
+	}
+	data = append(data, blob...)
+	data = append(data, make([]byte, size-len(blob))...)
+
+	return os.WriteFile(path, data, info.Mode())
+}
+
+// codeSignatureSize returns the space to reserve for a code signature. It is
+// exact for ad-hoc signatures, while CMS signatures get a generous allowance
+// as their size is only known after signing.
+func codeSignatureSize(codeLimit int, id, team string, signer *codeSigner, timestampURL string) int {
+	pages := (codeLimit + 1<<codePageBits - 1) >> codePageBits
+	size := 12 + 2*8 + codeDirectorySize + len(id) + 1 + 2*sha256.Size + pages*sha256.Size + len(emptyRequirements)
+	if team != "" {
+		size += len(team) + 1
+	}
+	if signer != nil {
+		size += 8 + 4096
+		for _, cert := range signer.Chain {
+			size += len(cert.Raw)
+		}
+		if timestampURL != "" {
+			size += 16384
+		}
+	}
+	return size
+}
+
+// codeDirectory creates the code directory blob holding the SHA-256 hash of
+// every page of the code and of the requirements.
+func codeDirectory(code []byte, id, team string, adhoc bool, textOff, textSize uint64, main bool) []byte {
+	const specialSlots = 2
+
+	pages := (len(code) + 1<<codePageBits - 1) >> codePageBits
+	identOffset := codeDirectorySize
+	teamOffset := 0
+	hashOffset := identOffset + len(id) + 1
+	if team != "" {
+		teamOffset = hashOffset
+		hashOffset += len(team) + 1
+	}
+	hashOffset += specialSlots * sha256.Size
+	length := hashOffset + pages*sha256.Size
+
+	var flags, execFlags uint32
+	if adhoc {
+		flags = csFlagAdhoc
+	}
+	if main {
+		execFlags = csExecSegMain
+	}
+	be := binary.BigEndian
+	out := be.AppendUint32(nil, csMagicCodeDirectory)
+	out = be.AppendUint32(out, uint32(length))
+	out = be.AppendUint32(out, codeDirectoryVersion)
+	out = be.AppendUint32(out, flags)
+	out = be.AppendUint32(out, uint32(hashOffset))
+	out = be.AppendUint32(out, uint32(identOffset))
+	out = be.AppendUint32(out, specialSlots)
+	out = be.AppendUint32(out, uint32(pages))
+	out = be.AppendUint32(out, uint32(len(code)))
+	out = append(out, sha256.Size, csHashTypeSHA256, 0, codePageBits)
+	out = be.AppendUint32(out, 0)                  // spare2
+	out = be.AppendUint32(out, 0)                  // scatterOffset
+	out = be.AppendUint32(out, uint32(teamOffset)) // teamOffset
+	out = be.AppendUint32(out, 0)                  // spare3
+	out = be.AppendUint64(out, 0)                  // codeLimit64
+	out = be.AppendUint64(out, textOff)
+	out = be.AppendUint64(out, textSize)
+	out = be.AppendUint64(out, uint64(execFlags))
+
+	out = append(out, id+"\x00"...)
+	if team != "" {
+		out = append(out, team+"\x00"...)
+	}
+	// Special slots are stored in reverse order before the code slots: the
+	// requirements (-2) and the absent Info.plist (-1)
+	requirements := sha256.Sum256(emptyRequirements)
+	out = append(out, requirements[:]...)
+	out = append(out, make([]byte, sha256.Size)...)
+
+	for offset := 0; offset < len(code); offset += 1 << codePageBits {
+		hash := sha256.Sum256(code[offset:min(offset+1<<codePageBits, len(code))])
+		out = append(out, hash[:]...)
+	}
+	return out
+}
+
+// codeBlob is a blob of an embedded signature and the slot it is indexed by.
+type codeBlob struct {
+	Slot uint32
+	Data []byte
+}
+
+// superBlob assembles the embedded signature from blobs given in ascending slot
+// order.
+func superBlob(blobs []codeBlob) []byte {
+	be := binary.BigEndian
+
+	length := 12 + 8*len(blobs)
+	for _, blob := range blobs {
+		length += len(blob.Data)
+	}
+	out := be.AppendUint32(nil, csMagicEmbeddedSignature)
+	out = be.AppendUint32(out, uint32(length))
+	out = be.AppendUint32(out, uint32(len(blobs)))
+
+	offset := 12 + 8*len(blobs)
+	for _, blob := range blobs {
+		out = be.AppendUint32(out, blob.Slot)
+		out = be.AppendUint32(out, uint32(offset))
+		offset += len(blob.Data)
+	}
+	for _, blob := range blobs {
+		out = append(out, blob.Data...)
+	}
+	return out
+}
+
+// verifyMachOFile checks the code signature of a thin Mach-O file or of every
+// slice of a universal binary, returning the signing certificate (nil if
+// ad-hoc signed) and the timestamp, if any.
+func verifyMachOFile(path string) (*x509.Certificate, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != macho.MagicFat {
+		return verifyMachO(data)
+	}
+	fat, err := macho.NewFatFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var (
+		signer  *x509.Certificate
+		stamped time.Time
+	)
+	for _, arch := range fat.Arches {
+		if signer, stamped, err = verifyMachO(data[arch.Offset : arch.Offset+arch.Size]); err != nil {
+			return nil, time.Time{}, fmt.Errorf("%v slice: %w", arch.Cpu, err)
+		}
+	}
+	return signer, stamped, nil
+}
+
+// verifyMachO checks the code signature of a thin Mach-O file: the page hashes
+// must match the file, and a CMS signature, if any, must sign the code
+// directory.
+func verifyMachO(data []byte) (*x509.Certificate, time.Time, error) {
+	file, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var dataoff, datasize uint32
+	for _, load := range file.Loads {
+		if raw := load.Raw(); file.ByteOrder.Uint32(raw) == lcCodeSignature {
+			dataoff, datasize = file.ByteOrder.Uint32(raw[8:]), file.ByteOrder.Uint32(raw[12:])
+		}
+	}
+	if datasize == 0 {
+		return nil, time.Time{}, errors.New("not signed")
+	}
+	if uint64(dataoff)+uint64(datasize) > uint64(len(data)) {
+		return nil, time.Time{}, errors.New("code signature out of bounds")
+	}
+	// Collect the blobs of the embedded signature by slot
+	be := binary.BigEndian
+	sig := data[dataoff : dataoff+datasize]
+	if len(sig) < 12 || be.Uint32(sig) != csMagicEmbeddedSignature || int(be.Uint32(sig[4:])) > len(sig) {
+		return nil, time.Time{}, errors.New("malformed embedded signature")
+	}
+	sig = sig[:be.Uint32(sig[4:])]
+	blobs := make(map[uint32][]byte)
+	for i := 0; i < int(be.Uint32(sig[8:])); i++ {
+		if 12+8*i+8 > len(sig) {
+			return nil, time.Time{}, errors.New("malformed embedded signature")
+		}
+		slot, offset := be.Uint32(sig[12+8*i:]), be.Uint32(sig[16+8*i:])
+		if int(offset)+8 > len(sig) || int(offset)+int(be.Uint32(sig[offset+4:])) > len(sig) {
+			return nil, time.Time{}, fmt.Errorf("blob in slot %#x out of bounds", slot)
+		}
+		blobs[slot] = sig[offset : offset+be.Uint32(sig[offset+4:])]
+	}
+	directory := blobs[csSlotCodeDirectory]
+	if len(directory) < codeDirectorySize || be.Uint32(directory) != csMagicCodeDirectory {
+		return nil, time.Time{}, errors.New("code directory missing")
+	}
+	var (
+		flags        = be.Uint32(directory[12:])
+		hashOffset   = int(be.Uint32(directory[16:]))
+		specialSlots = int(be.Uint32(directory[24:]))
+		codeSlots    = int(be.Uint32(directory[28:]))
+		codeLimit    = int(be.Uint32(directory[32:]))
+		hashSize     = int(directory[36])
+		hashType     = directory[37]
+		pageBits     = directory[39]
+	)
+	if hashType != csHashTypeSHA256 || hashSize != sha256.Size || pageBits == 0 {
+		return nil, time.Time{}, fmt.Errorf("unsupported code directory hash type %d", hashType)
+	}
+	if codeLimit > int(dataoff) || codeSlots != (codeLimit+1<<pageBits-1)>>pageBits {
+		return nil, time.Time{}, errors.New("code directory doesn't cover the file")
+	}
+	if hashOffset < specialSlots*hashSize || hashOffset+codeSlots*hashSize > len(directory) {
+		return nil, time.Time{}, errors.New("code directory hashes out of bounds")
+	}
+	for i := 0; i < codeSlots; i++ {
+		start := i << pageBits
+		hash := sha256.Sum256(data[start:min(start+1<<pageBits, codeLimit)])
+		if !bytes.Equal(hash[:], directory[hashOffset+i*hashSize:hashOffset+(i+1)*hashSize]) {
+			return nil, time.Time{}, fmt.Errorf("page %d doesn't match the signature, the file was modified after signing", i)
+		}
+	}
+	if requirements, ok := blobs[csSlotRequirements]; ok && specialSlots >= csSlotRequirements {
+		hash := sha256.Sum256(requirements)
+		if !bytes.Equal(hash[:], directory[hashOffset-csSlotRequirements*hashSize:hashOffset-(csSlotRequirements-1)*hashSize]) {
+			return nil, time.Time{}, errors.New("requirements don't match the signature")
+		}
+	}
+	// Ad-hoc signatures stop here, others must carry a CMS signature over the
+	// code directory
+	wrapper := blobs[csSlotSignature]
+	if len(wrapper) <= 8 {
+		if flags&csFlagAdhoc == 0 {
+			return nil, time.Time{}, errors.New("CMS signature missing")
+		}
+		return nil, time.Time{}, nil
+	}
+	sd, err := parseSignedData(wrapper[8:], directory)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var stamped time.Time
+	if token, ok := sd.Unsigned[oidTimeStampToken.String()]; ok {
+		stamp, err := parseSignedData(token, nil)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("invalid timestamp: %w", err)
+		}
+		if stamped, err = checkTimestamp(stamp, sd.Signature); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return sd.Signer, stamped, nil
+}
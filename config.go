@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is the optional YAML configuration file given with -config, for
+// settings too elaborate for the command line.
+type FileConfig struct {
+	Targets   TargetOverrides   `yaml:"targets"`   // Per-target overrides keyed by target glob
+	Libraries *LibraryPolicy    `yaml:"libraries"` // Allowed shared libraries, nil if not configured
+	Windows   *WindowsResources `yaml:"windows"`   // Resources embedded into Windows outputs, nil if not configured
+	Packages  *LinuxPackages    `yaml:"packages"`  // Distribution packages built from the Linux outputs, nil if not configured
+}
+
+// loadConfig reads and parses the configuration file at path. An empty path
+// yields an empty configuration.
+func loadConfig(path string) (*FileConfig, error) {
+	config := new(FileConfig)
+	if path == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Names of the files xgo cross-files generates in its output folder.
+const (
+	cmakeToolchainFile = "toolchain.cmake"
+	mesonCrossFile     = "cross.ini"
+)
+
+// crossCPU describes the processor of a Go architecture the way CMake and
+// Meson name it.
+type crossCPU struct {
+	Processor string // CMAKE_SYSTEM_PROCESSOR and the Meson cpu
+	Family    string // Meson cpu_family
+	Endian    string // Meson endian
+}
+
+// crossCPUs maps every Go architecture in the target registry to its processor.
+var crossCPUs = map[string]crossCPU{
+	"amd64":    {"x86_64", "x86_64", "little"},
+	"386":      {"i686", "x86", "little"},
+	"arm":      {"arm", "arm", "little"},
+	"arm64":    {"aarch64", "aarch64", "little"},
+	"mips64":   {"mips64", "mips64", "big"},
+	"mips64le": {"mips64el", "mips64", "little"},
+	"mips":     {"mips", "mips", "big"},
+	"mipsle":   {"mipsel", "mips", "little"},
+	"s390x":    {"s390x", "s390x", "big"},
+	"riscv64":  {"riscv64", "riscv64", "little"},
+	"ppc64le":  {"ppc64le", "ppc64", "little"},
+}
+
+// crossSystems maps every Go operating system in the target registry to its
+// CMake system name, Meson uses the lower case form.
+var crossSystems = map[string]string{
+	"linux":   "Linux",
+	"windows": "Windows",
+	"darwin":  "Darwin",
+	"freebsd": "FreeBSD",
+}
+
+// crossToolchain is the C toolchain build.sh sets up for a target, from which
+// the CMake toolchain file and Meson cross file are generated.
+type crossToolchain struct {
+	Target   Target
+	CPU      crossCPU
+	CC       []string // C compiler and its leading arguments (e.g. gcc -m32)
+	CXX      []string // C++ compiler and its leading arguments
+	CFlags   []string // Extra flags of the C compiler (CFLAGS)
+	CXXFlags []string // Extra flags of the C++ compiler (CXXFLAGS)
+	Prefix   string   // Folder the dependencies are installed into and looked up in
+	Tools    string   // Prefix of the binutils matching the compiler, if any
+}
+
+// writeCrossFiles implements xgo cross-files: it generates a CMake toolchain
+// file and a Meson cross file for the target build.sh is compiling into a
+// folder. The target is read from XGOOS and XGOARCH, its toolchain from CC,
+// CXX, CFLAGS, CXXFLAGS and PREFIX, as do_build exports them to build_deps.sh.
+func writeCrossFiles(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s cross-files <folder>", os.Args[0])
+	}
+	target, err := lookupTarget(os.Getenv("XGOOS"), os.Getenv("XGOARCH"))
+	if err != nil {
+		return err
+	}
+	toolchain, err := newCrossToolchain(target, os.Getenv)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(args[0], 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(args[0], cmakeToolchainFile), []byte(toolchain.cmake()), 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(args[0], mesonCrossFile), []byte(toolchain.meson()), 0o644)
+}
+
+// lookupTarget finds the registry target build.sh names by its XGOOS and
+// XGOARCH, carrying the platform version of windows and darwin targets (e.g.
+// windows-10.0) and the C library of linux ones (e.g. linux-musl).
+func lookupTarget(xgoos, xgoarch string) (Target, error) {
+	goos, variant, _ := strings.Cut(xgoos, "-")
+	for _, target := range targetRegistry {
+		if target.OS != goos || target.Arch != xgoarch {
+			continue
+		}
+		if goos == "linux" {
+			if target.Libc != variant {
+				continue
+			}
+		} else if variant != "" {
+			target.Platform = variant
+		}
+		return target, nil
+	}
+	return Target{}, fmt.Errorf("unknown target %s/%s", xgoos, xgoarch)
+}
+
+// newCrossToolchain assembles the toolchain of a target from the environment
+// build.sh compiles it in. Without a compiler the system one is used, as it is
+// for the native linux target.
+func newCrossToolchain(target Target, getenv func(string) string) (*crossToolchain, error) {
+	cpu, ok := crossCPUs[target.GoArch]
+	if !ok {
+		return nil, fmt.Errorf("no processor known for target %s", target)
+	}
+	if _, ok := crossSystems[target.OS]; !ok {
+		return nil, fmt.Errorf("no system known for target %s", target)
+	}
+	toolchain := &crossToolchain{
+		Target:   target,
+		CPU:      cpu,
+		CC:       strings.Fields(getenv("CC")),
+		CXX:      strings.Fields(getenv("CXX")),
+		CFlags:   strings.Fields(getenv("CFLAGS")),
+		CXXFlags: strings.Fields(getenv("CXXFLAGS")),
+		Prefix:   getenv("PREFIX"),
+	}
+	if len(toolchain.CC) == 0 {
+		toolchain.CC = []string{"gcc"}
+	}
+	if len(toolchain.CXX) == 0 {
+		toolchain.CXX = []string{"g++"}
+	}
+	if toolchain.Prefix == "" {
+		return nil, fmt.Errorf("no install prefix set for target %s", target)
+	}
+	// Cross compilers named by their triple (e.g. aarch64-linux-gnu-gcc or
+	// x86_64-w64-mingw32-gcc-posix) come with binutils of the same prefix
+	compiler := toolchain.CC[0]
+	for _, name := range []string{"-gcc", "-clang"} {
+		if i := strings.LastIndex(compiler, name); i > 0 && strings.Count(compiler[:i], "-") >= 1 {
+			toolchain.Tools = compiler[:i+1]
+			break
+		}
+	}
+	return toolchain, nil
+}
+
+// native reports whether the target is the platform the image itself runs on,
+// in which case CMake must not be told it is cross compiling, or it would stop
+// finding the system libraries.
+func (t *crossToolchain) native() bool {
+	return t.Target.OS == runtime.GOOS && t.Target.GoArch == runtime.GOARCH && t.Target.Libc == ""
+}
+
+// processor returns the processor name CMake expects, which on macOS follows
+// the Apple naming of the architecture.
+func (t *crossToolchain) processor() string {
+	if t.Target.OS == "darwin" && t.Target.GoArch == "arm64" {
+		return "arm64"
+	}
+	return t.CPU.Processor
+}
+
+// cmake renders the CMake toolchain file of the target. Libraries, headers and
+// packages are only looked up in the install prefix, programs only on the host.
+func (t *crossToolchain) cmake() string {
+	var b strings.Builder
+	set := func(name, value string) {
+		fmt.Fprintf(&b, "set(%s %s)\n", name, cmakeQuote(value))
+	}
+	fmt.Fprintf(&b, "# CMake toolchain file for %s, generated by xgo\n", describeTarget(t.Target))
+	if !t.native() {
+		set("CMAKE_SYSTEM_NAME", crossSystems[t.Target.OS])
+		set("CMAKE_SYSTEM_PROCESSOR", t.processor())
+	}
+	set("CMAKE_C_COMPILER", t.CC[0])
+	set("CMAKE_CXX_COMPILER", t.CXX[0])
+	if len(t.CC) > 1 {
+		set("CMAKE_C_FLAGS_INIT", strings.Join(t.CC[1:], " "))
+	}
+	if len(t.CXX) > 1 {
+		set("CMAKE_CXX_FLAGS_INIT", strings.Join(t.CXX[1:], " "))
+	}
+	if t.Tools != "" {
+		set("CMAKE_AR", t.Tools+"ar")
+		set("CMAKE_RANLIB", t.Tools+"ranlib")
+		set("CMAKE_STRIP", t.Tools+"strip")
+		if t.Target.OS == "windows" {
+			set("CMAKE_RC_COMPILER", t.Tools+"windres")
+		}
+	}
+	if t.Target.OS == "darwin" {
+		set("CMAKE_OSX_ARCHITECTURES", t.processor())
+		if t.Target.Platform != "" {
+			set("CMAKE_OSX_DEPLOYMENT_TARGET", t.Target.Platform)
+		}
+	}
+	set("CMAKE_PREFIX_PATH", t.Prefix)
+	if !t.native() {
+		set("CMAKE_FIND_ROOT_PATH", t.Prefix)
+		set("CMAKE_FIND_ROOT_PATH_MODE_PROGRAM", "NEVER")
+		set("CMAKE_FIND_ROOT_PATH_MODE_LIBRARY", "ONLY")
+		set("CMAKE_FIND_ROOT_PATH_MODE_INCLUDE", "ONLY")
+		set("CMAKE_FIND_ROOT_PATH_MODE_PACKAGE", "ONLY")
+	}
+	return b.String()
+}
+
+// meson renders the Meson cross file of the target. Dependencies are found
+// through the pkg-config files installed into the prefix.
+func (t *crossToolchain) meson() string {
+	var b strings.Builder
+	set := func(name, value string) {
+		fmt.Fprintf(&b, "%s = %s\n", name, mesonQuote(value))
+	}
+	list := func(name string, values []string) {
+		quoted := make([]string, len(values))
+		for i, value := range values {
+			quoted[i] = mesonQuote(value)
+		}
+		fmt.Fprintf(&b, "%s = [%s]\n", name, strings.Join(quoted, ", "))
+	}
+	cpu := t.CPU.Processor
+	if t.Target.GoArm != "" {
+		cpu = "armv" + t.Target.GoArm
+	}
+	fmt.Fprintf(&b, "# Meson cross file for %s, generated by xgo\n", describeTarget(t.Target))
+	b.WriteString("[host_machine]\n")
+	set("system", strings.ToLower(crossSystems[t.Target.OS]))
+	set("cpu_family", t.CPU.Family)
+	set("cpu", cpu)
+	set("endian", t.CPU.Endian)
+
+	b.WriteString("\n[binaries]\n")
+	list("c", t.CC)
+	list("cpp", t.CXX)
+	if t.Tools != "" {
+		set("ar", t.Tools+"ar")
+		set("strip", t.Tools+"strip")
+		if t.Target.OS == "windows" {
+			set("windres", t.Tools+"windres")
+		}
+	}
+	set("pkg-config", "pkg-config")
+
+	b.WriteString("\n[properties]\n")
+	set("pkg_config_libdir", filepath.Join(t.Prefix, "lib", "pkgconfig"))
+
+	// Meson ignores the compiler flags of the environment when cross compiling
+	cflags, cxxflags := t.CFlags, t.CXXFlags
+	if t.Target.OS == "darwin" {
+		cflags = append([]string{"-arch", t.processor()}, cflags...)
+		cxxflags = append([]string{"-arch", t.processor()}, cxxflags...)
+	}
+	if len(cflags) > 0 || len(cxxflags) > 0 {
+		b.WriteString("\n[built-in options]\n")
+		if len(cflags) > 0 {
+			list("c_args", cflags)
+		}
+		if len(cxxflags) > 0 {
+			list("cpp_args", cxxflags)
+		}
+	}
+	return b.String()
+}
+
+// cmakeQuote quotes a value as a CMake string argument.
+func cmakeQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(value) + `"`
+}
+
+// mesonQuote quotes a value as a Meson string literal.
+func mesonQuote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
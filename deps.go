@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// depsFieldSeparator separates the fields of a line of xgo deps-plan, as
+// build_deps.sh splits them into an array with read -a.
+const depsFieldSeparator = "\x1f"
+
+// Build systems a dependency may be built with.
+var depsBuildSystems = map[string]bool{"autotools": true, "cmake": true, "meson": true}
+
+// DepsManifest is the dependency manifest given with -deps-file (conventionally
+// xgo-deps.yaml), describing every CGO dependency and how to build it.
+type DepsManifest struct {
+	Dependencies []Dependency `yaml:"dependencies"`
+}
+
+// Dependency is a single C library in the dependency manifest.
+type Dependency struct {
+	Name       string     `yaml:"name" json:"name"`             // Unique name, referenced by depends
+	URL        string     `yaml:"url" json:"url"`               // Archive to download
+	SHA256     string     `yaml:"sha256" json:"sha256"`         // Expected checksum of the archive
+	Build      string     `yaml:"build" json:"build"`           // autotools, cmake or meson, detected if empty
+	Args       []string   `yaml:"args" json:"args"`             // Arguments of configure, cmake or meson setup
+	TargetArgs TargetArgs `yaml:"targetArgs" json:"targetArgs"` // Arguments appended for the targets matching a glob
+	Depends    []string   `yaml:"depends" json:"depends"`       // Dependencies to build before this one
+	Targets    []string   `yaml:"targets" json:"targets"`       // Target globs to build for, all if empty
+}
+
+// TargetArg holds the build arguments of a dependency for the targets matching a glob.
+type TargetArg struct {
+	Match string   `json:"match"` // Target glob (e.g. windows/*, linux/arm-*)
+	Args  []string `json:"args"`  // Arguments appended to the common ones
+}
+
+// TargetArgs is an ordered list of per-target arguments. In the manifest it is a
+// mapping from target glob to arguments, applied in document order.
+type TargetArgs []TargetArg
+
+// UnmarshalYAML decodes the target glob mapping, preserving its order.
+func (a *TargetArgs) UnmarshalYAML(node *yaml.Node) error {
+	return decodeTargetGlobs(node, "targetArgs", "arguments", func(glob string, value *yaml.Node) error {
+		arg := TargetArg{Match: glob}
+		if err := value.Decode(&arg.Args); err != nil {
+			return err
+		}
+		*a = append(*a, arg)
+		return nil
+	})
+}
+
+// loadDepsManifest reads and validates the dependency manifest at path,
+// returning its dependencies in build order.
+func loadDepsManifest(path string) ([]Dependency, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dependency manifest: %w", err)
+	}
+	manifest := new(DepsManifest)
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse dependency manifest %s: %w", path, err)
+	}
+	if err := validateDependencies(manifest.Dependencies); err != nil {
+		return nil, fmt.Errorf("invalid dependency manifest %s: %w", path, err)
+	}
+	return sortDependencies(manifest.Dependencies)
+}
+
+// validateDependencies checks the entries of the dependency manifest for
+// missing, duplicate or malformed fields.
+func validateDependencies(deps []Dependency) error {
+	var (
+		names    = make(map[string]bool)
+		archives = make(map[string]string)
+	)
+	for _, dep := range deps {
+		if dep.Name == "" || strings.ContainsAny(dep.Name, "/\\ ") {
+			return fmt.Errorf("dependency name %q must be non-empty and free of slashes and spaces", dep.Name)
+		}
+		if names[dep.Name] {
+			return fmt.Errorf("dependency %s is listed twice", dep.Name)
+		}
+		names[dep.Name] = true
+
+		if dep.URL == "" || strings.Contains(dep.URL, " ") {
+			return fmt.Errorf("dependency %s needs a url without spaces", dep.Name)
+		}
+		// Archives are cached by file name, so they must not overwrite each other
+		archive := filepath.Base(dep.URL)
+		if other, ok := archives[archive]; ok {
+			return fmt.Errorf("dependencies %s and %s both download %s", other, dep.Name, archive)
+		}
+		archives[archive] = dep.Name
+
+		if sum, err := hex.DecodeString(dep.SHA256); dep.SHA256 != "" && (err != nil || len(sum) != 32) {
+			return fmt.Errorf("dependency %s has an invalid sha256 %q", dep.Name, dep.SHA256)
+		}
+		if dep.Build != "" && !depsBuildSystems[dep.Build] {
+			return fmt.Errorf("dependency %s has unknown build system %q, expected autotools, cmake or meson", dep.Name, dep.Build)
+		}
+		for _, glob := range dep.Targets {
+			if err := validateTargetGlob(glob); err != nil {
+				return fmt.Errorf("dependency %s: %w", dep.Name, err)
+			}
+		}
+		args := append([]string{}, dep.Args...)
+		for _, targetArg := range dep.TargetArgs {
+			args = append(args, targetArg.Args...)
+		}
+		for _, arg := range args {
+			if arg == "" || strings.ContainsAny(arg, "\n"+depsFieldSeparator) {
+				return fmt.Errorf("dependency %s has an empty or multi-line argument %q", dep.Name, arg)
+			}
+		}
+	}
+	for _, dep := range deps {
+		for _, name := range dep.Depends {
+			if !names[name] {
+				return fmt.Errorf("dependency %s depends on unknown dependency %s", dep.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// sortDependencies orders the dependencies so every one comes after those it
+// depends on, keeping the manifest order otherwise.
+func sortDependencies(deps []Dependency) ([]Dependency, error) {
+	var (
+		sorted []Dependency
+		done   = make(map[string]bool)
+	)
+	for len(sorted) < len(deps) {
+		progress := false
+		for _, dep := range deps {
+			if done[dep.Name] {
+				continue
+			}
+			ready := true
+			for _, name := range dep.Depends {
+				ready = ready && done[name]
+			}
+			if ready {
+				sorted, done[dep.Name], progress = append(sorted, dep), true, true
+				break
+			}
+		}
+		if !progress {
+			var cycle []string
+			for _, dep := range deps {
+				if !done[dep.Name] {
+					cycle = append(cycle, dep.Name)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle between %s", strings.Join(cycle, ", "))
+		}
+	}
+	return sorted, nil
+}
+
+// dependencyURLs returns the archives of the dependencies in the space separated
+// form of -deps, which is what gets downloaded and passed to build.sh.
+func dependencyURLs(deps []Dependency) string {
+	urls := make([]string, len(deps))
+	for i, dep := range deps {
+		urls[i] = dep.URL
+	}
+	return strings.Join(urls, " ")
+}
+
+// checkDependencySum makes sure a cached dependency archive has the checksum
+// the manifest expects, if it names one.
+func checkDependencySum(archive string, dep Dependency) error {
+	if dep.SHA256 == "" {
+		return nil
+	}
+	sum, err := fileSHA256(archive)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, dep.SHA256) {
+		return fmt.Errorf("checksum mismatch, have sha256 %s, want %s", sum, dep.SHA256)
+	}
+	return nil
+}
+
+// dependencyDir returns the folder build.sh unpacks a manifest dependency
+// into. The index prefix makes the folders list in build order.
+func dependencyDir(index int, name string) string {
+	return fmt.Sprintf("%03d-%s", index+1, name)
+}
+
+// manifestDependencies decodes the ordered dependency manifest the wrapper
+// passes to build.sh in DEPS_MANIFEST, nil if the build has none.
+func manifestDependencies() ([]Dependency, error) {
+	return decodeDependencies(os.Getenv("DEPS_MANIFEST"))
+}
+
+// decodeDependencies decodes the JSON encoded dependency manifest of a build
+// (ConfigFlags.DepsManifest), nil if the build has none.
+func decodeDependencies(data string) ([]Dependency, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var deps []Dependency
+	if err := json.Unmarshal([]byte(data), &deps); err != nil {
+		return nil, fmt.Errorf("failed to decode dependency manifest: %w", err)
+	}
+	return deps, nil
+}
+
+// planDependencies implements xgo deps-plan: it prints the dependencies in a
+// folder that build_deps.sh should build for the current target, one per line
+// in build order, as the folder, the build system and the build arguments. With
+// a dependency manifest its order, targets and arguments apply, otherwise every
+// folder is built with the arguments given on the command line (-depsargs),
+// which only configure scripts receive.
+func planDependencies(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: %s deps-plan <folder> [configure argument...]", os.Args[0])
+	}
+	folder := args[0]
+
+	deps, err := manifestDependencies()
+	if err != nil {
+		return err
+	}
+	var lines []string
+	if deps == nil {
+		entries, err := os.ReadDir(folder)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			dir := filepath.Join(folder, entry.Name())
+			build, err := detectBuildSystem(dir)
+			if err != nil {
+				return fmt.Errorf("dependency %s: %w", entry.Name(), err)
+			}
+			fields := []string{dir, build}
+			if build == "autotools" {
+				fields = append(fields, args[1:]...)
+			}
+			lines = append(lines, strings.Join(fields, depsFieldSeparator))
+		}
+	} else {
+		target, err := lookupTarget(os.Getenv("XGOOS"), os.Getenv("XGOARCH"))
+		if err != nil {
+			return err
+		}
+		for i, dep := range deps {
+			if !dep.builtFor(target) {
+				continue
+			}
+			dir := filepath.Join(folder, dependencyDir(i, dep.Name))
+			build := dep.Build
+			if build == "" {
+				if build, err = detectBuildSystem(dir); err != nil {
+					return fmt.Errorf("dependency %s: %w", dep.Name, err)
+				}
+			}
+			fields := append([]string{dir, build}, dep.argsFor(target)...)
+			lines = append(lines, strings.Join(fields, depsFieldSeparator))
+		}
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// detectBuildSystem picks the build system of a dependency from the files in
+// its folder, preferring CMake and Meson over a configure script.
+func detectBuildSystem(dir string) (string, error) {
+	for _, probe := range []struct{ file, build string }{
+		{"CMakeLists.txt", "cmake"},
+		{"meson.build", "meson"},
+		{"configure", "autotools"},
+	} {
+		if _, err := os.Stat(filepath.Join(dir, probe.file)); err == nil {
+			return probe.build, nil
+		}
+	}
+	return "", fmt.Errorf("no CMakeLists.txt, meson.build or configure script found")
+}
+
+// builtFor reports whether the dependency is built for the given target.
+func (d Dependency) builtFor(target Target) bool {
+	if len(d.Targets) == 0 {
+		return true
+	}
+	for _, glob := range d.Targets {
+		if matchTarget(glob, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// argsFor returns the build arguments of the dependency for the given target,
+// the common ones followed by those of every matching target glob.
+func (d Dependency) argsFor(target Target) []string {
+	args := append([]string{}, d.Args...)
+	for _, targetArg := range d.TargetArgs {
+		if matchTarget(targetArg.Match, target) {
+			args = append(args, targetArg.Args...)
+		}
+	}
+	return args
+}
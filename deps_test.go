@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Tests that dependency manifests are decoded with their target arguments in
+// document order and sorted so dependencies are built first.
+func TestLoadDepsManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xgo-deps.yaml")
+	manifest := `dependencies:
+  - name: curl
+    url: https://example.com/curl.tar.gz
+    depends: [zlib]
+    targetArgs:
+      "windows/*": [--with-schannel]
+      "*/*": [--disable-ldap]
+  - name: zlib
+    url: https://example.com/zlib.tar.gz
+    build: cmake
+`
+	if err := os.WriteFile(path, []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deps, err := loadDepsManifest(path)
+	if err != nil {
+		t.Fatalf("failed to load manifest: %v", err)
+	}
+	if len(deps) != 2 || deps[0].Name != "zlib" || deps[1].Name != "curl" {
+		t.Fatalf("build order mismatch: have %v", deps)
+	}
+	want := TargetArgs{{"windows/*", []string{"--with-schannel"}}, {"*/*", []string{"--disable-ldap"}}}
+	if !reflect.DeepEqual(deps[1].TargetArgs, want) {
+		t.Errorf("target arguments mismatch: have %v, want %v", deps[1].TargetArgs, want)
+	}
+	windows, _ := lookupTarget("windows", "amd64")
+	if args := deps[1].argsFor(windows); !reflect.DeepEqual(args, []string{"--with-schannel", "--disable-ldap"}) {
+		t.Errorf("windows arguments mismatch: have %v", args)
+	}
+}
+
+// Tests that malformed target globs are rejected wherever they are given.
+func TestLoadDepsManifestInvalidGlob(t *testing.T) {
+	for _, manifest := range []string{
+		"dependencies:\n  - name: zlib\n    url: https://example.com/zlib.tar.gz\n    targets: [\"linux/[\"]\n",
+		"dependencies:\n  - name: zlib\n    url: https://example.com/zlib.tar.gz\n    targetArgs:\n      \"linux/[\": [--static]\n",
+	} {
+		path := filepath.Join(t.TempDir(), "xgo-deps.yaml")
+		if err := os.WriteFile(path, []byte(manifest), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadDepsManifest(path); err == nil || !strings.Contains(err.Error(), `invalid target glob "linux/["`) {
+			t.Errorf("error mismatch: have %v, want an invalid glob", err)
+		}
+	}
+}
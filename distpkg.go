@@ -0,0 +1,505 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LinuxPackages describes the distribution packages built from the Linux
+// outputs with -linux-packages, configured in the packages section of the
+// -config file.
+type LinuxPackages struct {
+	Name        string         `yaml:"name"`        // Package name
+	Version     string         `yaml:"version"`     // Upstream version, defaults to the git tag
+	Release     string         `yaml:"release"`     // Package release, defaults to 1
+	Maintainer  string         `yaml:"maintainer"`  // Name and email of the maintainer
+	Description string         `yaml:"description"` // Summary line, optionally followed by a longer description
+	Homepage    string         `yaml:"homepage"`    // Project URL
+	License     string         `yaml:"license"`     // License of the packaged software
+	Depends     []string       `yaml:"depends"`     // Packages required at runtime
+	BinDir      string         `yaml:"bindir"`      // Folder the executables are installed into, defaults to /usr/bin
+	Files       []PackageFile  `yaml:"files"`       // Additional files to install
+	Units       []string       `yaml:"units"`       // Systemd units to install
+	Scripts     PackageScripts `yaml:"scripts"`     // Maintainer scripts run around installation and removal
+}
+
+// PackageFile is an additional file installed by the distribution packages.
+type PackageFile struct {
+	Src    string `yaml:"src"`    // File to install, relative to the config file
+	Dst    string `yaml:"dst"`    // Absolute installation path
+	Mode   string `yaml:"mode"`   // Octal permissions, defaults to 0644
+	Config bool   `yaml:"config"` // Whether local modifications are kept on upgrades
+}
+
+// PackageScripts are the maintainer scripts of the distribution packages.
+type PackageScripts struct {
+	PreInstall  string `yaml:"preinstall"`
+	PostInstall string `yaml:"postinstall"`
+	PreRemove   string `yaml:"preremove"`
+	PostRemove  string `yaml:"postremove"`
+}
+
+// packageFormats maps the formats accepted by -linux-packages to their writers.
+var packageFormats = map[string]func(path string, pkg *distPackage) error{
+	"deb": writeDeb,
+	"rpm": writeRPM,
+	"apk": writeAPK,
+}
+
+// packageArches maps xgo architectures to their name in each package format.
+// Architectures a distribution doesn't support are missing, as is arm-6 for
+// deb, since Debian has a single soft-float port already taken by arm-5.
+var packageArches = map[string]map[string]string{
+	"amd64":    {"deb": "amd64", "rpm": "x86_64", "apk": "x86_64"},
+	"386":      {"deb": "i386", "rpm": "i686", "apk": "x86"},
+	"arm-5":    {"deb": "armel", "rpm": "armv5tel"},
+	"arm-6":    {"rpm": "armv6l", "apk": "armhf"},
+	"arm-7":    {"deb": "armhf", "rpm": "armv7hl", "apk": "armv7"},
+	"arm64":    {"deb": "arm64", "rpm": "aarch64", "apk": "aarch64"},
+	"mips":     {"deb": "mips", "rpm": "mips"},
+	"mipsle":   {"deb": "mipsel", "rpm": "mipsel"},
+	"mips64":   {"deb": "mips64", "rpm": "mips64"},
+	"mips64le": {"deb": "mips64el", "rpm": "mips64el"},
+	"ppc64le":  {"deb": "ppc64el", "rpm": "ppc64le", "apk": "ppc64le"},
+	"riscv64":  {"deb": "riscv64", "rpm": "riscv64", "apk": "riscv64"},
+	"s390x":    {"deb": "s390x", "rpm": "s390x", "apk": "s390x"},
+}
+
+// hardFloatArches are the package architectures using the ARM hard-float ABI.
+// The arm targets are built soft-float, so only statically linked outputs,
+// which don't load any of the system's libraries, are packaged for these.
+var hardFloatArches = map[string]bool{"armhf": true, "armv7hl": true, "armv7": true}
+
+// packageName matches the package names every format accepts.
+var packageName = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+
+// systemdUnitDir is the folder systemd units are installed into.
+const systemdUnitDir = "/usr/lib/systemd/system"
+
+// distPackage is the content of a distribution package for a single target.
+type distPackage struct {
+	Spec    *LinuxPackages
+	Version string            // Upstream version, normalized by each format
+	Arch    string            // Architecture as named by the package format
+	Files   []packageEntry    // Installed files, sorted by path
+	Scripts map[string][]byte // Maintainer scripts keyed by PackageScripts field
+	Time    time.Time         // Modification time of every entry
+}
+
+// packageEntry is a single file installed by a distribution package.
+type packageEntry struct {
+	Path   string // Absolute installation path
+	Mode   uint32 // Unix permission bits
+	Data   []byte
+	Config bool
+}
+
+// resolve makes the file, unit and script paths relative to the config file
+// absolute, and fills in the defaults.
+func (p *LinuxPackages) resolve(dir string) {
+	abs := func(file *string) {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(dir, *file)
+		}
+	}
+	for i := range p.Files {
+		abs(&p.Files[i].Src)
+	}
+	for i := range p.Units {
+		abs(&p.Units[i])
+	}
+	for _, script := range []*string{&p.Scripts.PreInstall, &p.Scripts.PostInstall, &p.Scripts.PreRemove, &p.Scripts.PostRemove} {
+		abs(script)
+	}
+	if p.Release == "" {
+		p.Release = "1"
+	}
+	if p.BinDir == "" {
+		p.BinDir = "/usr/bin"
+	}
+}
+
+// validate checks the package description for missing or malformed fields.
+func (p *LinuxPackages) validate() error {
+	if p.Name == "" || p.Maintainer == "" || p.Description == "" {
+		return fmt.Errorf("packages section needs a name, maintainer and description")
+	}
+	if !packageName.MatchString(p.Name) {
+		return fmt.Errorf("invalid package name %q, use lowercase letters, digits and +.-", p.Name)
+	}
+	if _, err := strconv.ParseUint(p.Release, 10, 32); err != nil {
+		return fmt.Errorf("invalid package release %q, expected a number", p.Release)
+	}
+	for _, file := range p.Files {
+		if file.Src == "" || !path.IsAbs(file.Dst) {
+			return fmt.Errorf("package file %q needs a src and an absolute dst", file.Dst)
+		}
+		if _, err := parseFileMode(file.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseFileMode parses octal permissions, defaulting to 0644.
+func parseFileMode(mode string) (uint32, error) {
+	if mode == "" {
+		return 0o644, nil
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0o7777 {
+		return 0, fmt.Errorf("invalid file mode %q, expected octal permissions", mode)
+	}
+	return uint32(perm), nil
+}
+
+// parsePackageFormats splits the comma separated -linux-packages flag.
+func parsePackageFormats(list string) ([]string, error) {
+	var formats []string
+	for _, format := range strings.Split(list, ",") {
+		if format = strings.TrimSpace(format); format == "" {
+			continue
+		}
+		if _, ok := packageFormats[format]; !ok {
+			return nil, fmt.Errorf("unsupported package format %s, expected deb, rpm or apk", format)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// buildLinuxPackages writes a distribution package in each format for every
+// Linux target, holding the executables of all packages built for it. The deb
+// and rpm packages are built from the glibc outputs, apk packages from the musl
+// ones where available. It returns the paths of the packages written.
+func buildLinuxPackages(folder string, artifacts []Artifact, git gitInfo, config *ConfigFlags, flags *BuildFlags) ([]string, error) {
+	spec := config.Packaging
+	version := spec.Version
+	if version == "" {
+		if version = git.Tag; version == "" {
+			version = "0.0.0"
+		}
+	}
+	modified := time.Now()
+	if flags.SourceDateEpoch != 0 {
+		modified = time.Unix(flags.SourceDateEpoch, 0)
+	}
+	names := executableNames(config)
+	// The files beside the executables are the same for every target
+	var common []packageEntry
+	for _, file := range spec.Files {
+		data, err := os.ReadFile(file.Src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read package file: %w", err)
+		}
+		mode, _ := parseFileMode(file.Mode)
+		common = append(common, packageEntry{Path: path.Clean(file.Dst), Mode: mode, Data: data, Config: file.Config})
+	}
+	for _, unit := range spec.Units {
+		data, err := os.ReadFile(unit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read systemd unit: %w", err)
+		}
+		common = append(common, packageEntry{Path: path.Join(systemdUnitDir, filepath.Base(unit)), Mode: 0o644, Data: data})
+	}
+	scripts := make(map[string][]byte)
+	for name, file := range map[string]string{"preinstall": spec.Scripts.PreInstall, "postinstall": spec.Scripts.PostInstall, "preremove": spec.Scripts.PreRemove, "postremove": spec.Scripts.PostRemove} {
+		if file == "" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s script: %w", name, err)
+		}
+		scripts[name] = data
+	}
+	order, grouped := groupLinuxArtifacts(artifacts)
+
+	var written []string
+	for _, format := range config.PackageTypes {
+		for _, target := range order {
+			arch, ok := packageArches[target.Arch][format]
+			if !ok {
+				fmt.Printf("Skipping %s package for %s, unsupported architecture.\n", format, target)
+				continue
+			}
+			// Use the musl outputs for Alpine and the glibc ones for the rest,
+			// falling back to glibc builds for Alpine only if they are static
+			if format == "apk" && target.Libc == "" {
+				if hasMuslOutputs(target, grouped) {
+					continue
+				}
+				if !staticallyLinked(grouped[target.String()]) {
+					fmt.Printf("Skipping %s package for %s, no musl outputs and the glibc ones are dynamically linked.\n", format, target)
+					continue
+				}
+			}
+			if format != "apk" && target.Libc != "" {
+				continue
+			}
+			if hardFloatArches[arch] && target.FloatABI == "soft" && !staticallyLinked(grouped[target.String()]) {
+				fmt.Printf("Skipping %s package for %s, the soft-float outputs are dynamically linked but %s is hard-float.\n", format, target, arch)
+				continue
+			}
+			pkg := &distPackage{Spec: spec, Version: version, Arch: arch, Scripts: scripts, Time: modified}
+			for _, artifact := range grouped[target.String()] {
+				data, err := os.ReadFile(artifact.Path)
+				if err != nil {
+					return nil, err
+				}
+				pkg.Files = append(pkg.Files, packageEntry{Path: path.Join(spec.BinDir, names[artifact.Package]), Mode: 0o755, Data: data})
+			}
+			pkg.Files = append(pkg.Files, common...)
+			sort.Slice(pkg.Files, func(i, j int) bool { return pkg.Files[i].Path < pkg.Files[j].Path })
+			for i := 1; i < len(pkg.Files); i++ {
+				if pkg.Files[i].Path == pkg.Files[i-1].Path {
+					return nil, fmt.Errorf("%s is installed by multiple package entries", pkg.Files[i].Path)
+				}
+			}
+			name, err := packageFileName(format, pkg)
+			if err != nil {
+				return nil, err
+			}
+			out := filepath.Join(folder, name)
+			if err := packageFormats[format](out, pkg); err != nil {
+				return nil, fmt.Errorf("failed to create %s: %w", name, err)
+			}
+			fmt.Printf("Created package %s\n", out)
+			written = append(written, out)
+		}
+	}
+	return written, nil
+}
+
+// executableNames maps every built package to the name its executable is
+// installed as.
+func executableNames(config *ConfigFlags) map[string]string {
+	packages := config.Packages
+	if len(packages) == 0 {
+		packages = []string{""}
+	}
+	names := make(map[string]string)
+	for i, name := range outputNames(config) {
+		names[packages[i]] = name
+	}
+	return names
+}
+
+// groupLinuxArtifacts groups the Linux executables by target, returning the
+// targets in registry order.
+func groupLinuxArtifacts(artifacts []Artifact) ([]Target, map[string][]Artifact) {
+	var (
+		order   []Target
+		grouped = make(map[string][]Artifact)
+	)
+	for _, artifact := range artifacts {
+		if artifact.Target.OS != "linux" {
+			continue
+		}
+		key := artifact.Target.String()
+		if grouped[key] == nil {
+			order = append(order, artifact.Target)
+		}
+		grouped[key] = append(grouped[key], artifact)
+	}
+	return order, grouped
+}
+
+// hasMuslOutputs reports whether musl outputs were built alongside the outputs
+// of a glibc target, which Alpine packages and OCI images use instead.
+func hasMuslOutputs(target Target, grouped map[string][]Artifact) bool {
+	musl := Target{OS: target.OS, Arch: target.Arch, Libc: "musl"}
+	return target.Libc == "" && grouped[musl.String()] != nil
+}
+
+// staticallyLinked reports whether none of the artifacts loads shared libraries,
+// so they run regardless of the C library of the system.
+func staticallyLinked(artifacts []Artifact) bool {
+	for _, artifact := range artifacts {
+		if len(artifact.Libraries) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// packageFileName returns the conventional file name of a package.
+func packageFileName(format string, pkg *distPackage) (string, error) {
+	version, err := packageVersion(format, pkg.Version)
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case "deb":
+		return fmt.Sprintf("%s_%s-%s_%s.deb", pkg.Spec.Name, version, pkg.Spec.Release, pkg.Arch), nil
+	case "rpm":
+		return fmt.Sprintf("%s-%s-%s.%s.rpm", pkg.Spec.Name, version, pkg.Spec.Release, pkg.Arch), nil
+	default:
+		return fmt.Sprintf("%s_%s-r%s_%s.apk", pkg.Spec.Name, version, pkg.Spec.Release, pkg.Arch), nil
+	}
+}
+
+// Version syntax of package formats: the dotted number every version starts
+// with, the characters allowed in deb and rpm pre-release suffixes, and the
+// pre-release suffixes apk supports.
+var (
+	packageBaseVersion = regexp.MustCompile(`^\d+(\.\d+)*$`)
+	packageSuffix      = regexp.MustCompile(`^[A-Za-z0-9.+~-]+$`)
+	apkSuffix          = regexp.MustCompile(`^(alpha|beta|pre|rc|p)\.?(\d*)$`)
+)
+
+// packageVersion converts an upstream version (e.g. v1.2.0-rc.1) into the
+// syntax of a package format, sorting pre-releases before the release.
+func packageVersion(format, version string) (string, error) {
+	version = strings.TrimPrefix(version, "v")
+	base, pre, _ := strings.Cut(version, "-")
+	if !packageBaseVersion.MatchString(base) {
+		return "", fmt.Errorf("version %q must start with a dotted number", version)
+	}
+	if pre == "" {
+		return base, nil
+	}
+	switch format {
+	case "apk":
+		match := apkSuffix.FindStringSubmatch(pre)
+		if match == nil {
+			return "", fmt.Errorf("version %q has a suffix apk doesn't support", version)
+		}
+		return base + "_" + match[1] + match[2], nil
+	default:
+		if !packageSuffix.MatchString(pre) {
+			return "", fmt.Errorf("version %q has an invalid suffix", version)
+		}
+		return base + "~" + strings.ReplaceAll(pre, "-", "."), nil
+	}
+}
+
+// packageDirs returns the parent folders of the installed files, excluding
+// the root, sorted so parents precede their children.
+func packageDirs(files []packageEntry) []string {
+	seen := make(map[string]bool)
+	for _, file := range files {
+		for dir := path.Dir(file.Path); dir != "/" && !seen[dir]; dir = path.Dir(dir) {
+			seen[dir] = true
+		}
+	}
+	dirs := make([]string, 0, len(seen))
+	for dir := range seen {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// dataEntries returns the tar entries of the installed files and their parent
+// folders, named with the given prefix. Folders precede their contents.
+func dataEntries(pkg *distPackage, prefix string) []tarEntry {
+	var entries []tarEntry
+	for _, dir := range packageDirs(pkg.Files) {
+		entries = append(entries, tarDir(prefix+strings.TrimPrefix(dir, "/"), pkg.Time))
+	}
+	for _, file := range pkg.Files {
+		entries = append(entries, tarFile(prefix+strings.TrimPrefix(file.Path, "/"), file.Mode, file.Data, pkg.Time))
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Header.Name < entries[j].Header.Name })
+	return entries
+}
+
+// installedSize returns the total size of the installed files.
+func installedSize(files []packageEntry) int64 {
+	var size int64
+	for _, file := range files {
+		size += int64(len(file.Data))
+	}
+	return size
+}
+
+// tarEntry is a single entry of a tarball written by writeTarball.
+type tarEntry struct {
+	Header *tar.Header
+	Data   []byte
+}
+
+// tarFile creates a root owned tar entry.
+func tarFile(name string, mode uint32, data []byte, modified time.Time) tarEntry {
+	return tarEntry{
+		Header: &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: int64(mode), Size: int64(len(data)), ModTime: modified, Uname: "root", Gname: "root", Format: tar.FormatPAX},
+		Data:   data,
+	}
+}
+
+// tarDir creates a root owned tar folder entry.
+func tarDir(name string, modified time.Time) tarEntry {
+	return tarEntry{
+		Header: &tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0o755, ModTime: modified, Uname: "root", Gname: "root", Format: tar.FormatPAX},
+	}
+}
+
+// writeTarball creates a gzip compressed tarball. Without end, the trailing
+// end of archive blocks are left out, so the result can be concatenated with
+// further tarballs (as apk packages are).
+func writeTarball(entries []tarEntry, end bool) ([]byte, error) {
+	data, err := writeTar(entries, end)
+	if err != nil {
+		return nil, err
+	}
+	return gzipBytes(data)
+}
+
+// writeTar creates an uncompressed tarball, optionally without the end of
+// archive blocks.
+func writeTar(entries []tarEntry, end bool) ([]byte, error) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(entry.Header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(entry.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	data := archive.Bytes()
+	if end {
+		if err := tw.Close(); err != nil {
+			return nil, err
+		}
+		data = archive.Bytes()
+	}
+	return data, nil
+}
+
+// gzipBytes compresses data with a reproducible gzip header.
+func gzipBytes(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&out, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// summary returns the first line of the package description.
+func (p *LinuxPackages) summary() string {
+	summary, _, _ := strings.Cut(strings.TrimSpace(p.Description), "\n")
+	return strings.TrimSpace(summary)
+}
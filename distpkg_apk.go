@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// apkScripts maps the maintainer scripts to their name in apk packages.
+var apkScripts = map[string]string{
+	"preinstall":  ".pre-install",
+	"postinstall": ".post-install",
+	"preremove":   ".pre-deinstall",
+	"postremove":  ".post-deinstall",
+}
+
+// writeAPK creates an unsigned Alpine package: the control tarball and the
+// data tarball as concatenated gzip streams. The control tarball lacks its end
+// of archive blocks, so the two read as a single tar stream.
+func writeAPK(path string, pkg *distPackage) error {
+	version, err := packageVersion("apk", pkg.Version)
+	if err != nil {
+		return err
+	}
+	// Assemble the installed files, each with the checksum apk records
+	data := dataEntries(pkg, "")
+	for _, entry := range data {
+		if entry.Header.Typeflag == tar.TypeReg {
+			entry.Header.PAXRecords = map[string]string{"APK-TOOLS.checksum.SHA1": fmt.Sprintf("%x", sha1.Sum(entry.Data))}
+		}
+	}
+	dataTar, err := writeTarball(data, true)
+	if err != nil {
+		return err
+	}
+	datahash := sha256.Sum256(dataTar)
+
+	// Assemble the package metadata, pinning the data by its hash
+	spec := pkg.Spec
+	var info strings.Builder
+	fmt.Fprintf(&info, "# Generated by xgo\n")
+	fmt.Fprintf(&info, "pkgname = %s\n", spec.Name)
+	fmt.Fprintf(&info, "pkgver = %s-r%s\n", version, spec.Release)
+	fmt.Fprintf(&info, "pkgdesc = %s\n", spec.summary())
+	if spec.Homepage != "" {
+		fmt.Fprintf(&info, "url = %s\n", spec.Homepage)
+	}
+	fmt.Fprintf(&info, "builddate = %d\n", pkg.Time.Unix())
+	fmt.Fprintf(&info, "packager = %s\n", spec.Maintainer)
+	fmt.Fprintf(&info, "size = %d\n", installedSize(pkg.Files))
+	fmt.Fprintf(&info, "arch = %s\n", pkg.Arch)
+	fmt.Fprintf(&info, "origin = %s\n", spec.Name)
+	if spec.License != "" {
+		fmt.Fprintf(&info, "license = %s\n", spec.License)
+	}
+	for _, dep := range spec.Depends {
+		fmt.Fprintf(&info, "depend = %s\n", dep)
+	}
+	fmt.Fprintf(&info, "datahash = %s\n", hex.EncodeToString(datahash[:]))
+
+	meta := []tarEntry{tarFile(".PKGINFO", 0o644, []byte(info.String()), pkg.Time)}
+	for _, name := range []string{"preinstall", "postinstall", "preremove", "postremove"} {
+		if script, ok := pkg.Scripts[name]; ok {
+			meta = append(meta, tarFile(apkScripts[name], 0o755, script, pkg.Time))
+		}
+	}
+	controlTar, err := writeTarball(meta, false)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(controlTar, dataTar...), 0o644)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// debScripts maps the maintainer scripts to their name in deb packages.
+var debScripts = map[string]string{
+	"preinstall":  "preinst",
+	"postinstall": "postinst",
+	"preremove":   "prerm",
+	"postremove":  "postrm",
+}
+
+// writeDeb creates a Debian binary package: an ar archive holding the format
+// version, the control tarball and the data tarball.
+func writeDeb(path string, pkg *distPackage) error {
+	version, err := packageVersion("deb", pkg.Version)
+	if err != nil {
+		return err
+	}
+	// Assemble the installed files and their checksums
+	data := append([]tarEntry{tarDir(".", pkg.Time)}, dataEntries(pkg, "./")...)
+
+	var (
+		sums      strings.Builder
+		conffiles strings.Builder
+	)
+	for _, file := range pkg.Files {
+		fmt.Fprintf(&sums, "%x  %s\n", md5.Sum(file.Data), strings.TrimPrefix(file.Path, "/"))
+		if file.Config {
+			fmt.Fprintln(&conffiles, file.Path)
+		}
+	}
+	dataTar, err := writeTarball(data, true)
+	if err != nil {
+		return err
+	}
+	// Assemble the package metadata and maintainer scripts
+	spec := pkg.Spec
+	var control strings.Builder
+	fmt.Fprintf(&control, "Package: %s\n", spec.Name)
+	fmt.Fprintf(&control, "Version: %s-%s\n", version, spec.Release)
+	fmt.Fprintf(&control, "Architecture: %s\n", pkg.Arch)
+	fmt.Fprintf(&control, "Maintainer: %s\n", spec.Maintainer)
+	fmt.Fprintf(&control, "Installed-Size: %d\n", (installedSize(pkg.Files)+1023)/1024)
+	if len(spec.Depends) > 0 {
+		fmt.Fprintf(&control, "Depends: %s\n", strings.Join(spec.Depends, ", "))
+	}
+	fmt.Fprintf(&control, "Section: misc\nPriority: optional\n")
+	if spec.Homepage != "" {
+		fmt.Fprintf(&control, "Homepage: %s\n", spec.Homepage)
+	}
+	fmt.Fprintf(&control, "Description: %s\n", debDescription(spec.Description))
+
+	meta := []tarEntry{
+		tarDir(".", pkg.Time),
+		tarFile("./control", 0o644, []byte(control.String()), pkg.Time),
+		tarFile("./md5sums", 0o644, []byte(sums.String()), pkg.Time),
+	}
+	if conffiles.Len() > 0 {
+		meta = append(meta, tarFile("./conffiles", 0o644, []byte(conffiles.String()), pkg.Time))
+	}
+	for _, name := range []string{"preinstall", "postinstall", "preremove", "postremove"} {
+		if script, ok := pkg.Scripts[name]; ok {
+			meta = append(meta, tarFile("./"+debScripts[name], 0o755, script, pkg.Time))
+		}
+	}
+	controlTar, err := writeTarball(meta, true)
+	if err != nil {
+		return err
+	}
+	// Bundle everything into the ar archive
+	var out bytes.Buffer
+	out.WriteString("!<arch>\n")
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlTar},
+		{"data.tar.gz", dataTar},
+	} {
+		fmt.Fprintf(&out, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", member.name, pkg.Time.Unix(), 0, 0, "100644", len(member.data))
+		out.Write(member.data)
+		if len(member.data)%2 == 1 {
+			out.WriteByte('\n')
+		}
+	}
+	return os.WriteFile(path, out.Bytes(), 0o644)
+}
+
+// debDescription formats a description as a control file field: the summary
+// followed by the indented extended description, blank lines written as dots.
+func debDescription(description string) string {
+	lines := strings.Split(strings.TrimSpace(description), "\n")
+	for i := 1; i < len(lines); i++ {
+		if line := strings.TrimRight(lines[i], " \t"); line == "" {
+			lines[i] = " ."
+		} else {
+			lines[i] = " " + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
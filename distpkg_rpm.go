@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// RPM header data types.
+const (
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeBin         = 7
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// RPM signature and header tags, from rpmtag.h.
+const (
+	rpmSigHeaderSignatures = 62
+	rpmSigSHA1             = 269
+	rpmSigSHA256           = 273
+	rpmSigSize             = 1000
+	rpmSigMD5              = 1004
+	rpmSigPayloadSize      = 1007
+
+	rpmTagHeaderImmutable   = 63
+	rpmTagI18NTable         = 100
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagLicense           = 1014
+	rpmTagPackager          = 1015
+	rpmTagGroup             = 1016
+	rpmTagURL               = 1020
+	rpmTagOS                = 1021
+	rpmTagArch              = 1022
+	rpmTagPreIn             = 1023
+	rpmTagPostIn            = 1024
+	rpmTagPreUn             = 1025
+	rpmTagPostUn            = 1026
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRdevs         = 1033
+	rpmTagFileMtimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagSourceRPM         = 1044
+	rpmTagFileVerifyFlags   = 1045
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagPreInProg         = 1085
+	rpmTagPostInProg        = 1086
+	rpmTagPreUnProg         = 1087
+	rpmTagPostUnProg        = 1088
+	rpmTagFileDevices       = 1095
+	rpmTagFileInodes        = 1096
+	rpmTagFileLangs         = 1097
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagFileDigestAlgo    = 5011
+	rpmTagPayloadDigest     = 5092
+	rpmTagPayloadDigestAlgo = 5093
+)
+
+// RPM dependency and file flags.
+const (
+	rpmSenseLess     = 1 << 1
+	rpmSenseEqual    = 1 << 3
+	rpmSenseRPMLib   = 1 << 24
+	rpmFileConfig    = 1 << 0
+	rpmFileNoReplace = 1 << 4
+	rpmDigestSHA256  = 8
+)
+
+// rpmScripts maps the maintainer scripts to their script and interpreter tags.
+var rpmScripts = map[string][2]int{
+	"preinstall":  {rpmTagPreIn, rpmTagPreInProg},
+	"postinstall": {rpmTagPostIn, rpmTagPostInProg},
+	"preremove":   {rpmTagPreUn, rpmTagPreUnProg},
+	"postremove":  {rpmTagPostUn, rpmTagPostUnProg},
+}
+
+// rpmLibFeatures are the rpm features the written packages rely on, required
+// so older rpm versions refuse them rather than misinterpret them.
+var rpmLibFeatures = [][2]string{
+	{"rpmlib(CompressedFileNames)", "3.0.4-1"},
+	{"rpmlib(FileDigests)", "4.6.0-1"},
+	{"rpmlib(PayloadFilesHavePrefix)", "4.0-1"},
+}
+
+// rpmHeader collects the entries of an RPM header structure.
+type rpmHeader struct {
+	entries []rpmEntry
+}
+
+// rpmEntry is a single tag of an RPM header with its encoded value.
+type rpmEntry struct {
+	Tag   int
+	Type  int
+	Count int
+	Data  []byte
+}
+
+func (h *rpmHeader) addString(tag int, value string) {
+	h.entries = append(h.entries, rpmEntry{tag, rpmTypeString, 1, append([]byte(value), 0)})
+}
+
+func (h *rpmHeader) addI18NString(tag int, value string) {
+	h.entries = append(h.entries, rpmEntry{tag, rpmTypeI18NString, 1, append([]byte(value), 0)})
+}
+
+func (h *rpmHeader) addStrings(tag int, values []string) {
+	var data []byte
+	for _, value := range values {
+		data = append(append(data, value...), 0)
+	}
+	h.entries = append(h.entries, rpmEntry{tag, rpmTypeStringArray, len(values), data})
+}
+
+func (h *rpmHeader) addInt32s(tag int, values []int32) {
+	var data []byte
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint32(data, uint32(value))
+	}
+	h.entries = append(h.entries, rpmEntry{tag, rpmTypeInt32, len(values), data})
+}
+
+func (h *rpmHeader) addInt16s(tag int, values []int16) {
+	var data []byte
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint16(data, uint16(value))
+	}
+	h.entries = append(h.entries, rpmEntry{tag, rpmTypeInt16, len(values), data})
+}
+
+func (h *rpmHeader) addBin(tag int, value []byte) {
+	h.entries = append(h.entries, rpmEntry{tag, rpmTypeBin, len(value), value})
+}
+
+// marshal encodes the header with every entry inside an immutable region
+// identified by the region tag, as rpm expects of signed headers.
+func (h *rpmHeader) marshal(region int) []byte {
+	entries := append([]rpmEntry{}, h.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Tag < entries[j].Tag })
+
+	index := binary.BigEndian.AppendUint32(nil, uint32(region))
+	index = binary.BigEndian.AppendUint32(index, rpmTypeBin)
+
+	var store []byte
+	var rest []byte
+	for _, entry := range entries {
+		// Numbers are aligned to their size within the data store
+		switch entry.Type {
+		case rpmTypeInt16:
+			store = append(store, make([]byte, len(store)%2)...)
+		case rpmTypeInt32:
+			store = append(store, make([]byte, (4-len(store)%4)%4)...)
+		}
+		rest = binary.BigEndian.AppendUint32(rest, uint32(entry.Tag))
+		rest = binary.BigEndian.AppendUint32(rest, uint32(entry.Type))
+		rest = binary.BigEndian.AppendUint32(rest, uint32(len(store)))
+		rest = binary.BigEndian.AppendUint32(rest, uint32(entry.Count))
+		store = append(store, entry.Data...)
+	}
+	// The region entry points at a trailer closing the data store, which in
+	// turn points back at the start of the index
+	count := len(entries) + 1
+	index = binary.BigEndian.AppendUint32(index, uint32(len(store)))
+	index = binary.BigEndian.AppendUint32(index, 16)
+	index = append(index, rest...)
+
+	store = binary.BigEndian.AppendUint32(store, uint32(region))
+	store = binary.BigEndian.AppendUint32(store, rpmTypeBin)
+	store = binary.BigEndian.AppendUint32(store, uint32(-int32(count*16)))
+	store = binary.BigEndian.AppendUint32(store, 16)
+
+	out := []byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0}
+	out = binary.BigEndian.AppendUint32(out, uint32(count))
+	out = binary.BigEndian.AppendUint32(out, uint32(len(store)))
+	out = append(out, index...)
+	return append(out, store...)
+}
+
+// writeRPM creates an RPM binary package: the lead, the signature header, the
+// main header and the gzip compressed cpio payload.
+func writeRPM(file string, pkg *distPackage) error {
+	version, err := packageVersion("rpm", pkg.Version)
+	if err != nil {
+		return err
+	}
+	spec := pkg.Spec
+	mtime := int32(pkg.Time.Unix())
+
+	// Assemble the payload, with every file named relative to the root
+	var (
+		archive bytes.Buffer
+		dirs    []string
+		dirIdx  = make(map[string]int32)
+
+		sizes, mtimes, flags, verify, devices, inodes, dirIndexes []int32
+		modes, rdevs                                              []int16
+		digests, links, users, groups, langs, bases               []string
+	)
+	for i, entry := range pkg.Files {
+		writeCpio(&archive, "."+entry.Path, int32(i+1), 0o100000|entry.Mode, mtime, entry.Data)
+
+		dir, base := path.Split(entry.Path)
+		if _, ok := dirIdx[dir]; !ok {
+			dirIdx[dir] = int32(len(dirs))
+			dirs = append(dirs, dir)
+		}
+		var flag int32
+		if entry.Config {
+			flag = rpmFileConfig | rpmFileNoReplace
+		}
+		sum := sha256.Sum256(entry.Data)
+
+		sizes, mtimes, flags = append(sizes, int32(len(entry.Data))), append(mtimes, mtime), append(flags, flag)
+		verify, devices, inodes = append(verify, -1), append(devices, 1), append(inodes, int32(i+1))
+		modes, rdevs = append(modes, int16(0o100000|entry.Mode)), append(rdevs, 0)
+		digests, links = append(digests, hex.EncodeToString(sum[:])), append(links, "")
+		users, groups, langs = append(users, "root"), append(groups, "root"), append(langs, "")
+		dirIndexes, bases = append(dirIndexes, dirIdx[dir]), append(bases, base)
+	}
+	writeCpio(&archive, "TRAILER!!!", 0, 0, 0, nil)
+	payload, err := gzipBytes(archive.Bytes())
+	if err != nil {
+		return err
+	}
+	payloadDigest := sha256.Sum256(payload)
+
+	// Assemble the package metadata
+	var header rpmHeader
+	header.addStrings(rpmTagI18NTable, []string{"C"})
+	header.addString(rpmTagName, spec.Name)
+	header.addString(rpmTagVersion, version)
+	header.addString(rpmTagRelease, spec.Release)
+	header.addI18NString(rpmTagSummary, spec.summary())
+	header.addI18NString(rpmTagDescription, strings.TrimSpace(spec.Description))
+	header.addInt32s(rpmTagBuildTime, []int32{mtime})
+	header.addString(rpmTagBuildHost, "xgo")
+	header.addInt32s(rpmTagSize, []int32{int32(installedSize(pkg.Files))})
+	if spec.License != "" {
+		header.addString(rpmTagLicense, spec.License)
+	}
+	header.addString(rpmTagPackager, spec.Maintainer)
+	header.addI18NString(rpmTagGroup, "Unspecified")
+	if spec.Homepage != "" {
+		header.addString(rpmTagURL, spec.Homepage)
+	}
+	header.addString(rpmTagOS, "linux")
+	header.addString(rpmTagArch, pkg.Arch)
+	header.addString(rpmTagSourceRPM, fmt.Sprintf("%s-%s-%s.src.rpm", spec.Name, version, spec.Release))
+
+	for name, tags := range rpmScripts {
+		if script, ok := pkg.Scripts[name]; ok {
+			header.addString(tags[0], string(script))
+			header.addString(tags[1], "/bin/sh")
+		}
+	}
+	header.addInt32s(rpmTagFileSizes, sizes)
+	header.addInt16s(rpmTagFileModes, modes)
+	header.addInt16s(rpmTagFileRdevs, rdevs)
+	header.addInt32s(rpmTagFileMtimes, mtimes)
+	header.addStrings(rpmTagFileDigests, digests)
+	header.addStrings(rpmTagFileLinkTos, links)
+	header.addInt32s(rpmTagFileFlags, flags)
+	header.addStrings(rpmTagFileUserName, users)
+	header.addStrings(rpmTagFileGroupName, groups)
+	header.addInt32s(rpmTagFileVerifyFlags, verify)
+	header.addInt32s(rpmTagFileDevices, devices)
+	header.addInt32s(rpmTagFileInodes, inodes)
+	header.addStrings(rpmTagFileLangs, langs)
+	header.addInt32s(rpmTagDirIndexes, dirIndexes)
+	header.addStrings(rpmTagBaseNames, bases)
+	header.addStrings(rpmTagDirNames, dirs)
+
+	header.addStrings(rpmTagProvideName, []string{spec.Name})
+	header.addInt32s(rpmTagProvideFlags, []int32{rpmSenseEqual})
+	header.addStrings(rpmTagProvideVersion, []string{version + "-" + spec.Release})
+
+	var (
+		requireNames    []string
+		requireFlags    []int32
+		requireVersions []string
+	)
+	for _, feature := range rpmLibFeatures {
+		requireNames = append(requireNames, feature[0])
+		requireFlags = append(requireFlags, rpmSenseRPMLib|rpmSenseLess|rpmSenseEqual)
+		requireVersions = append(requireVersions, feature[1])
+	}
+	for _, dep := range spec.Depends {
+		requireNames = append(requireNames, dep)
+		requireFlags = append(requireFlags, 0)
+		requireVersions = append(requireVersions, "")
+	}
+	header.addStrings(rpmTagRequireName, requireNames)
+	header.addInt32s(rpmTagRequireFlags, requireFlags)
+	header.addStrings(rpmTagRequireVersion, requireVersions)
+
+	header.addString(rpmTagPayloadFormat, "cpio")
+	header.addString(rpmTagPayloadCompressor, "gzip")
+	header.addString(rpmTagPayloadFlags, "9")
+	header.addInt32s(rpmTagFileDigestAlgo, []int32{rpmDigestSHA256})
+	header.addStrings(rpmTagPayloadDigest, []string{hex.EncodeToString(payloadDigest[:])})
+	header.addInt32s(rpmTagPayloadDigestAlgo, []int32{rpmDigestSHA256})
+
+	main := header.marshal(rpmTagHeaderImmutable)
+
+	// Sign the header and payload with plain digests
+	headerSHA1, headerSHA256 := sha1.Sum(main), sha256.Sum256(main)
+	digest := md5.New()
+	digest.Write(main)
+	digest.Write(payload)
+
+	var signature rpmHeader
+	signature.addString(rpmSigSHA1, hex.EncodeToString(headerSHA1[:]))
+	signature.addString(rpmSigSHA256, hex.EncodeToString(headerSHA256[:]))
+	signature.addInt32s(rpmSigSize, []int32{int32(len(main) + len(payload))})
+	signature.addBin(rpmSigMD5, digest.Sum(nil))
+	signature.addInt32s(rpmSigPayloadSize, []int32{int32(archive.Len())})
+	sig := signature.marshal(rpmSigHeaderSignatures)
+	sig = append(sig, make([]byte, (8-len(sig)%8)%8)...)
+
+	// The lead is obsolete, but still needs to be present and well formed
+	lead := []byte{0xed, 0xab, 0xee, 0xdb, 3, 0, 0, 0, 0, 0}
+	name := make([]byte, 66)
+	copy(name[:65], fmt.Sprintf("%s-%s-%s", spec.Name, version, spec.Release))
+	lead = append(lead, name...)
+	lead = append(lead, 0, 1, 0, 5)
+	lead = append(lead, make([]byte, 16)...)
+
+	out := bytes.Join([][]byte{lead, sig, main, payload}, nil)
+	return os.WriteFile(file, out, 0o644)
+}
+
+// writeCpio appends a file to a cpio archive in the SVR4 (newc) format.
+func writeCpio(out *bytes.Buffer, name string, inode int32, mode uint32, mtime int32, data []byte) {
+	fmt.Fprintf(out, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		inode, mode, 0, 0, 1, mtime, len(data), 0, 0, 0, 0, len(name)+1, 0)
+	out.WriteString(name)
+	out.WriteByte(0)
+	out.Write(make([]byte, (4-(110+len(name)+1)%4)%4))
+	out.Write(data)
+	out.Write(make([]byte, (4-len(data)%4)%4))
+}
@@ -11,7 +11,7 @@
 #   REPO_BRANCH    - Optional VCS branch to use, if not the master branch
 #   DEPS           - Optional list of C dependency packages to build
 #   ARGS           - Optional arguments to pass to C dependency configure scripts
-#   PACK           - Optional sub-package, if not the import path is being built
+#   PACK           - Optional space separated sub-packages, if not the import path is being built
 #   OUT            - Optional output prefix to override the package name
 #   FLAG_V         - Optional verbosity flag to set on the Go builder
 #   FLAG_X         - Optional flag to print the build progress commands
@@ -23,9 +23,15 @@
 #   FLAG_TRIMPATH  - Optional trimpath flag to set on the Go builder
 #   FLAG_BUILDVCS  - Optional buildvcs flag to set on the Go builder
 #   FLAG_OBFUSCATE - Optional flag to obfuscate builds using garble
+#   FLAG_REPRODUCIBLE - Optional flag to strip build paths from C debug info
+#   SOURCE_DATE_EPOCH - Optional timestamp to pin reproducible builds to
 #   TARGETS        - Comma separated list of build targets to compile for
 #   EXT_GOPATH     - GOPATH elements mounted from the host filesystem
+#   SOURCE_PATH    - Optional module folder within /source (Go workspace builds)
+#   GOWORK         - Optional go.work file within /source (Go workspace builds)
 #   GARBLE_FLAGS   - Flags to pass to garble (e.g. -seed=random)
+#   XGO_TARGET_*   - Optional per-target overrides (NAME=VALUE lines), e.g.
+#                    XGO_TARGET_windows_10_0_amd64 or XGO_TARGET_linux_musl_amd64
 
 # Define a function that figures out the binary extension
 function extension {
@@ -50,6 +56,15 @@ function extension {
   fi
 }
 
+# Build every requested package for the current target, naming the outputs
+# after the package followed by the given target suffix
+function go_build {
+  local suffix=$1; shift
+  for i in "${!PACK_RELPATHS[@]}"; do
+    $GOBIN build "$@" -o "/build/${NAMES[$i]}$suffix" "${PACK_RELPATHS[$i]}"
+  done
+}
+
 function do_build {
     if [ -f "/hooksdir/build.sh" ]; then echo "source build.sh hook"; source "/hooksdir/build.sh"; fi
     # call dedicated build script
@@ -94,9 +109,9 @@ if [ "$EXT_GOPATH" != "" ]; then
 elif [[ "$USEMODULES" == true && -d /source ]]; then
   # Go module build with a local repository mapped to /source containing at least a go.mod file.
 
-  # Change into the repo/source folder
-  cd /source
-  echo "Building /source/go.mod..."
+  # Change into the repo/source folder (nested within the workspace if any)
+  cd "/source/$SOURCE_PATH"
+  echo "Building $(pwd)/go.mod..."
 else
   # Inject all possible Godep paths to short circuit go gets
   GOPATH_ROOT="$GOPATH/src"
@@ -155,13 +170,13 @@ else
   fi
 fi
 
-# Download all the C dependencies
+# Extract all the C dependencies, detecting the archive formats by content
 mkdir /deps
-DEPS=("$DEPS") && for dep in "${DEPS[@]}"; do
-  if [ "${dep##*.}" == "tar" ]; then tar -C /deps -x < "/deps-cache/$(basename "$dep")"; fi
-  if [ "${dep##*.}" == "gz" ];  then tar -C /deps -xz < "/deps-cache/$(basename "$dep")"; fi
-  if [ "${dep##*.}" == "bz2" ]; then tar -C /deps -xj < "/deps-cache/$(basename "$dep")"; fi
+ARCHIVES=()
+for dep in $DEPS; do
+  ARCHIVES+=("/deps-cache/$(basename "$dep")")
 done
+xgo unpack /deps "${ARCHIVES[@]}"
 
 DEPS_ARGS=("$ARGS")
 
@@ -172,36 +187,101 @@ shopt -u nullglob
 
 
 # Configure some global build parameters
-NAME="$OUT"
+read -r -a PACKS <<< "$PACK"
 
+if [ "${#PACKS[@]}" -le 1 ]; then
+  NAME="$OUT"
 
-if [ "$NAME" == "" ]; then
-  if [[ "$USEMODULES" = true && -d /source && -f /source/go.mod ]]; then
-    NAME="$(sed -n 's/module\ \(.*\)/\1/p' /source/go.mod)"
+  if [ "$NAME" == "" ]; then
+    if [[ "$USEMODULES" = true && -d /source && -f "/source/$SOURCE_PATH/go.mod" ]]; then
+      NAME="$(sed -n 's/module\ \(.*\)/\1/p' "/source/$SOURCE_PATH/go.mod")"
 
-    if [[ "$NAME" != "" && "$PACK" != "" ]]; then
-      NAME="$NAME/$PACK"
+      if [[ "$NAME" != "" && "$PACK" != "" ]]; then
+        NAME="$NAME/$PACK"
+      fi
     fi
   fi
-fi
 
-if [[ "$NAME" == "" ]]; then
-  NAME="$(basename "$1/$PACK")"
-fi
+  if [[ "$NAME" == "" ]]; then
+    NAME="$(basename "$1/$PACK")"
+  fi
+
+  if [[ "$NAME" == "" || "$NAME" == "." ]]; then
+    NAME="main"
+  fi
 
-if [[ "$NAME" == "" || "$NAME" == "." ]]; then
-  NAME="main"
+  # Support go module package
+  NAMES=("$NAME")
+  PACK_RELPATHS=("./$PACK")
+else
+  # Multiple packages are named after their folder
+  NAMES=()
+  PACK_RELPATHS=()
+  for pack in "${PACKS[@]}"; do
+    name="$(basename "$pack")"
+    if [[ "$name" == "." ]]; then
+      name="$(basename "$1")"
+    fi
+    NAMES+=("$name")
+    PACK_RELPATHS+=("./$pack")
+  done
 fi
 
-# Support go module package
-PACK_RELPATH="./$PACK"
+# Define a function that assembles the tags, ldflags and gcflags arguments
+function configure_flags {
+  T=(); LD=(); GC=(); LDF=()
+  if [ "$FLAG_V" == "true" ];    then LD+=('-v'); fi
+  if [ "$FLAG_TAGS" != "" ];     then T=(--tags "$FLAG_TAGS"); fi
+  if [ "$FLAG_LDFLAGS" != "" ];  then LD=("${LD[@]}" "${FLAG_LDFLAGS[@]}"); fi
+  if [ "$FLAG_GCFLAGS" != "" ];  then GC=(--gcflags="$(printf "%s " "${FLAG_GCFLAGS[@]}")"); fi
+  if [ "${#LD[@]}" -gt 0 ]; then LDF=(--ldflags="$(printf "%s " "${LD[@]}")"); fi
+}
+
+# Define a function that links the executables of musl targets fully statically
+# (shared libraries and archives can't be), the user's ldflags still come last
+function musl_flags {
+  MUSL_LDF=("${LDF[@]}")
+  if [ "$FLAG_BUILDMODE" == "" ] || [ "$FLAG_BUILDMODE" == "default" ] || [ "$FLAG_BUILDMODE" == "exe" ]; then
+    MUSL_LDF=(--ldflags="-linkmode=external -extldflags=-static $(printf "%s " "${LD[@]}")")
+  fi
+}
+
+# Define a function that applies the overrides of a target (XGO_TARGET_<os>_<arch>,
+# where the os includes the platform version of windows and darwin targets)
+# on top of the global environment, undoing those of the previous target first
+declare -A TARGET_ENV_SAVED
+function target_overrides {
+  local name kv var="XGO_TARGET_${1//[-.]/_}_${2//-/_}"
+
+  for name in "${!TARGET_ENV_SAVED[@]}"; do
+    if [ "${TARGET_ENV_SAVED[$name]}" == "unset" ]; then
+      unset "$name"
+    else
+      export "$name=${TARGET_ENV_SAVED[$name]#set:}"
+    fi
+  done
+  TARGET_ENV_SAVED=()
+  FLAG_TAGS="$GLOBAL_FLAG_TAGS"; FLAG_LDFLAGS="$GLOBAL_FLAG_LDFLAGS"; FLAG_GCFLAGS="$GLOBAL_FLAG_GCFLAGS"
+
+  while IFS= read -r kv; do
+    name="${kv%%=*}"
+    case "$name" in
+      "") ;;
+      FLAG_TAGS|FLAG_LDFLAGS|FLAG_GCFLAGS) printf -v "$name" "%s" "${kv#*=}" ;;
+      *)
+        if [ "${!name+x}" == "x" ]; then TARGET_ENV_SAVED[$name]="set:${!name}"; else TARGET_ENV_SAVED[$name]="unset"; fi
+        export "$kv"
+        ;;
+    esac
+  done <<< "${!var}"
+  configure_flags
+}
 
-if [ "$FLAG_V" == "true" ];    then V=-v; LD+='-v'; fi
+if [ "$FLAG_V" == "true" ];    then V=-v; fi
 if [ "$FLAG_X" == "true" ];    then X=-x; fi
 if [ "$FLAG_RACE" == "true" ]; then R=-race; fi
-if [ "$FLAG_TAGS" != "" ];     then T=(--tags "$FLAG_TAGS"); fi
-if [ "$FLAG_LDFLAGS" != "" ];  then LD=("${LD[@]}" "${FLAG_LDFLAGS[@]}"); fi
-if [ "$FLAG_GCFLAGS" != "" ];  then GC=(--gcflags="$(printf "%s " "${FLAG_GCFLAGS[@]}")"); fi
+GLOBAL_FLAG_TAGS="$FLAG_TAGS"; GLOBAL_FLAG_LDFLAGS="$FLAG_LDFLAGS"; GLOBAL_FLAG_GCFLAGS="$FLAG_GCFLAGS"
+configure_flags
 
 if [ "$FLAG_BUILDMODE" != "" ] && [ "$FLAG_BUILDMODE" != "default" ]; then BM=(--buildmode="${FLAG_BUILDMODE[@]}"); fi
 if [ "$FLAG_TRIMPATH" == "true" ]; then TP=-trimpath; fi
@@ -217,13 +297,23 @@ else
   GOBIN=go
 fi
 
+# Map the container paths embedded into C debug information and macros to fixed
+# names, and pin the timestamps of reproducible builds to the last commit
+if [ "$FLAG_REPRODUCIBLE" == "true" ]; then
+  export XGO_PREFIX_MAP="-ffile-prefix-map=/source=. -ffile-prefix-map=/deps-build=deps -ffile-prefix-map=/ext-go/=gopath/ -ffile-prefix-map=/go/=gopath/"
+  export CGO_CFLAGS="${CGO_CFLAGS:--O2 -g} $XGO_PREFIX_MAP"
+  export CGO_CXXFLAGS="${CGO_CXXFLAGS:--O2 -g} $XGO_PREFIX_MAP"
+  if [ "$SOURCE_DATE_EPOCH" == "" ]; then
+    SOURCE_DATE_EPOCH="$(git log -1 --format=%ct 2>/dev/null || true)"
+  fi
+  if [ "$SOURCE_DATE_EPOCH" != "" ]; then export SOURCE_DATE_EPOCH; fi
+fi
+
 # If no build targets were specified, inject a catch all wildcard
 if [ "$TARGETS" == "" ]; then
   TARGETS="./."
 fi
 
-if [ "${#LD[@]}" -gt 0 ]; then LDF=(--ldflags="$(printf "%s " "${LD[@]}")"); fi
-
 # source setup.sh if existing
 if [ -f "/hooksdir/setup.sh" ]; then echo "source setup.sh hook"; source "/hooksdir/setup.sh"; fi
 
@@ -236,21 +326,23 @@ for TARGET in $TARGETS; do
   # Check and build for Linux targets
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; } && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "amd64" ]; }; then
     echo "Compiling for linux/amd64..."
+    target_overrides linux amd64
     mkdir -p /gocache/linux/amd64
     XGOOS="linux" XGOARCH="amd64" GOCACHE=/gocache/linux/amd64 HOST=x86_64-linux PREFIX=/usr/local do_build
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/amd64 GOOS=linux GOARCH=amd64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/amd64 GOOS=linux GOARCH=amd64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/amd64 CC=x86_64-linux-gnu-gcc CXX=x86_64-linux-gnu-g++ GOOS=linux GOARCH=amd64 CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" $R "${BM[@]}" -o "/build/$NAME-linux-amd64$R$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/amd64 CC=x86_64-linux-gnu-gcc CXX=x86_64-linux-gnu-g++ GOOS=linux GOARCH=amd64 CGO_ENABLED=1 go_build "-linux-amd64$R$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" $R "${BM[@]}"
   fi
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; } && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "386" ]; }; then
     echo "Compiling for linux/386..."
+    target_overrides linux 386
     mkdir -p /gocache/linux/386
     XGOOS="linux" XGOARCH="386" GOCACHE=/gocache/linux/386 CC="gcc -m32" CXX="g++ -m32" HOST=i686-linux PREFIX=/usr/local do_build
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/386 GOOS=linux GOARCH=386 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/386 GOOS=linux GOARCH=386 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/386 GOOS=linux GOARCH=386 CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-386$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/386 GOOS=linux GOARCH=386 CGO_ENABLED=1 go_build "-linux-386$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
   fi
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; }  && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "arm" ] || [ "$XGOARCH" == "arm-5" ]; }; then
     mkdir -p /gocache/linux/arm-5
@@ -258,13 +350,14 @@ for TARGET in $TARGETS; do
       ln -s /usr/local/go/pkg/linux_arm-5 /usr/local/go/pkg/linux_arm
     fi
     echo "Compiling for linux/arm-5..."
+    target_overrides linux arm-5
     XGOOS="linux" XGOARCH="arm-5" GOCACHE=/gocache/linux/arm-5 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ HOST=arm-linux-gnueabi-gcc PREFIX=/usr/arm-linux-gnueabihf CFLAGS="-march=armv5t" CXXFLAGS="-march=armv5t" do_build
     export PKG_CONFIG_PATH=/usr/arm-linux-gnueabi/lib/pkgconfig
 
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/arm-5 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=5 CGO_ENABLED=1 CGO_CFLAGS="-march=armv5t" CGO_CXXFLAGS="-march=armv5t" go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/arm-5 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=5 CGO_ENABLED=1 CGO_CFLAGS="-march=armv5t $CGO_CFLAGS" CGO_CXXFLAGS="-march=armv5t $CGO_CXXFLAGS" go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/arm-5 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=5 CGO_ENABLED=1 CGO_CFLAGS="-march=armv5t" CGO_CXXFLAGS="-march=armv5t" $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-arm-5$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/arm-5 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=5 CGO_ENABLED=1 CGO_CFLAGS="-march=armv5t $CGO_CFLAGS" CGO_CXXFLAGS="-march=armv5t $CGO_CXXFLAGS" go_build "-linux-arm-5$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
     if [ "$GO_VERSION_MAJOR" -gt 1 ] || { [ "$GO_VERSION_MAJOR" == 1 ] && [ "$GO_VERSION_MINOR" -ge 15 ]; }; then
       rm /usr/local/go/pkg/linux_arm
     fi
@@ -274,13 +367,14 @@ for TARGET in $TARGETS; do
     ln -s /usr/local/go/pkg/linux_arm-6 /usr/local/go/pkg/linux_arm
 
     echo "Compiling for linux/arm-6..."
+    target_overrides linux arm-6
     XGOOS="linux" XGOARCH="arm-6" GOCACHE=/gocache/linux/arm-6 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ HOST=arm-linux-gnueabi-gcc PREFIX=/usr/arm-linux-gnueabihf CFLAGS="-march=armv6" CXXFLAGS="-march=armv6" do_build
     export PKG_CONFIG_PATH=/usr/arm-linux-gnueabi/lib/pkgconfig
 
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/arm-6 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=6 CGO_ENABLED=1 CGO_CFLAGS="-march=armv6" CGO_CXXFLAGS="-march=armv6" go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/arm-6 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=6 CGO_ENABLED=1 CGO_CFLAGS="-march=armv6 $CGO_CFLAGS" CGO_CXXFLAGS="-march=armv6 $CGO_CXXFLAGS" go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/arm-6 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=6 CGO_ENABLED=1 CGO_CFLAGS="-march=armv6" CGO_CXXFLAGS="-march=armv6" $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-arm-6$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/arm-6 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=6 CGO_ENABLED=1 CGO_CFLAGS="-march=armv6 $CGO_CFLAGS" CGO_CXXFLAGS="-march=armv6 $CGO_CXXFLAGS" go_build "-linux-arm-6$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
 
     rm /usr/local/go/pkg/linux_arm
   fi
@@ -289,103 +383,139 @@ for TARGET in $TARGETS; do
     ln -s /usr/local/go/pkg/linux_arm-7 /usr/local/go/pkg/linux_arm
 
     echo "Compiling for linux/arm-7..."
+    target_overrides linux arm-7
     XGOOS="linux" XGOARCH="arm-7" GOCACHE=/gocache/linux/arm-7 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ HOST=arm-linux-gnueabi-gcc PREFIX=/usr/arm-linux-gnueabi CFLAGS="-march=armv7-a -fPIC" CXXFLAGS="-march=armv7-a -fPIC" do_build
     export PKG_CONFIG_PATH=/usr/arm-linux-gnueabi/lib/pkgconfig
 
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/arm-7 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=7 CGO_ENABLED=1 CGO_CFLAGS="-march=armv7-a -fPIC" CGO_CXXFLAGS="-march=armv7-a -fPIC" go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/arm-7 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=7 CGO_ENABLED=1 CGO_CFLAGS="-march=armv7-a -fPIC $CGO_CFLAGS" CGO_CXXFLAGS="-march=armv7-a -fPIC $CGO_CXXFLAGS" go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/arm-7 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=7 CGO_ENABLED=1 CGO_CFLAGS="-march=armv7-a -fPIC" CGO_CXXFLAGS="-march=armv7-a -fPIC" $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-arm-7$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/arm-7 CC=arm-linux-gnueabi-gcc CXX=arm-linux-gnueabihf-g++ GOOS=linux GOARCH=arm GOARM=7 CGO_ENABLED=1 CGO_CFLAGS="-march=armv7-a -fPIC $CGO_CFLAGS" CGO_CXXFLAGS="-march=armv7-a -fPIC $CGO_CXXFLAGS" go_build "-linux-arm-7$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
 
     rm /usr/local/go/pkg/linux_arm
   fi
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; } && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "arm64" ]; }; then
     echo "Compiling for linux/arm64..."
+    target_overrides linux arm64
     mkdir -p /gocache/linux/arm64
     XGOOS="linux" XGOARCH="arm64" GOCACHE=/gocache/linux/arm64 CC=aarch64-linux-gnu-gcc CXX=aarch64-linux-gnu-g++ PREFIX=/usr/aarch64-linux-gnu-gcc/ do_build
     export PKG_CONFIG_PATH=/usr/aarch64-linux-gnu-gcc/lib/pkgconfig
 
       if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/arm64 CC=aarch64-linux-gnu-gcc CXX=aarch64-linux-gnu-g++ GOOS=linux GOARCH=arm64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/arm64 CC=aarch64-linux-gnu-gcc CXX=aarch64-linux-gnu-g++ GOOS=linux GOARCH=arm64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/arm64 CC=aarch64-linux-gnu-gcc CXX=aarch64-linux-gnu-g++ GOOS=linux GOARCH=arm64 CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-arm64$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/arm64 CC=aarch64-linux-gnu-gcc CXX=aarch64-linux-gnu-g++ GOOS=linux GOARCH=arm64 CGO_ENABLED=1 go_build "-linux-arm64$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
   fi
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; } && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "mips64" ]; }; then
     echo "Compiling for linux/mips64..."
+    target_overrides linux mips64
     mkdir -p /gocache/linux/mips64
     XGOOS="linux" XGOARCH="mips64" GOCACHE=/gocache/linux/mips64 CC=mips64-linux-gnuabi64-gcc CXX=mips64-linux-gnuabi64-g++ HOST=mips64-linux-gnuabi64 PREFIX=/usr/mips64-linux-gnuabi64 do_build
     export PKG_CONFIG_PATH=/usr/mips64-linux-gnuabi64/lib/pkgconfig
 
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/mips64 CC=mips64-linux-gnuabi64-gcc CXX=mips64-linux-gnuabi64-g++ GOOS=linux GOARCH=mips64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/mips64 CC=mips64-linux-gnuabi64-gcc CXX=mips64-linux-gnuabi64-g++ GOOS=linux GOARCH=mips64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/mips64 CC=mips64-linux-gnuabi64-gcc CXX=mips64-linux-gnuabi64-g++ GOOS=linux GOARCH=mips64 CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-mips64$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/mips64 CC=mips64-linux-gnuabi64-gcc CXX=mips64-linux-gnuabi64-g++ GOOS=linux GOARCH=mips64 CGO_ENABLED=1 go_build "-linux-mips64$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
   fi
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; } && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "mips64le" ]; }; then
     echo "Compiling for linux/mips64le..."
+    target_overrides linux mips64le
     mkdir -p /gocache/linux/mips64le
     XGOOS="linux" XGOARCH="mips64le" GOCACHE=/gocache/linux/mips64le CC=mips64el-linux-gnuabi64-gcc CXX=mips64el-linux-gnuabi64-g++ HOST=mips64el-linux-gnuabi64 PREFIX=/usr/mips64el-linux-gnuabi64 do_build
     export PKG_CONFIG_PATH=/usr/mips64le-linux-gnuabi64/lib/pkgconfig
 
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/mips64le CC=mips64el-linux-gnuabi64-gcc CXX=mips64el-linux-gnuabi64-g++ GOOS=linux GOARCH=mips64le CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/mips64le CC=mips64el-linux-gnuabi64-gcc CXX=mips64el-linux-gnuabi64-g++ GOOS=linux GOARCH=mips64le CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/mips64le CC=mips64el-linux-gnuabi64-gcc CXX=mips64el-linux-gnuabi64-g++ GOOS=linux GOARCH=mips64le CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-mips64le$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/mips64le CC=mips64el-linux-gnuabi64-gcc CXX=mips64el-linux-gnuabi64-g++ GOOS=linux GOARCH=mips64le CGO_ENABLED=1 go_build "-linux-mips64le$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
   fi
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; } && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "mips" ]; }; then
     echo "Compiling for linux/mips..."
+    target_overrides linux mips
     mkdir -p /gocache/linux/mips
     XGOOS="linux" XGOARCH="mips" GOCACHE=/gocache/linux/mips CC=mips-linux-gnu-gcc CXX=mips-linux-gnu-g++ HOST=mips-linux-gnu PREFIX=/usr/mips-linux-gnu do_build
     export PKG_CONFIG_PATH=/usr/mips-linux-gnu/lib/pkgconfig
 
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/mips CC=mips-linux-gnu-gcc CXX=mips-linux-gnu-g++ GOOS=linux GOARCH=mips CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/mips CC=mips-linux-gnu-gcc CXX=mips-linux-gnu-g++ GOOS=linux GOARCH=mips CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/mips CC=mips-linux-gnu-gcc CXX=mips-linux-gnu-g++ GOOS=linux GOARCH=mips CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-mips$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/mips CC=mips-linux-gnu-gcc CXX=mips-linux-gnu-g++ GOOS=linux GOARCH=mips CGO_ENABLED=1 go_build "-linux-mips$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
   fi
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; } && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "s390x" ]; }; then
     echo "Compiling for linux/s390x..."
+    target_overrides linux s390x
     mkdir -p /gocache/linux/s390x
     XGOOS="linux" XGOARCH="s390x" GOCACHE=/gocache/linux/s390x CC=s390x-linux-gnu-gcc CXX=s390x-linux-gnu-g++ HOST=s390x-linux-gnu PREFIX=/usr/s390x-linux-gnu do_build
     export PKG_CONFIG_PATH=/usr/s390x-linux-gnu/lib/pkgconfig
 
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/s390x CC=s390x-linux-gnu-gcc CXX=s390x-linux-gnu-g++ GOOS=linux GOARCH=s390x CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/s390x CC=s390x-linux-gnu-gcc CXX=s390x-linux-gnu-g++ GOOS=linux GOARCH=s390x CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/s390x CC=s390x-linux-gnu-gcc CXX=s390x-linux-gnu-g++ GOOS=linux GOARCH=s390x CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-s390x$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/s390x CC=s390x-linux-gnu-gcc CXX=s390x-linux-gnu-g++ GOOS=linux GOARCH=s390x CGO_ENABLED=1 go_build "-linux-s390x$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
   fi
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; } && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "riscv64" ]; }; then
     echo "Compiling for linux/riscv64..."
+    target_overrides linux riscv64
     mkdir -p /gocache/linux/riscv64
     XGOOS="linux" XGOARCH="riscv64" GOCACHE=/gocache/linux/riscv64 CC=riscv64-linux-gnu-gcc CXX=riscv64-linux-gnu-g++ HOST=riscv64-linux-gnu PREFIX=/usr/riscv64-linux-gnu do_build
     export PKG_CONFIG_PATH=/usr/riscv64-linux-gnu/lib/pkgconfig
 
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/riscv64 CC=riscv64-linux-gnu-gcc CXX=riscv64-linux-gnu-g++ GOOS=linux GOARCH=riscv64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/riscv64 CC=riscv64-linux-gnu-gcc CXX=riscv64-linux-gnu-g++ GOOS=linux GOARCH=riscv64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/riscv64 CC=riscv64-linux-gnu-gcc CXX=riscv64-linux-gnu-g++ GOOS=linux GOARCH=riscv64 CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-riscv64$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/riscv64 CC=riscv64-linux-gnu-gcc CXX=riscv64-linux-gnu-g++ GOOS=linux GOARCH=riscv64 CGO_ENABLED=1 go_build "-linux-riscv64$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
   fi
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; } && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "ppc64le" ]; }; then
     echo "Compiling for linux/ppc64le..."
+    target_overrides linux ppc64le
     mkdir -p /gocache/linux/ppc64le
     XGOOS="linux" XGOARCH="ppc64le" GOCACHE=/gocache/linux/ppc64le CC=powerpc64le-linux-gnu-gcc CXX=powerpc64le-linux-gnu-g++ HOST=ppc64le-linux-gnu PREFIX=/usr/ppc64le-linux-gnu do_build
     export PKG_CONFIG_PATH=/usr/ppc64le-linux-gnu/lib/pkgconfig
 
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/ppc64le CC=powerpc64le-linux-gnu-gcc CXX=powerpc64le-linux-gnu-g++ GOOS=linux GOARCH=ppc64le CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/ppc64le CC=powerpc64le-linux-gnu-gcc CXX=powerpc64le-linux-gnu-g++ GOOS=linux GOARCH=ppc64le CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/ppc64le CC=powerpc64le-linux-gnu-gcc CXX=powerpc64le-linux-gnu-g++ GOOS=linux GOARCH=ppc64le CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-ppc64le$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux/ppc64le CC=powerpc64le-linux-gnu-gcc CXX=powerpc64le-linux-gnu-g++ GOOS=linux GOARCH=ppc64le CGO_ENABLED=1 go_build "-linux-ppc64le$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
   fi
   if { [ "$XGOOS" == "." ] || [ "$XGOOS" == "linux" ]; } && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "mipsle" ]; }; then
     echo "Compiling for linux/mipsle..."
+    target_overrides linux mipsle
     mkdir -p /gocache/linux/mipsle
     XGOOS="linux" XGOARCH="mipsle" GOCACHE=/gocache/linux/mipsle CC=mipsel-linux-gnu-gcc CXX=mipsel-linux-gnu-g++ HOST=mipsel-linux-gnu PREFIX=/usr/mipsel-linux-gnu do_build
     export PKG_CONFIG_PATH=/usr/mipsle-linux-gnu/lib/pkgconfig
 
     if [[ "$USEMODULES" == false ]]; then
-      GOCACHE=/gocache/linux/mipsle CC=mipsel-linux-gnu-gcc CXX=mipsel-linux-gnu-g++ GOOS=linux GOARCH=mipsle CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+      GOCACHE=/gocache/linux/mipsle CC=mipsel-linux-gnu-gcc CXX=mipsel-linux-gnu-g++ GOOS=linux GOARCH=mipsle CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
+    fi
+    GOCACHE=/gocache/linux/mipsle CC=mipsel-linux-gnu-gcc CXX=mipsel-linux-gnu-g++ GOOS=linux GOARCH=mipsle CGO_ENABLED=1 go_build "-linux-mipsle$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
+  fi
+  # Check and build for musl based Linux targets, only if explicitly requested
+  if [ "$XGOOS" == "linux-musl" ] && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "amd64" ]; }; then
+    echo "Compiling for linux-musl/amd64..."
+    target_overrides linux-musl amd64
+    musl_flags
+    mkdir -p /gocache/linux-musl/amd64
+    XGOOS="linux-musl" XGOARCH="amd64" GOCACHE=/gocache/linux-musl/amd64 CC=x86_64-linux-musl-gcc CXX=x86_64-linux-musl-g++ HOST=x86_64-linux-musl PREFIX=/musl/x86_64-linux-musl do_build
+    export PKG_CONFIG_PATH=/musl/x86_64-linux-musl/lib/pkgconfig
+
+    if [[ "$USEMODULES" == false ]]; then
+      GOCACHE=/gocache/linux-musl/amd64 CC=x86_64-linux-musl-gcc CXX=x86_64-linux-musl-g++ GOOS=linux GOARCH=amd64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
     fi
-    GOCACHE=/gocache/linux/mipsle CC=mipsel-linux-gnu-gcc CXX=mipsel-linux-gnu-g++ GOOS=linux GOARCH=mipsle CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-linux-mipsle$(extension linux)" "$PACK_RELPATH"
+    GOCACHE=/gocache/linux-musl/amd64 CC=x86_64-linux-musl-gcc CXX=x86_64-linux-musl-g++ GOOS=linux GOARCH=amd64 CGO_ENABLED=1 go_build "-linux-musl-amd64$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${MUSL_LDF[@]}" "${GC[@]}" "${BM[@]}"
+  fi
+  if [ "$XGOOS" == "linux-musl" ] && { [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "arm64" ]; }; then
+    echo "Compiling for linux-musl/arm64..."
+    target_overrides linux-musl arm64
+    musl_flags
+    mkdir -p /gocache/linux-musl/arm64
+    XGOOS="linux-musl" XGOARCH="arm64" GOCACHE=/gocache/linux-musl/arm64 CC=aarch64-linux-musl-gcc CXX=aarch64-linux-musl-g++ HOST=aarch64-linux-musl PREFIX=/musl/aarch64-linux-musl do_build
+    export PKG_CONFIG_PATH=/musl/aarch64-linux-musl/lib/pkgconfig
+
+    if [[ "$USEMODULES" == false ]]; then
+      GOCACHE=/gocache/linux-musl/arm64 CC=aarch64-linux-musl-gcc CXX=aarch64-linux-musl-g++ GOOS=linux GOARCH=arm64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
+    fi
+    GOCACHE=/gocache/linux-musl/arm64 CC=aarch64-linux-musl-gcc CXX=aarch64-linux-musl-g++ GOOS=linux GOARCH=arm64 CGO_ENABLED=1 go_build "-linux-musl-arm64$(extension linux)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${MUSL_LDF[@]}" "${GC[@]}" "${BM[@]}"
   fi
   # Check and build for Windows targets
   if [ "$XGOOS" == "." ] || [[ "$XGOOS" == windows* ]]; then
@@ -404,25 +534,27 @@ for TARGET in $TARGETS; do
     # Build the requested windows binaries
     if [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "amd64" ]; then
       echo "Compiling for windows-$PLATFORM/amd64..."
+      target_overrides windows-$PLATFORM amd64
       mkdir -p /gocache/windows-$PLATFORM/amd64
       XGOOS="windows-$PLATFORM" XGOARCH="amd64" GOCACHE=/gocache/windows-$PLATFORM/amd64 CC=x86_64-w64-mingw32-gcc-posix CXX=x86_64-w64-mingw32-g++-posix HOST=x86_64-w64-mingw32 PREFIX=/usr/x86_64-w64-mingw32 do_build
       export PKG_CONFIG_PATH=/usr/x86_64-w64-mingw32/lib/pkgconfig
 
       if [[ "$USEMODULES" == false ]]; then
-        GOCACHE=/gocache/windows-$PLATFORM/amd64 CC=x86_64-w64-mingw32-gcc-posix CXX=x86_64-w64-mingw32-g++-posix GOOS=windows GOARCH=amd64 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF" CGO_CXXFLAGS="$CGO_NTDEF" go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+        GOCACHE=/gocache/windows-$PLATFORM/amd64 CC=x86_64-w64-mingw32-gcc-posix CXX=x86_64-w64-mingw32-g++-posix GOOS=windows GOARCH=amd64 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF $CGO_CFLAGS" CGO_CXXFLAGS="$CGO_NTDEF $CGO_CXXFLAGS" go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
       fi
-      GOCACHE=/gocache/windows-$PLATFORM/amd64 CC=x86_64-w64-mingw32-gcc-posix CXX=x86_64-w64-mingw32-g++-posix GOOS=windows GOARCH=amd64 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF" CGO_CXXFLAGS="$CGO_NTDEF" $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" $R "${BM[@]}" -o "/build/$NAME-windows-$PLATFORM-amd64$R$(extension windows)" "$PACK_RELPATH"
+      GOCACHE=/gocache/windows-$PLATFORM/amd64 CC=x86_64-w64-mingw32-gcc-posix CXX=x86_64-w64-mingw32-g++-posix GOOS=windows GOARCH=amd64 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF $CGO_CFLAGS" CGO_CXXFLAGS="$CGO_NTDEF $CGO_CXXFLAGS" go_build "-windows-$PLATFORM-amd64$R$(extension windows)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" $R "${BM[@]}"
     fi
     if [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "386" ]; then
       echo "Compiling for windows-$PLATFORM/386..."
+      target_overrides windows-$PLATFORM 386
       mkdir -p /gocache/windows-$PLATFORM/386
       XGOOS="windows-$PLATFORM" XGOARCH="386" GOCACHE=/gocache/windows-$PLATFORM/386 CC=i686-w64-mingw32-gcc-posix CXX=i686-w64-mingw32-g++-posix HOST=i686-w64-mingw32 PREFIX=/usr/i686-w64-mingw32 do_build
       export PKG_CONFIG_PATH=/usr/i686-w64-mingw32/lib/pkgconfig
 
       if [[ "$USEMODULES" == false ]]; then
-        GOCACHE=/gocache/windows-$PLATFORM/386 CC=i686-w64-mingw32-gcc-posix CXX=i686-w64-mingw32-g++-posix GOOS=windows GOARCH=386 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF" CGO_CXXFLAGS="$CGO_NTDEF" go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+        GOCACHE=/gocache/windows-$PLATFORM/386 CC=i686-w64-mingw32-gcc-posix CXX=i686-w64-mingw32-g++-posix GOOS=windows GOARCH=386 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF $CGO_CFLAGS" CGO_CXXFLAGS="$CGO_NTDEF $CGO_CXXFLAGS" go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
       fi
-      GOCACHE=/gocache/windows-$PLATFORM/386 CC=i686-w64-mingw32-gcc-posix CXX=i686-w64-mingw32-g++-posix GOOS=windows GOARCH=386 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF" CGO_CXXFLAGS="$CGO_NTDEF" $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-windows-$PLATFORM-386$(extension windows)" "$PACK_RELPATH"
+      GOCACHE=/gocache/windows-$PLATFORM/386 CC=i686-w64-mingw32-gcc-posix CXX=i686-w64-mingw32-g++-posix GOOS=windows GOARCH=386 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF $CGO_CFLAGS" CGO_CXXFLAGS="$CGO_NTDEF $CGO_CXXFLAGS" go_build "-windows-$PLATFORM-386$(extension windows)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
     fi
     if [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "arm64" ]; then
       if [ "$GO_VERSION_MAJOR" -lt 1 ] || { [ "$GO_VERSION_MAJOR" == 1 ] && [ "$GO_VERSION_MINOR" -lt 17 ]; }; then
@@ -431,14 +563,15 @@ for TARGET in $TARGETS; do
         # Windows ARM64 requires at least Windows 10
         CGO_NTDEF_ARM64="-D_WIN32_WINNT=0x0A00"
         echo "Compiling for windows-$PLATFORM/arm64..."
+        target_overrides windows-$PLATFORM arm64
         mkdir -p /gocache/windows-$PLATFORM/arm64
         XGOOS="windows-$PLATFORM" XGOARCH="arm64" GOCACHE=/gocache/windows-$PLATFORM/arm64 CC=aarch64-w64-mingw32-clang CXX=aarch64-w64-mingw32-clang++ HOST=aarch64-w64-mingw32 PREFIX=/llvm-mingw/aarch64-w64-mingw32 do_build
         export PKG_CONFIG_PATH=/llvm-mingw/aarch64-w64-mingw32/lib/pkgconfig
 
         if [[ "$USEMODULES" == false ]]; then
-          GOCACHE=/gocache/windows-$PLATFORM/arm64 CC=aarch64-w64-mingw32-clang CXX=aarch64-w64-mingw32-clang++ GOOS=windows GOARCH=arm64 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF_ARM64" CGO_CXXFLAGS="$CGO_NTDEF_ARM64" go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+          GOCACHE=/gocache/windows-$PLATFORM/arm64 CC=aarch64-w64-mingw32-clang CXX=aarch64-w64-mingw32-clang++ GOOS=windows GOARCH=arm64 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF_ARM64 $CGO_CFLAGS" CGO_CXXFLAGS="$CGO_NTDEF_ARM64 $CGO_CXXFLAGS" go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
         fi
-        GOCACHE=/gocache/windows-$PLATFORM/arm64 CC=aarch64-w64-mingw32-clang CXX=aarch64-w64-mingw32-clang++ GOOS=windows GOARCH=arm64 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF_ARM64" CGO_CXXFLAGS="$CGO_NTDEF_ARM64" $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-windows-$PLATFORM-arm64$(extension windows)" "$PACK_RELPATH"
+        GOCACHE=/gocache/windows-$PLATFORM/arm64 CC=aarch64-w64-mingw32-clang CXX=aarch64-w64-mingw32-clang++ GOOS=windows GOARCH=arm64 CGO_ENABLED=1 CGO_CFLAGS="$CGO_NTDEF_ARM64 $CGO_CFLAGS" CGO_CXXFLAGS="$CGO_NTDEF_ARM64 $CGO_CXXFLAGS" go_build "-windows-$PLATFORM-arm64$(extension windows)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
       fi
     fi
   fi
@@ -451,35 +584,29 @@ for TARGET in $TARGETS; do
     fi
     export MACOSX_DEPLOYMENT_TARGET=$PLATFORM
 
-    # Strip symbol table below Go 1.6 to prevent DWARF issues
-    LDS=("${LD[@]}")
-    if [ "$GO_VERSION_MAJOR" -lt 1 ] || { [ "$GO_VERSION_MAJOR" == 1 ] && [ "$GO_VERSION_MINOR" -lt 16 ]; }; then
-      LDS=("-s" "${LDS[@]}")
-    fi
-    if [ ${#LDS[@]} -gt 0 ]; then
-      LDFS=(--ldflags="$(printf "%s " "${LD[@]}")")
-    fi
     # Build the requested darwin binaries
     if [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "amd64" ]; then
       echo "Compiling for darwin-$PLATFORM/amd64..."
+      target_overrides darwin-$PLATFORM amd64
       mkdir -p /gocache/darwin-$PLATFORM/amd64
       XGOOS="darwin-$PLATFORM" XGOARCH="amd64" GOCACHE=/gocache/darwin-$PLATFORM/amd64 CC=o64-clang CXX=o64-clang++ HOST=x86_64-apple-darwin15 PREFIX=/usr/local do_build
       if [[ "$USEMODULES" == false ]]; then
-        GOCACHE=/gocache/darwin-$PLATFORM/amd64 CC=o64-clang CXX=o64-clang++ GOOS=darwin GOARCH=amd64 CGO_ENABLED=1 go get $V $X "${T[@]}" "${LDFS[@]}" "${GC[@]}" -d "$PACK_RELPATH"
+        GOCACHE=/gocache/darwin-$PLATFORM/amd64 CC=o64-clang CXX=o64-clang++ GOOS=darwin GOARCH=amd64 CGO_ENABLED=1 go get $V $X "${T[@]}" "${LDF[@]}" "${GC[@]}" -d "${PACK_RELPATHS[@]}"
       fi
-      GOCACHE=/gocache/darwin-$PLATFORM/amd64 CC=o64-clang CXX=o64-clang++ GOOS=darwin GOARCH=amd64 CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDFS[@]}" "${GC[@]}" $R "${BM[@]}" -o "/build/$NAME-darwin-$PLATFORM-amd64$R$(extension darwin)" "$PACK_RELPATH"
+      GOCACHE=/gocache/darwin-$PLATFORM/amd64 CC=o64-clang CXX=o64-clang++ GOOS=darwin GOARCH=amd64 CGO_ENABLED=1 go_build "-darwin-$PLATFORM-amd64$R$(extension darwin)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" $R "${BM[@]}"
     fi
     if [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "arm64" ]; then
       if [ "$GO_VERSION_MAJOR" -lt 1 ] || { [ "$GO_VERSION_MAJOR" == 1 ] && [ "$GO_VERSION_MINOR" -lt 16 ]; }; then
         echo "Go version too low, skipping darwin-$PLATFORM/arm64..."
       else
         echo "Compiling for darwin-$PLATFORM/arm64..."
+        target_overrides darwin-$PLATFORM arm64
         mkdir -p /gocache/darwin-$PLATFORM/arm64
         XGOOS="darwin-$PLATFORM" XGOARCH="arm64" GOCACHE=/gocache/darwin-$PLATFORM/arm64 CC=o64-clang CXX=o64-clang++ HOST=arm64-apple-darwin15 PREFIX=/usr/local do_build
         if [[ "$USEMODULES" == false ]]; then
-          GOCACHE=/gocache/darwin-$PLATFORM/arm64 CC=o64-clang CXX=o64-clang++ GOOS=darwin GOARCH=arm64 CGO_ENABLED=1 go get $V $X "${T[@]}" "${LDFS[@]}" "${GC[@]}" -d "$PACK_RELPATH"
+          GOCACHE=/gocache/darwin-$PLATFORM/arm64 CC=o64-clang CXX=o64-clang++ GOOS=darwin GOARCH=arm64 CGO_ENABLED=1 go get $V $X "${T[@]}" "${LDF[@]}" "${GC[@]}" -d "${PACK_RELPATHS[@]}"
         fi
-        GOCACHE=/gocache/darwin-$PLATFORM/arm64 CC=o64-clang CXX=o64-clang++ GOOS=darwin GOARCH=arm64 CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDFS[@]}" "${GC[@]}" $R "${BM[@]}" -o "/build/$NAME-darwin-$PLATFORM-arm64$R$(extension darwin)" "$PACK_RELPATH"
+        GOCACHE=/gocache/darwin-$PLATFORM/arm64 CC=o64-clang CXX=o64-clang++ GOOS=darwin GOARCH=arm64 CGO_ENABLED=1 go_build "-darwin-$PLATFORM-arm64$R$(extension darwin)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" $R "${BM[@]}"
       fi
     fi
     # Remove any automatically injected deployment target vars
@@ -490,13 +617,14 @@ for TARGET in $TARGETS; do
     # Build the requested freebsd binaries
     if [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "amd64" ]; then
       echo "Compiling for freebsd/amd64..."
-      XGOOS="freebsd" XGOARCH="amd64" CC=x86_64-pc-freebsd14-gcc HOST=x86_64-pc-freebsd14 PREFIX=/freebsdcross/x86_64-pc-freebsd14 do_build
+      target_overrides freebsd amd64
+      XGOOS="freebsd" XGOARCH="amd64" CC=x86_64-pc-freebsd14-gcc CXX=x86_64-pc-freebsd14-g++ HOST=x86_64-pc-freebsd14 PREFIX=/freebsdcross/x86_64-pc-freebsd14 do_build
       export PKG_CONFIG_PATH=/freebsdcross/x86_64-pc-freebsd14/lib/pkgconfig
 
        if [[ "$USEMODULES" == false ]]; then
-        CC=x86_64-pc-freebsd14-gcc CXX=x86_64-pc-freebsd14-g++ GOOS=freebsd GOARCH=amd64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "$PACK_RELPATH"
+        CC=x86_64-pc-freebsd14-gcc CXX=x86_64-pc-freebsd14-g++ GOOS=freebsd GOARCH=amd64 CGO_ENABLED=1 go get $V $X "${T[@]}" -d "${PACK_RELPATHS[@]}"
       fi
-      CC=x86_64-pc-freebsd14-gcc CXX=x86_64-pc-freebsd14-g++ GOOS=freebsd GOARCH=amd64 CGO_ENABLED=1 $GOBIN build $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}" -o "/build/$NAME-freebsd14-amd64$(extension freebsd)" "$PACK_RELPATH"
+      CC=x86_64-pc-freebsd14-gcc CXX=x86_64-pc-freebsd14-g++ GOOS=freebsd GOARCH=amd64 CGO_ENABLED=1 go_build "-freebsd14-amd64$(extension freebsd)" $V $X $TP $BV "${MOD[@]}" "${T[@]}" "${LDF[@]}" "${GC[@]}" "${BM[@]}"
     fi
     if [ "$XGOARCH" == "." ] || [ "$XGOARCH" == "arm64" ]; then
       echo "skipping freebsd/arm64... as it is not yet supported"
@@ -524,5 +652,7 @@ for dir in /usr/local/*; do
   fi
 done
 
-# set owner of created executables to owner of the /build directory (all executables and created directories start with $NAME)
-chown -R --reference /build /build/"$NAME"*
+# set owner of created executables to owner of the /build directory (all executables and created directories start with a package name)
+for name in "${NAMES[@]}"; do
+  chown -R --reference /build /build/"$name"*
+done
@@ -5,23 +5,68 @@
 #
 # Usage: build_deps.sh <dependency folder> <configure arguments>
 #
+# Dependencies are built with CMake if they have a CMakeLists.txt, with Meson
+# if they have a meson.build, and with their configure script otherwise. The
+# configure arguments are only passed to configure scripts. If the build has a
+# dependency manifest, its order, build systems, arguments and targets apply
+# instead (see xgo deps-plan).
+#
 # Needed environment variables:
 #   CC      - C cross compiler to use for the build
+#   CXX     - C++ cross compiler to use for the build
 #   HOST    - Target platform to build (used to find the needed tool-chains)
 #   PREFIX  - File-system path where to install the built binaries
+#   XGOOS   - Target operating system as named by xgo (used by the cross files)
+#   XGOARCH - Target architecture as named by xgo (used by the cross files)
+#   XGO_PREFIX_MAP - Optional compiler flags mapping build paths for reproducible builds
+#   DEPS_MANIFEST  - Optional dependency manifest in build order, as passed by xgo
 set -e
 
 # Remove any previous build leftovers, and copy a fresh working set (clean doesn't work for cross compiling)
 rm -rf /deps-build && cp -r "$1" /deps-build
 
-# Build all the dependencies (no order for now)
-for dep in $(ls /deps-build/); do
-	echo "Configuring dependency $dep for $HOST..."
-	(cd "$dep" && ./configure --disable-shared --host="$HOST" --prefix="$PREFIX" --silent "${@:2}")
+# Keep the build folder out of the debug information of reproducible builds
+if [ "$XGO_PREFIX_MAP" != "" ]; then
+	export CFLAGS="${CFLAGS:--g -O2} $XGO_PREFIX_MAP"
+	export CXXFLAGS="${CXXFLAGS:--g -O2} $XGO_PREFIX_MAP"
+fi
+
+# Generate the CMake toolchain file and Meson cross file of the target
+rm -rf /deps-cross && xgo cross-files /deps-cross
+
+# Build the dependencies in the order xgo plans for this target, with the build
+# system and arguments it picked (one per line, fields separated by \x1f)
+xgo deps-plan /deps-build "${@:2}" > /deps-cross/plan
+while IFS=$'\x1f' read -r -u 3 -a fields; do
+	dir="${fields[0]}" dep=$(basename "${fields[0]}") args=("${fields[@]:2}")
+	case "${fields[1]}" in
+	cmake)
+		echo "Configuring dependency $dep for $HOST with CMake..."
+		cmake -S "$dir" -B "$dir/xgo-build" -DCMAKE_TOOLCHAIN_FILE=/deps-cross/toolchain.cmake \
+			-DCMAKE_INSTALL_PREFIX="$PREFIX" -DCMAKE_BUILD_TYPE=Release -DBUILD_SHARED_LIBS=OFF --log-level=WARNING "${args[@]}"
+
+		echo "Building dependency $dep for $HOST..."
+		cmake --build "$dir/xgo-build" --parallel
+		cmake --install "$dir/xgo-build"
+		;;
+	meson)
+		echo "Configuring dependency $dep for $HOST with Meson..."
+		meson setup "$dir/xgo-build" "$dir" --cross-file=/deps-cross/cross.ini \
+			--prefix="$PREFIX" --libdir=lib --buildtype=release --default-library=static "${args[@]}"
+
+		echo "Building dependency $dep for $HOST..."
+		meson compile -C "$dir/xgo-build"
+		meson install -C "$dir/xgo-build"
+		;;
+	autotools)
+		echo "Configuring dependency $dep for $HOST..."
+		(cd "$dir" && ./configure --disable-shared --host="$HOST" --prefix="$PREFIX" --silent "${args[@]}")
 
-	echo "Building dependency $dep for $HOST..."
-	(cd "$dep" && make --silent -j install)
-done
+		echo "Building dependency $dep for $HOST..."
+		(cd "$dir" && make --silent -j install)
+		;;
+	esac
+done 3< /deps-cross/plan
 
 # Remove any build artifacts
-rm -rf /deps-build
+rm -rf /deps-build /deps-cross
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// forwardedGoEnv lists the Go environment variables forwarded from the host to
+// the build. Variables describing the host toolchain, file system layout or
+// target (GOROOT, GOPATH, GOCACHE, GOOS, GOARCH, GOARM, CC, ...) are left out
+// on purpose, the image and build script set those for every target.
+var forwardedGoEnv = []string{
+	// Module download and verification
+	"GOFLAGS", "GOPROXY", "GOPRIVATE", "GONOPROXY", "GONOSUMDB", "GOSUMDB",
+	"GOINSECURE", "GOVCS", "GOAUTH", "GOTOOLCHAIN",
+	// Compiler and runtime behaviour
+	"GOEXPERIMENT", "GODEBUG", "GOFIPS140",
+	// Architecture feature levels, only used by matching targets
+	"GOAMD64", "GOARM64", "GO386", "GOMIPS", "GOMIPS64", "GOPPC64", "GORISCV64",
+}
+
+// hostEnv returns the environment to forward from the host to the build:
+// every Go variable in forwardedGoEnv that the user changed (either in the
+// environment or with go env -w), plus any host variable matching the -env-pass
+// patterns, minus those matching the -env-skip patterns.
+func hostEnv(config *ConfigFlags) []string {
+	values := changedGoEnv()
+	for _, name := range forwardedGoEnv {
+		if value := os.Getenv(name); value != "" {
+			values[name] = value
+		}
+	}
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if matchEnvPattern(config.EnvPass, name) {
+			values[name] = value
+		}
+	}
+	var env []string
+	for name, value := range values {
+		if !matchEnvPattern(config.EnvSkip, name) {
+			env = append(env, name+"="+value)
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// changedGoEnv asks the host go tool for the forwarded Go variables that differ
+// from their defaults, which includes values set with go env -w. It returns an
+// empty map if no (recent enough) go tool is available.
+func changedGoEnv() map[string]string {
+	values := make(map[string]string)
+
+	out, err := exec.Command("go", append([]string{"env", "-json", "-changed"}, forwardedGoEnv...)...).Output()
+	if err != nil {
+		return values
+	}
+	var changed map[string]string
+	if err := json.Unmarshal(out, &changed); err != nil {
+		return values
+	}
+	for name, value := range changed {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// filterEnv drops the variables matching the -env-skip patterns from an
+// environment list (used when building within the current system, where the
+// whole environment is inherited).
+func filterEnv(env []string, config *ConfigFlags) []string {
+	var filtered []string
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !matchEnvPattern(config.EnvSkip, name) {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered
+}
+
+// matchEnvPattern reports whether name matches any of the glob patterns.
+func matchEnvPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
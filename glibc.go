@@ -0,0 +1,177 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseVersion splits a dotted version (e.g. 2.17) into its numeric parts.
+func parseVersion(version string) ([]int, error) {
+	var parts []int
+	for _, field := range strings.Split(version, ".") {
+		part, err := strconv.Atoi(field)
+		if err != nil || part < 0 {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// compareVersions compares two parsed versions, returning -1, 0 or +1.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// glibcABIVersions maps the GLIBC version requirements that mark ABI features
+// rather than releases to the release introducing them.
+var glibcABIVersions = map[string]string{
+	"GLIBC_ABI_DT_RELR": "2.36",
+}
+
+// symbolVersionNeeds groups the GLIBC and GLIBCXX versions an ELF file requires
+// (from its .gnu.version_r entries) with the imported symbols needing each. ABI
+// feature requirements such as GLIBC_ABI_DT_RELR are listed under the release
+// introducing them, with the requirement as name.
+func symbolVersionNeeds(path string) (map[string]map[string][]string, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	needs := make(map[string]map[string][]string)
+	add := func(requirement, name string) {
+		prefix, version, ok := strings.Cut(requirement, "_")
+		if !ok || (prefix != "GLIBC" && prefix != "GLIBCXX") {
+			return
+		}
+		if release, ok := glibcABIVersions[requirement]; ok {
+			version, name = release, requirement
+		}
+		if _, err := parseVersion(version); err != nil {
+			return // GLIBC_PRIVATE and the like
+		}
+		if needs[prefix] == nil {
+			needs[prefix] = make(map[string][]string)
+		}
+		needs[prefix][version] = needs[prefix][version] // Keep versions without symbols
+		if name != "" {
+			needs[prefix][version] = append(needs[prefix][version], name)
+		}
+	}
+	// Statically linked files have no dynamic symbols and require nothing
+	if file.SectionByType(elf.SHT_DYNSYM) == nil {
+		return needs, nil
+	}
+	syms, err := file.ImportedSymbols()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dynamic symbols: %w", err)
+	}
+	for _, sym := range syms {
+		add(sym.Version, sym.Name)
+	}
+	// Some requirements carry no symbols, so only show up in the version needs
+	if file.SectionByType(elf.SHT_GNU_VERNEED) != nil {
+		libs, err := file.DynamicVersionNeeds()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read version needs: %w", err)
+		}
+		for _, lib := range libs {
+			for _, need := range lib.Needs {
+				add(need.Dep, "")
+			}
+		}
+	}
+	return needs, nil
+}
+
+// highestVersion returns the highest of the required versions.
+func highestVersion(versions map[string][]string) string {
+	var highest string
+	for version := range versions {
+		a, _ := parseVersion(version)
+		b, _ := parseVersion(highest)
+		if highest == "" || compareVersions(a, b) > 0 {
+			highest = version
+		}
+	}
+	return highest
+}
+
+// checkGlibc reports the highest GLIBC and GLIBCXX versions every Linux
+// executable and shared library requires, and fails if any requires a glibc
+// newer than the ceiling (if one is given), naming the offending symbols.
+func checkGlibc(artifacts []Artifact, ceiling, mode string) error {
+	if mode == "archive" || mode == "c-archive" {
+		return nil
+	}
+	var limit []int
+	if ceiling != "" {
+		var err error
+		if limit, err = parseVersion(ceiling); err != nil {
+			return fmt.Errorf("invalid glibc ceiling: %w", err)
+		}
+	}
+	var problems []string
+	for _, artifact := range artifacts {
+		if artifact.Target.OS != "linux" {
+			continue
+		}
+		needs, err := symbolVersionNeeds(artifact.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read symbol versions of %s: %w", artifact.Path, err)
+		}
+		if len(needs) == 0 {
+			continue
+		}
+		var required []string
+		for _, prefix := range []string{"GLIBC", "GLIBCXX"} {
+			if versions := needs[prefix]; len(versions) > 0 {
+				required = append(required, prefix+"_"+highestVersion(versions))
+			}
+		}
+		fmt.Printf("%s: requires %s\n", artifact.Path, strings.Join(required, ", "))
+
+		if limit == nil {
+			continue
+		}
+		var offending []string
+		for version, names := range needs["GLIBC"] {
+			if parsed, _ := parseVersion(version); compareVersions(parsed, limit) > 0 {
+				if len(names) == 0 {
+					offending = append(offending, "GLIBC_"+version)
+				}
+				for _, name := range names {
+					offending = append(offending, name+"@GLIBC_"+version)
+				}
+			}
+		}
+		if len(offending) > 0 {
+			sort.Strings(offending)
+			problems = append(problems, fmt.Sprintf("%s: %s", artifact.Path, strings.Join(offending, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("glibc versions newer than %s required:\n  %s", ceiling, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
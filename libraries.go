@@ -0,0 +1,160 @@
+package main
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LibraryPolicy restricts the shared libraries the artifacts may load at run
+// time, on top of the system libraries allowed by default.
+type LibraryPolicy struct {
+	Allow   map[string][]string `yaml:"allow"`   // Additional allowed library globs per OS
+	Enforce bool                `yaml:"enforce"` // Fail the build on libraries not allowed
+}
+
+// defaultLibraries are the system libraries every artifact of an OS may load.
+var defaultLibraries = map[string][]string{
+	"linux": {
+		"libc.so.*", "libm.so.*", "libpthread.so.*", "libdl.so.*", "librt.so.*",
+		"libresolv.so.*", "ld-linux*.so.*", "ld64.so.*", "ld.so.*", "libc.so", "ld-musl-*.so.*",
+	},
+	"freebsd": {
+		"libc.so.*", "libm.so.*", "libthr.so.*", "libpthread.so.*",
+	},
+	"windows": {
+		"kernel32.dll", "ntdll.dll", "kernelbase.dll", "user32.dll", "gdi32.dll",
+		"advapi32.dll", "shell32.dll", "ole32.dll", "oleaut32.dll", "comctl32.dll",
+		"comdlg32.dll", "shlwapi.dll", "version.dll", "winmm.dll", "ws2_32.dll",
+		"mswsock.dll", "iphlpapi.dll", "dnsapi.dll", "netapi32.dll", "userenv.dll",
+		"crypt32.dll", "bcrypt.dll", "ncrypt.dll", "secur32.dll", "wininet.dll",
+		"winhttp.dll", "setupapi.dll", "psapi.dll", "powrprof.dll", "dbghelp.dll",
+		"msvcrt.dll", "ucrtbase.dll", "api-ms-win-*.dll",
+	},
+	"darwin": {
+		"/usr/lib/libSystem.B.dylib", "/usr/lib/libresolv.9.dylib", "/usr/lib/libc++.1.dylib",
+		"/usr/lib/libobjc.A.dylib", "/System/Library/Frameworks/*",
+	},
+}
+
+// sharedLibraries lists the libraries an executable or shared library loads at
+// run time: ELF DT_NEEDED entries, PE imports or Mach-O LC_LOAD_DYLIB entries.
+func sharedLibraries(path string, target Target) ([]string, error) {
+	var libs []string
+	switch target.OS {
+	case "windows":
+		file, err := pe.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		// debug/pe doesn't implement ImportedLibraries, derive them from the
+		// imported symbols (symbol:library)
+		syms, err := file.ImportedSymbols()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PE imports: %w", err)
+		}
+		seen := make(map[string]bool)
+		for _, sym := range syms {
+			if _, lib, ok := strings.Cut(sym, ":"); ok && !seen[strings.ToLower(lib)] {
+				seen[strings.ToLower(lib)] = true
+				libs = append(libs, lib)
+			}
+		}
+	case "darwin", "ios":
+		file, err := macho.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		libs, err = file.ImportedLibraries()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Mach-O load commands: %w", err)
+		}
+	default:
+		file, err := elf.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		libs, err = file.ImportedLibraries()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ELF dynamic section: %w", err)
+		}
+	}
+	sort.Strings(libs)
+	return libs, nil
+}
+
+// inspectLibraries records the shared libraries of every artifact along with
+// those missing from the allowlist of its OS, printing a report as it goes.
+// Static archives have no run time dependencies and are skipped.
+func inspectLibraries(artifacts []Artifact, policy *LibraryPolicy, mode string) error {
+	if mode == "archive" || mode == "c-archive" {
+		return nil
+	}
+	for i := range artifacts {
+		artifact := &artifacts[i]
+
+		libs, err := sharedLibraries(artifact.Path, artifact.Target)
+		if err != nil {
+			return fmt.Errorf("failed to list libraries of %s: %w", artifact.Path, err)
+		}
+		artifact.Libraries = libs
+
+		allowed := defaultLibraries[artifact.Target.OS]
+		if policy != nil {
+			allowed = append(allowed[:len(allowed):len(allowed)], policy.Allow[artifact.Target.OS]...)
+		}
+		for _, lib := range libs {
+			if !matchLibrary(allowed, lib, artifact.Target.OS == "windows") {
+				artifact.Disallowed = append(artifact.Disallowed, lib)
+			}
+		}
+		switch {
+		case len(libs) == 0:
+			fmt.Printf("%s: statically linked\n", artifact.Path)
+		case len(artifact.Disallowed) == 0:
+			fmt.Printf("%s: %s\n", artifact.Path, strings.Join(libs, ", "))
+		default:
+			fmt.Printf("%s: %s (not allowed: %s)\n", artifact.Path, strings.Join(libs, ", "), strings.Join(artifact.Disallowed, ", "))
+		}
+	}
+	return nil
+}
+
+// libraryViolations summarises the disallowed libraries of all artifacts.
+func libraryViolations(artifacts []Artifact) error {
+	var problems []string
+	for _, artifact := range artifacts {
+		if len(artifact.Disallowed) > 0 {
+			problems = append(problems, fmt.Sprintf("%s loads %s", artifact.Path, strings.Join(artifact.Disallowed, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("shared libraries not in the allowlist:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// matchLibrary reports whether a library matches any of the globs, where a *
+// matches any sequence of characters including path separators.
+func matchLibrary(globs []string, lib string, fold bool) bool {
+	for _, glob := range globs {
+		expr := "^" + strings.ReplaceAll(strings.ReplaceAll(regexp.QuoteMeta(glob), `\*`, ".*"), `\?`, ".") + "$"
+		if fold {
+			expr = "(?i)" + expr
+		}
+		if ok, _ := regexp.MatchString(expr, lib); ok {
+			return true
+		}
+	}
+	return false
+}
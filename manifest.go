@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// manifestFile is the name of the build manifest written next to the outputs
+// of reproducible builds.
+const manifestFile = "xgo-manifest.json"
+
+// Manifest records how a reproducible build was invoked and what it produced,
+// so that xgo verify can repeat it and compare the results.
+type Manifest struct {
+	Dir             string             `json:"dir"`                       // Working directory xgo was started in
+	Flags           []string           `json:"flags"`                     // Command line flags, without publishing and signing ones
+	Reproducible    bool               `json:"reproducible,omitempty"`    // Whether the build was meant to be reproducible
+	Args            []string           `json:"args"`                      // Positional arguments (the repository)
+	Image           string             `json:"image,omitempty"`           // Content addressed image the build ran in
+	Commit          string             `json:"commit,omitempty"`          // Commit of the local repository
+	Dirty           bool               `json:"dirty,omitempty"`           // Whether the checkout had uncommitted changes
+	SourceDateEpoch int64              `json:"sourceDateEpoch,omitempty"` // Timestamp the build was pinned to
+	Artifacts       []ManifestArtifact `json:"artifacts"`                 // Outputs of the build
+}
+
+// ManifestArtifact is a single output recorded in the build manifest.
+type ManifestArtifact struct {
+	Target  string `json:"target"`            // Target including its platform version
+	Package string `json:"package,omitempty"` // Sub-package the output was built from
+	Path    string `json:"path"`              // Slash separated path within the output folder
+	SHA256  string `json:"sha256"`            // Hex encoded SHA-256 of the output
+
+	Libraries  []string `json:"libraries,omitempty"`  // Shared libraries loaded at run time
+	Violations []string `json:"violations,omitempty"` // Shared libraries missing from the allowlist
+}
+
+// unrecordedFlags are left out of the manifest, so xgo verify doesn't publish
+// or sign the rebuilt outputs again, and no credentials or host paths beyond
+// the build inputs are recorded.
+var unrecordedFlags = map[string]bool{
+	"upload":            true,
+	"upload-endpoint":   true,
+	"push-artifacts":    true,
+	"oci-layout":        true,
+	"oci-base":          true,
+	"oci-push":          true,
+	"linux-packages":    true,
+	"sign-windows":      true,
+	"sign-windows-pass": true,
+	"sign-darwin":       true,
+	"sign-darwin-pass":  true,
+	"timestamp-url":     true,
+	"provenance-key":    true,
+}
+
+// recordedFlags returns the command line flags to record in the manifest,
+// dropping the unrecorded ones along with their values. Ad-hoc macOS signing
+// is kept, as its signatures are deterministic parts of the outputs.
+func recordedFlags(args []string) []string {
+	var recorded []string
+	for i := 0; i < len(args); i++ {
+		name, value, inline := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+
+		// Non-boolean flags take the next argument unless given as -name=value
+		n := 1
+		if f := flag.Lookup(name); f != nil && !inline && i+1 < len(args) {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				n, value = 2, args[i+1]
+			}
+		}
+		if !unrecordedFlags[name] || (name == "sign-darwin" && value == adhocSigning) {
+			recorded = append(recorded, args[i:i+n]...)
+		}
+		i += n - 1
+	}
+	return recorded
+}
+
+// newManifestArtifacts hashes the collected outputs of a build.
+func newManifestArtifacts(folder string, artifacts []Artifact) ([]ManifestArtifact, error) {
+	entries := make([]ManifestArtifact, 0, len(artifacts))
+	for _, artifact := range artifacts {
+		sum, err := fileSHA256(artifact.Path)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(folder, artifact.Path)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, ManifestArtifact{
+			Target:  describeTarget(artifact.Target),
+			Package: artifact.Package,
+			Path:    filepath.ToSlash(rel),
+			SHA256:  sum,
+
+			Libraries:  artifact.Libraries,
+			Violations: artifact.Disallowed,
+		})
+	}
+	return entries, nil
+}
+
+// writeManifest stores the manifest in the output folder.
+func writeManifest(folder string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(folder, manifestFile), append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write build manifest: %w", err)
+	}
+	return nil
+}
+
+// readManifest loads a build manifest from disk.
+func readManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build manifest: %w", err)
+	}
+	manifest := new(Manifest)
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse build manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of a file.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests that publishing and signing flags are left out of the manifest along
+// with their values, in every form the flag package accepts.
+func TestRecordedFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{
+			[]string{"-reproducible", "-targets", "linux/amd64", "-upload", "s3://bucket/", "-v"},
+			[]string{"-reproducible", "-targets", "linux/amd64", "-v"},
+		},
+		{
+			[]string{"--push-artifacts=ghcr.io/org/app:v1", "-oci-layout", "dist/oci", "--oci-push", "ghcr.io/org/app:v1", "-ldflags=-s"},
+			[]string{"-ldflags=-s"},
+		},
+		{
+			[]string{"-sign-windows", "cert.pfx", "-sign-windows-pass", "env:PASS", "-timestamp-url", "http://ts", "-provenance-key", "key.pem", "-provenance"},
+			[]string{"-provenance"},
+		},
+		{
+			[]string{"-sign-darwin", "adhoc", "-linux-packages", "deb", "-trimpath"},
+			[]string{"-sign-darwin", "adhoc", "-trimpath"},
+		},
+		{
+			[]string{"-sign-darwin=developer-id.p12", "-sign-darwin-pass=file:pass", "-sign-darwin=adhoc"},
+			[]string{"-sign-darwin=adhoc"},
+		},
+	}
+	for _, tt := range tests {
+		if have := recordedFlags(tt.args); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%q: have %q, want %q", tt.args, have, tt.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ociBinDir is the folder the images hold the executables in.
+const ociBinDir = "/usr/local/bin"
+
+// ociPlatform returns the image platform of a Linux target, carrying the ARM
+// version as the variant (e.g. arm-7 becomes linux/arm/v7).
+func ociPlatform(target Target) *ocispec.Platform {
+	platform := &ocispec.Platform{OS: target.OS, Architecture: target.GoArch}
+	if target.GoArm != "" {
+		platform.Variant = "v" + target.GoArm
+	}
+	return platform
+}
+
+// ociAnnotations returns the pre-defined annotations describing the build,
+// filled from the version control metadata available.
+func ociAnnotations(git gitInfo, created time.Time) map[string]string {
+	annotations := map[string]string{ocispec.AnnotationCreated: created.Format(time.RFC3339)}
+	for key, value := range map[string]string{
+		ocispec.AnnotationRevision: git.Commit,
+		ocispec.AnnotationSource:   git.Remote,
+		ocispec.AnnotationVersion:  git.Version,
+	} {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+// ociLayer is a compressed layer along with the digest of its uncompressed
+// contents, as the image configuration references it.
+type ociLayer struct {
+	Data   []byte
+	DiffID digest.Digest
+}
+
+// readBaseLayer loads a tarball to place beneath the executables of every
+// image, compressing it if it isn't already.
+func readBaseLayer(file string) (*ociLayer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base layer: %w", err)
+	}
+	raw := data
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress base layer: %w", err)
+		}
+		if raw, err = io.ReadAll(gz); err != nil {
+			return nil, fmt.Errorf("failed to decompress base layer: %w", err)
+		}
+	} else if data, err = gzipBytes(raw); err != nil {
+		return nil, err
+	}
+	if _, err := tar.NewReader(bytes.NewReader(raw)).Next(); err != nil {
+		return nil, fmt.Errorf("base layer %s is not a tarball: %w", file, err)
+	}
+	return &ociLayer{Data: data, DiffID: digest.FromBytes(raw)}, nil
+}
+
+// imageLayout is an OCI image layout folder being written.
+type imageLayout struct {
+	dir string
+}
+
+// writeBlob stores a blob in the layout and returns its descriptor.
+func (l *imageLayout) writeBlob(mediaType string, data []byte) (ocispec.Descriptor, error) {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+
+	blob := filepath.Join(l.dir, ocispec.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
+		return desc, err
+	}
+	return desc, os.WriteFile(blob, data, 0o644)
+}
+
+// writeJSON stores a JSON document in the layout and returns its descriptor.
+func (l *imageLayout) writeJSON(mediaType string, v any) (ocispec.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return l.writeBlob(mediaType, data)
+}
+
+// readBlob loads the content of a descriptor from the layout.
+func (l *imageLayout) readBlob(desc ocispec.Descriptor) ([]byte, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(l.dir, ocispec.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err != nil {
+		return nil, err
+	}
+	if digest.FromBytes(data) != desc.Digest {
+		return nil, fmt.Errorf("blob %s is corrupted", desc.Digest)
+	}
+	return data, nil
+}
+
+// writeOCILayout writes an OCI image layout into dir holding a multi-arch
+// image index, with an image per Linux target that carries its executables in
+// /usr/local/bin on top of the optional base layer. Targets built against both
+// glibc and musl use the musl outputs, as an index holds a single image per
+// platform. The index is named by tag in the layout.
+func writeOCILayout(dir, tag string, base *ociLayer, artifacts []Artifact, git gitInfo, config *ConfigFlags, flags *BuildFlags) (ocispec.Descriptor, error) {
+	layout := &imageLayout{dir: dir}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to create image layout: %w", err)
+	}
+	created := time.Now().UTC()
+	if flags.SourceDateEpoch != 0 {
+		created = time.Unix(flags.SourceDateEpoch, 0).UTC()
+	}
+	names := executableNames(config)
+
+	labels := ociAnnotations(git, created)
+
+	order, grouped := groupLinuxArtifacts(artifacts)
+	index := ocispec.Index{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageIndex,
+		Annotations: labels,
+	}
+	for _, target := range order {
+		if hasMuslOutputs(target, grouped) {
+			continue
+		}
+		// Scratch images have no C library for dynamically linked outputs to load
+		if base == nil && !staticallyLinked(grouped[target.String()]) {
+			return ocispec.Descriptor{}, fmt.Errorf("outputs for %s are dynamically linked and can't run in a scratch image, pass an -oci-base with their libraries", target)
+		}
+		// Assemble the layer holding the executables
+		var (
+			entries    []tarEntry
+			entrypoint []string
+		)
+		for _, dir := range []string{"usr", "usr/local", "usr/local/bin"} {
+			entries = append(entries, tarDir(dir, created))
+		}
+		for _, artifact := range grouped[target.String()] {
+			data, err := os.ReadFile(artifact.Path)
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			file := path.Join(ociBinDir, names[artifact.Package])
+			entries = append(entries, tarFile(file[1:], 0o755, data, created))
+			if entrypoint == nil {
+				entrypoint = []string{file}
+			}
+		}
+		raw, err := writeTar(entries, true)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		compressed, err := gzipBytes(raw)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		layers := []*ociLayer{{Data: compressed, DiffID: digest.FromBytes(raw)}}
+		if base != nil {
+			layers = append([]*ociLayer{base}, layers...)
+		}
+		// Assemble the image configuration and manifest of the target
+		platform := ociPlatform(target)
+		image := ocispec.Image{
+			Created:  &created,
+			Platform: *platform,
+			Config: ocispec.ImageConfig{
+				Env:        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+				Entrypoint: entrypoint,
+				Labels:     labels,
+			},
+			RootFS: ocispec.RootFS{Type: "layers"},
+		}
+		manifest := ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+		}
+		for _, layer := range layers {
+			desc, err := layout.writeBlob(ocispec.MediaTypeImageLayerGzip, layer.Data)
+			if err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("failed to write image layer: %w", err)
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+			image.RootFS.DiffIDs = append(image.RootFS.DiffIDs, layer.DiffID)
+		}
+		if manifest.Config, err = layout.writeJSON(ocispec.MediaTypeImageConfig, image); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to write image config: %w", err)
+		}
+		desc, err := layout.writeJSON(ocispec.MediaTypeImageManifest, manifest)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to write image manifest: %w", err)
+		}
+		desc.Platform = platform
+		index.Manifests = append(index.Manifests, desc)
+	}
+	if len(index.Manifests) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("no Linux outputs to build images from")
+	}
+	desc, err := layout.writeJSON(ocispec.MediaTypeImageIndex, index)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to write image index: %w", err)
+	}
+	// Name the multi-arch index in the layout's entry point
+	desc.Annotations = map[string]string{ocispec.AnnotationRefName: tag}
+	root, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{desc},
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ocispec.ImageIndexFile), root, 0o644); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to write image layout: %w", err)
+	}
+	version, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), version, 0o644); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to write image layout: %w", err)
+	}
+	fmt.Printf("Created image layout %s (%d platforms, %s)\n", dir, len(index.Manifests), desc.Digest)
+	return desc, nil
+}
+
+// pushOCIImage uploads an image or image index of the layout to a registry,
+// along with everything it references, tagging it as the client's reference.
+func pushOCIImage(ctx context.Context, dir string, client *registryClient, desc ocispec.Descriptor) error {
+	if err := pushOCIContent(ctx, &imageLayout{dir: dir}, client, desc, client.tag); err != nil {
+		return err
+	}
+	fmt.Printf("Pushed %s/%s:%s@%s\n", client.base.Host, client.repo, client.tag, desc.Digest)
+	return nil
+}
+
+// pushOCIContent uploads a manifest under the given reference, after the blobs
+// and manifests it references.
+func pushOCIContent(ctx context.Context, layout *imageLayout, client *registryClient, desc ocispec.Descriptor, ref string) error {
+	data, err := layout.readBlob(desc)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", desc.Digest, err)
+	}
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex:
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("failed to decode image index: %w", err)
+		}
+		for _, manifest := range index.Manifests {
+			if err := pushOCIContent(ctx, layout, client, manifest, manifest.Digest.String()); err != nil {
+				return err
+			}
+		}
+	case ocispec.MediaTypeImageManifest:
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("failed to decode image manifest: %w", err)
+		}
+		for _, blob := range append(manifest.Layers, manifest.Config) {
+			content, err := layout.readBlob(blob)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", blob.Digest, err)
+			}
+			if err := client.pushBlob(ctx, blob, content); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported manifest type %s", desc.MediaType)
+	}
+	return client.pushManifest(ctx, ref, desc, data)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Types identifying the manifests pushed with -push-artifacts and the build
+// outputs within them, for clients pulling them from the registry.
+const (
+	artifactsType     = "application/vnd.techknowlogick.xgo.artifacts.v1"
+	artifactMediaType = "application/octet-stream"
+)
+
+// Annotations describing the target of every build output in the manifest.
+const (
+	annotationOS      = "com.techknowlogick.xgo.os"
+	annotationArch    = "com.techknowlogick.xgo.arch"
+	annotationLibc    = "com.techknowlogick.xgo.libc"
+	annotationPackage = "com.techknowlogick.xgo.package"
+)
+
+// pushArtifacts uploads the build outputs to a registry as an OCI artifact
+// manifest, holding a descriptor per output annotated with its target. The
+// manifest is tagged as the client's reference, and the outputs are titled by
+// their path within the output folder.
+func pushArtifacts(ctx context.Context, folder string, client *registryClient, artifacts []Artifact, git gitInfo, flags *BuildFlags) error {
+	created := time.Now().UTC()
+	if flags.SourceDateEpoch != 0 {
+		created = time.Unix(flags.SourceDateEpoch, 0).UTC()
+	}
+	manifest := ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactsType,
+		Config:       ocispec.DescriptorEmptyJSON,
+		Annotations:  ociAnnotations(git, created),
+	}
+	// Upload the outputs, the manifest references them once they are stored
+	for _, artifact := range artifacts {
+		data, err := os.ReadFile(artifact.Path)
+		if err != nil {
+			return err
+		}
+		title, err := filepath.Rel(folder, artifact.Path)
+		if err != nil {
+			return err
+		}
+		desc := ocispec.Descriptor{
+			MediaType: artifactMediaType,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+			Annotations: map[string]string{
+				ocispec.AnnotationTitle: filepath.ToSlash(title),
+				annotationOS:            artifact.Target.OS,
+				annotationArch:          artifact.Target.Arch,
+			},
+		}
+		if artifact.Target.Libc != "" {
+			desc.Annotations[annotationLibc] = artifact.Target.Libc
+		}
+		if artifact.Package != "" {
+			desc.Annotations[annotationPackage] = artifact.Package
+		}
+		// Universal binaries hold several architectures, so have no platform
+		if artifact.Target.GoArch != "" {
+			desc.Platform = ociPlatform(artifact.Target)
+		}
+		if err := client.pushBlob(ctx, desc, data); err != nil {
+			return fmt.Errorf("failed to push %s: %w", title, err)
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+	if err := client.pushBlob(ctx, manifest.Config, manifest.Config.Data); err != nil {
+		return err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	desc := ocispec.Descriptor{MediaType: manifest.MediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	if err := client.pushManifest(ctx, client.tag, desc, data); err != nil {
+		return err
+	}
+	fmt.Printf("Pushed %d artifacts to %s/%s:%s@%s\n", len(manifest.Layers), client.base.Host, client.repo, client.tag, desc.Digest)
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Artifact is a single output produced by the cross compilation.
+type Artifact struct {
+	Target  Target // Target the artifact was built for
+	Package string // Sub-package the artifact was built from
+	Path    string // Location of the artifact on the host
+	Header  string // C header generated alongside c-shared and c-archive outputs, if any
+
+	Libraries  []string // Shared libraries the artifact loads at run time
+	Disallowed []string // Shared libraries missing from the allowlist of the OS
+}
+
+// templateFields are the values available to -out-template and -ldflags.
+type templateFields struct {
+	gitInfo
+
+	Name     string // Last element of the output prefix (-out, or derived from the package)
+	OS       string // Go operating system (GOOS)
+	Arch     string // Architecture as named by xgo (e.g. arm-7)
+	GoArch   string // Go architecture (GOARCH)
+	GoArm    string // Go ARM version (GOARM), empty for non-arm targets
+	Platform string // Platform version (Windows NT, macOS deployment target)
+	Libc     string // C library variant of linux targets (musl), empty otherwise
+	Race     string // "-race" for race enabled builds, empty otherwise
+	Ext      string // File extension, including the leading dot
+}
+
+// newTemplateFields assembles the template fields of a single target.
+func newTemplateFields(target Target, name string, git gitInfo, flags *BuildFlags) templateFields {
+	race := ""
+	if flags.Race && target.Race {
+		race = "-race"
+	}
+	return templateFields{
+		gitInfo:  git,
+		Name:     name,
+		OS:       target.OS,
+		Arch:     target.Arch,
+		GoArch:   target.GoArch,
+		GoArm:    target.GoArm,
+		Platform: target.Platform,
+		Libc:     target.Libc,
+		Race:     race,
+		Ext:      targetExtension(target.OS, flags.Mode),
+	}
+}
+
+// parseOutputTemplate parses an -out-template value.
+func parseOutputTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("out").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderOutputPath expands the output template for a single target, making
+// sure the result stays within the destination folder.
+func renderOutputPath(tmpl *template.Template, fields templateFields) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, fields); err != nil {
+		return "", fmt.Errorf("failed to render output template: %w", err)
+	}
+	name := path.Clean(filepath.ToSlash(buf.String()))
+	if buf.Len() == 0 || name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("output template renders to invalid path %q for %s", buf.String(), fields.OS+"/"+fields.Arch)
+	}
+	return name, nil
+}
+
+// outputPath returns the path of an output relative to the destination folder,
+// either by expanding the output template or, if there is none, following the
+// naming of build.sh.
+func outputPath(tmpl *template.Template, name string, git gitInfo, target Target, flags *BuildFlags) (string, error) {
+	if tmpl == nil {
+		return path.Clean(name + scriptSuffix(target, flags.Race, flags.Mode)), nil
+	}
+	return renderOutputPath(tmpl, newTemplateFields(target, path.Base(name), git, flags))
+}
+
+// validateOutputs computes the output path of every requested package and
+// target and makes sure no two of them end up at the same path, before the
+// build starts.
+func validateOutputs(text string, names []string, git gitInfo, targets []Target, flags *BuildFlags) error {
+	var tmpl *template.Template
+	if text != "" {
+		var err error
+		if tmpl, err = parseOutputTemplate(text); err != nil {
+			return err
+		}
+	}
+	owners := make(map[string]string)
+	dirs := make(map[string]string)
+	for _, name := range names {
+		for _, target := range targets {
+			output, err := outputPath(tmpl, name, git, target, flags)
+			if err != nil {
+				return err
+			}
+			owner := name + " for " + describeTarget(target)
+			if other, ok := owners[output]; ok {
+				return fmt.Errorf("both %s and %s would be written to %s", other, owner, output)
+			}
+			if other, ok := dirs[output]; ok {
+				return fmt.Errorf("%s is used both as the output of %s and as a folder for %s", output, owner, other)
+			}
+			owners[output] = owner
+			for dir := path.Dir(output); dir != "."; dir = path.Dir(dir) {
+				if other, ok := owners[dir]; ok {
+					return fmt.Errorf("%s is used both as the output of %s and as a folder for %s", dir, other, owner)
+				}
+				dirs[dir] = owner
+			}
+		}
+	}
+	return nil
+}
+
+// describeTarget formats a target including its platform version, if any.
+func describeTarget(target Target) string {
+	if target.Platform != "" && (target.OS == "windows" || target.OS == "darwin") {
+		return target.OS + "-" + target.Platform + "/" + target.Arch
+	}
+	return target.String()
+}
+
+// collectArtifacts locates the outputs build.sh produced in folder for every
+// requested package and target and, if an output template was given, moves
+// them to their templated location. Targets the build script skipped are left
+// out, but a target missing only some of its outputs, or a build producing none
+// at all, fails.
+func collectArtifacts(folder string, git gitInfo, config *ConfigFlags, flags *BuildFlags) ([]Artifact, error) {
+	var tmpl *template.Template
+	if config.Template != "" {
+		var err error
+		if tmpl, err = parseOutputTemplate(config.Template); err != nil {
+			return nil, err
+		}
+	}
+	packages := config.Packages
+	if len(packages) == 0 {
+		packages = []string{""}
+	}
+	names := outputNames(config)
+
+	var artifacts []Artifact
+	for _, target := range resolveTargets(config.Targets) {
+		var missing []string
+		for _, name := range names {
+			source := name + scriptSuffix(target, flags.Race, flags.Mode)
+			if _, err := os.Stat(filepath.Join(folder, filepath.FromSlash(source))); err != nil {
+				missing = append(missing, source)
+			}
+		}
+		if len(missing) == len(names) {
+			continue
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("build outputs missing for %s: %s", target, strings.Join(missing, ", "))
+		}
+		for i, name := range names {
+			source := filepath.Join(folder, filepath.FromSlash(name+scriptSuffix(target, flags.Race, flags.Mode)))
+			artifact := Artifact{Target: target, Package: packages[i], Path: source}
+			if header := strings.TrimSuffix(source, targetExtension(target.OS, flags.Mode)) + ".h"; header != source {
+				if _, err := os.Stat(header); err == nil {
+					artifact.Header = header
+				}
+			}
+			if tmpl != nil {
+				rendered, err := outputPath(tmpl, name, git, target, flags)
+				if err != nil {
+					return nil, err
+				}
+				dest := filepath.Join(folder, filepath.FromSlash(rendered))
+				if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+					return nil, fmt.Errorf("failed to create output folder for %s: %w", rendered, err)
+				}
+				if err := os.Rename(source, dest); err != nil {
+					return nil, fmt.Errorf("failed to move %s to %s: %w", source, dest, err)
+				}
+				// Library headers keep following their output
+				if artifact.Header != "" {
+					header := strings.TrimSuffix(dest, targetExtension(target.OS, flags.Mode)) + ".h"
+					if err := os.Rename(artifact.Header, header); err != nil {
+						return nil, fmt.Errorf("failed to move %s to %s: %w", artifact.Header, header, err)
+					}
+					artifact.Header = header
+				}
+				removeEmptyParents(filepath.Dir(source), folder)
+				artifact.Path = dest
+			}
+			artifacts = append(artifacts, artifact)
+		}
+	}
+	if len(artifacts) == 0 {
+		return nil, fmt.Errorf("no build outputs found for %s", strings.Join(names, ", "))
+	}
+	return artifacts, nil
+}
+
+// removeEmptyParents deletes dir and its parents up to (but excluding) root as
+// long as they are empty. Module path based output names create such folders.
+func removeEmptyParents(dir, root string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// outputNames mirrors how build.sh derives the output prefix of each package:
+// the -out flag if given, the module path of a local module, or the last
+// element of the package path otherwise. Multiple packages are always named
+// after their folder.
+func outputNames(config *ConfigFlags) []string {
+	if len(config.Packages) > 1 {
+		return packageNames(config.Repository, config.Packages)
+	}
+	pack := ""
+	if len(config.Packages) == 1 {
+		pack = filepath.ToSlash(config.Packages[0])
+	}
+	name := config.Prefix
+	if name == "" && isLocalRepository(config.Repository) {
+		if module := modulePath(filepath.Join(config.Repository, "go.mod")); module != "" {
+			name = module
+			if pack != "" {
+				name = name + "/" + pack
+			}
+		}
+	}
+	if name == "" {
+		name = path.Base(filepath.ToSlash(config.Repository) + "/" + pack)
+	}
+	if name == "" || name == "." {
+		name = "main"
+	}
+	return []string{name}
+}
+
+// modulePath returns the module path declared in the given go.mod file, or an
+// empty string if it cannot be read.
+func modulePath(gomod string) string {
+	file, err := os.Open(gomod)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "module ") {
+			return strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "module ")), `"`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TargetOverride adjusts the build of the targets matching a glob.
+type TargetOverride struct {
+	Match   string            `yaml:"-"`       // Target glob (e.g. windows/*, linux/arm-*)
+	Env     map[string]string `yaml:"env"`     // Environment variables to set
+	Tags    string            `yaml:"tags"`    // Build tags added to the global ones
+	LdFlags string            `yaml:"ldflags"` // Linker flags appended to the global ones
+	GcFlags string            `yaml:"gcflags"` // Compiler flags appended to the global ones
+}
+
+// TargetOverrides is an ordered list of target overrides. In the config file it
+// is a mapping from target glob to override, applied in document order.
+type TargetOverrides []TargetOverride
+
+// UnmarshalYAML decodes the target glob mapping, preserving its order.
+func (o *TargetOverrides) UnmarshalYAML(node *yaml.Node) error {
+	return decodeTargetGlobs(node, "targets", "overrides", func(glob string, value *yaml.Node) error {
+		override := TargetOverride{Match: glob}
+		if err := value.Decode(&override); err != nil {
+			return err
+		}
+		*o = append(*o, override)
+		return nil
+	})
+}
+
+// decodeTargetGlobs walks a YAML mapping from target glob to value in document
+// order, validating every glob and handing it to decode along with its value.
+// The field and kind of value name the mapping in errors.
+func decodeTargetGlobs(node *yaml.Node, field, kind string, decode func(glob string, value *yaml.Node) error) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: %s must be a mapping from target glob to %s", node.Line, field, kind)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		glob := node.Content[i].Value
+		if err := validateTargetGlob(glob); err != nil {
+			return fmt.Errorf("line %d: %w", node.Content[i].Line, err)
+		}
+		if err := decode(glob, node.Content[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateTargetGlob makes sure a target glob is a well-formed pattern.
+func validateTargetGlob(glob string) error {
+	if _, err := path.Match(glob, ""); err != nil {
+		return fmt.Errorf("invalid target glob %q: %w", glob, err)
+	}
+	return nil
+}
+
+// parseTargetEnv parses a -target-env value of the form GLOB:NAME=VALUE.
+func parseTargetEnv(value string) (TargetOverride, error) {
+	match, kv, ok := strings.Cut(value, ":")
+	if !ok {
+		return TargetOverride{}, fmt.Errorf("invalid target environment %q, expected GLOB:NAME=VALUE", value)
+	}
+	name, val, ok := strings.Cut(kv, "=")
+	if !ok || name == "" {
+		return TargetOverride{}, fmt.Errorf("invalid target environment %q, expected GLOB:NAME=VALUE", value)
+	}
+	if err := validateTargetGlob(match); err != nil {
+		return TargetOverride{}, err
+	}
+	return TargetOverride{Match: match, Env: map[string]string{name: val}}, nil
+}
+
+// matches reports whether the override applies to the given target.
+func (o TargetOverride) matches(target Target) bool {
+	return matchTarget(o.Match, target)
+}
+
+// matchTarget reports whether a target glob selects the given target. The glob
+// is matched against both the plain os/arch form and, for versioned platforms,
+// the os-platform/arch form.
+func matchTarget(glob string, target Target) bool {
+	for _, name := range []string{target.String(), describeTarget(target)} {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// targetOverrideEnv merges the overrides applying to each target into the
+// environment build.sh picks up before building it. Every target with any
+// override gets an XGO_TARGET_<os>_<arch> variable (see targetEnvName) holding
+// NAME=VALUE lines, where the build flags are passed as their fully merged
+// FLAG_* values.
+func targetOverrideEnv(targets []Target, overrides TargetOverrides, flags *BuildFlags) []string {
+	var env []string
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		name := targetEnvName(target)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		var (
+			vars    = make(map[string]string)
+			tags    = []string{flags.Tags}
+			ldflags = []string{flags.LdFlags}
+			gcflags = []string{flags.GcFlags}
+			matched bool
+		)
+		for _, override := range overrides {
+			if !override.matches(target) {
+				continue
+			}
+			matched = true
+			for k, v := range override.Env {
+				vars[k] = v
+			}
+			tags = append(tags, override.Tags)
+			ldflags = append(ldflags, override.LdFlags)
+			gcflags = append(gcflags, override.GcFlags)
+		}
+		if !matched {
+			continue
+		}
+		var lines []string
+		for k, v := range vars {
+			lines = append(lines, k+"="+v)
+		}
+		sort.Strings(lines)
+		lines = append(lines,
+			"FLAG_TAGS="+strings.Join(splitTags(tags), ","),
+			"FLAG_LDFLAGS="+joinNonEmpty(ldflags),
+			"FLAG_GCFLAGS="+joinNonEmpty(gcflags),
+		)
+		env = append(env, name+"="+strings.Join(lines, "\n"))
+	}
+	return env
+}
+
+// targetEnvName returns the variable build.sh reads the overrides of a target
+// from, e.g. XGO_TARGET_linux_arm_7, XGO_TARGET_linux_musl_amd64 or, as several
+// platform versions may be built in one run, XGO_TARGET_windows_10_0_amd64.
+func targetEnvName(target Target) string {
+	return "XGO_TARGET_" + strings.NewReplacer("-", "_", ".", "_", "/", "_").Replace(describeTarget(target))
+}
+
+// splitTags splits build tag lists given either comma or space separated.
+func splitTags(lists []string) []string {
+	var tags []string
+	for _, list := range lists {
+		tags = append(tags, strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' })...)
+	}
+	return tags
+}
+
+// joinNonEmpty joins the non-empty flag strings with spaces.
+func joinNonEmpty(values []string) string {
+	var parts []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			parts = append(parts, value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/build"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// splitPackages splits the comma separated -pkg flag into its entries.
+func splitPackages(list string) []string {
+	var packages []string
+	for _, pack := range strings.Split(list, ",") {
+		if pack = strings.TrimSpace(pack); pack != "" {
+			packages = append(packages, pack)
+		}
+	}
+	return packages
+}
+
+// expandPackages resolves the requested sub-packages of the local repository
+// in dir. Entries ending in "/..." are expanded to every main package below
+// them, following the same rules as the go tool: folders starting with . or _,
+// testdata, vendor and nested modules are skipped. The returned packages are
+// relative to dir.
+func expandPackages(dir string, packages []string) ([]string, error) {
+	var expanded []string
+	for _, pack := range packages {
+		if pack != "..." && !strings.HasSuffix(pack, "/...") {
+			expanded = append(expanded, filepath.ToSlash(filepath.Clean(pack)))
+			continue
+		}
+		root := filepath.Join(dir, filepath.FromSlash(strings.TrimSuffix(strings.TrimSuffix(pack, "..."), "/")))
+		mains, err := findMainPackages(root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand package pattern %s: %w", pack, err)
+		}
+		if len(mains) == 0 {
+			return nil, fmt.Errorf("package pattern %s matched no main packages", pack)
+		}
+		for _, main := range mains {
+			rel, err := filepath.Rel(dir, main)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, filepath.ToSlash(rel))
+		}
+	}
+	// Drop duplicates, patterns may overlap with explicitly listed packages
+	seen := make(map[string]bool)
+	unique := expanded[:0]
+	for _, pack := range expanded {
+		if !seen[pack] {
+			seen[pack] = true
+			unique = append(unique, pack)
+		}
+	}
+	return unique, nil
+}
+
+// findMainPackages walks root and returns the folders containing a main package.
+func findMainPackages(root string) ([]string, error) {
+	var mains []string
+	err := filepath.WalkDir(root, func(dir string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if dir != root {
+			name := entry.Name()
+			if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor" {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		pack, err := build.ImportDir(dir, build.IgnoreVendor)
+		if err != nil {
+			var noGo *build.NoGoError
+			if errors.As(err, &noGo) {
+				return nil
+			}
+			return fmt.Errorf("failed to load package in %s: %w", dir, err)
+		}
+		if pack.Name == "main" {
+			mains = append(mains, dir)
+		}
+		return nil
+	})
+	return mains, err
+}
+
+// packageNames returns the output names build.sh uses when building multiple
+// packages at once: the last element of each package path, or of the
+// repository itself for its root package.
+func packageNames(repo string, packages []string) []string {
+	if abs, err := filepath.Abs(repo); err == nil && isLocalRepository(repo) {
+		repo = abs
+	}
+	names := make([]string, 0, len(packages))
+	for _, pack := range packages {
+		name := path.Base(filepath.ToSlash(pack))
+		if name == "." || name == "/" {
+			name = path.Base(filepath.ToSlash(repo))
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Object identifiers used by PKCS#7 signatures and RFC 3161 timestamps.
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidTSTInfo         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidTimeStampToken  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// digestAlgorithms maps digest algorithm identifiers to their hash functions.
+var digestAlgorithms = map[string]crypto.Hash{
+	oidSHA256.String(): crypto.SHA256,
+	oidSHA384.String(): crypto.SHA384,
+	oidSHA512.String(): crypto.SHA512,
+}
+
+// codeSigner holds the key and certificate chain loaded from the PKCS#12 file
+// given with -sign-windows or -sign-darwin.
+type codeSigner struct {
+	Key   crypto.Signer
+	Chain []*x509.Certificate // Signing certificate first
+}
+
+// readPassword resolves a password given as env:NAME or file:PATH. The file
+// content is used up to its first line break.
+func readPassword(spec string) (string, error) {
+	kind, value, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "":
+		return "", nil
+	case "env":
+		password, ok := os.LookupEnv(value)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", value)
+		}
+		return password, nil
+	case "file":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %w", err)
+		}
+		password, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimSuffix(password, "\r"), nil
+	}
+	return "", fmt.Errorf("invalid password source %q, expected env:NAME or file:PATH", spec)
+}
+
+// loadCodeSigner reads the RSA or ECDSA key and certificate chain of a
+// PKCS#12 (.pfx) file.
+func loadCodeSigner(path, password string) (*codeSigner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing certificate: %w", err)
+	}
+	key, cert, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signing certificate %s: %w", path, err)
+	}
+	signer := &codeSigner{Chain: append([]*x509.Certificate{cert}, chain...)}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signer.Key = key
+	case *ecdsa.PrivateKey:
+		signer.Key = key
+	default:
+		return nil, fmt.Errorf("unsupported signing key algorithm %T in %s", key, path)
+	}
+	return signer, nil
+}
+
+// attribute is a PKCS#9 attribute holding a single DER encoded value.
+func attribute(oid asn1.ObjectIdentifier, value []byte) ([]byte, error) {
+	return asn1.Marshal(struct {
+		Type   asn1.ObjectIdentifier
+		Values asn1.RawValue
+	}{oid, asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: value}})
+}
+
+// marshalSet encodes DER elements as the contents of a SET OF, in the sorted
+// order DER requires.
+func marshalSet(elements [][]byte) []byte {
+	sorted := append([][]byte{}, elements...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	return bytes.Join(sorted, nil)
+}
+
+// signedAttribute is an attribute to sign along with the content type and
+// message digest.
+type signedAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value any
+}
+
+// signPKCS7 creates a PKCS#7 SignedData over the given content, countersigned
+// by the timestamp server if one is given. The encapsulated content is DER
+// encoded, or nil for a detached signature. The message digest covers digested
+// rather than the content, as Authenticode only hashes the content's value.
+func (s *codeSigner) signPKCS7(ctx context.Context, contentType asn1.ObjectIdentifier, content, digested []byte, extra []signedAttribute, timestampURL string, timestampType asn1.ObjectIdentifier) ([]byte, error) {
+	contentDigest := sha256.Sum256(digested)
+
+	var attrs [][]byte
+	for _, attr := range append([]signedAttribute{{oidContentType, contentType}, {oidMessageDigest, contentDigest[:]}}, extra...) {
+		value, err := asn1.Marshal(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := attribute(attr.Type, value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, encoded)
+	}
+	signed := marshalSet(attrs)
+
+	// The signature covers the attributes encoded as a SET rather than the
+	// implicitly tagged field they are stored in
+	set, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signed})
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256(set)
+	signature, err := s.Key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	encryption := pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	if _, ok := s.Key.(*ecdsa.PrivateKey); ok {
+		encryption = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	}
+	var unsigned asn1.RawValue
+	if timestampURL != "" {
+		token, err := requestTimestamp(ctx, timestampURL, signature)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := attribute(timestampType, token)
+		if err != nil {
+			return nil, err
+		}
+		unsigned = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: attr}
+	}
+	leaf := s.Chain[0]
+	signerInfo, err := asn1.Marshal(struct {
+		Version         int
+		IssuerAndSerial struct {
+			Issuer asn1.RawValue
+			Serial *big.Int
+		}
+		DigestAlgorithm     pkix.AlgorithmIdentifier
+		SignedAttributes    asn1.RawValue
+		EncryptionAlgorithm pkix.AlgorithmIdentifier
+		Signature           []byte
+		UnsignedAttributes  asn1.RawValue `asn1:"optional"`
+	}{
+		Version: 1,
+		IssuerAndSerial: struct {
+			Issuer asn1.RawValue
+			Serial *big.Int
+		}{asn1.RawValue{FullBytes: leaf.RawIssuer}, leaf.SerialNumber},
+		DigestAlgorithm:     pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+		SignedAttributes:    asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signed},
+		EncryptionAlgorithm: encryption,
+		Signature:           signature,
+		UnsignedAttributes:  unsigned,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var certs []byte
+	for _, cert := range s.Chain {
+		certs = append(certs, cert.Raw...)
+	}
+	encapsulated := struct {
+		Type    asn1.ObjectIdentifier
+		Content asn1.RawValue `asn1:"optional"`
+	}{Type: contentType}
+	if content != nil {
+		encapsulated.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content}
+	}
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+		ContentInfo      struct {
+			Type    asn1.ObjectIdentifier
+			Content asn1.RawValue `asn1:"optional"`
+		}
+		Certificates asn1.RawValue
+		SignerInfos  asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}},
+		ContentInfo:      encapsulated,
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos:      asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signerInfo},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		Type    asn1.ObjectIdentifier
+		Content asn1.RawValue
+	}{oidSignedData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData}})
+}
+
+// requestTimestamp asks an RFC 3161 timestamp server to countersign the
+// signature, returning the timestamp token.
+func requestTimestamp(ctx context.Context, url string, signature []byte) ([]byte, error) {
+	imprint := sha256.Sum256(signature)
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	request, err := asn1.Marshal(struct {
+		Version        int
+		MessageImprint struct {
+			Algorithm pkix.AlgorithmIdentifier
+			Digest    []byte
+		}
+		Nonce   *big.Int
+		CertReq bool
+	}{
+		Version: 1,
+		MessageImprint: struct {
+			Algorithm pkix.AlgorithmIdentifier
+			Digest    []byte
+		}{pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}, imprint[:]},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/timestamp-query")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read timestamp response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("timestamp server responded with %s", res.Status)
+	}
+	// TimeStampResp: the status info followed by the token, if granted
+	fields, err := asn1Elements(body)
+	if err != nil || len(fields) == 0 {
+		return nil, errors.New("malformed timestamp response")
+	}
+	var status int
+	if _, err := asn1.Unmarshal(fields[0].Bytes, &status); err != nil {
+		return nil, errors.New("malformed timestamp response status")
+	}
+	if status > 1 || len(fields) < 2 {
+		return nil, fmt.Errorf("timestamp request rejected with status %d", status)
+	}
+	token := fields[1].FullBytes
+
+	// Make sure the token stamps this signature
+	stamp, err := parseSignedData(token, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp token: %w", err)
+	}
+	if _, err := checkTimestamp(stamp, signature); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// asn1Elements returns the elements of a DER encoded SEQUENCE or SET.
+func asn1Elements(der []byte) ([]asn1.RawValue, error) {
+	var outer asn1.RawValue
+	if rest, err := asn1.Unmarshal(der, &outer); err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, errors.New("trailing data after ASN.1 value")
+	}
+	return asn1Children(outer.Bytes)
+}
+
+// asn1Children splits concatenated DER values.
+func asn1Children(b []byte) ([]asn1.RawValue, error) {
+	var children []asn1.RawValue
+	for len(b) > 0 {
+		var child asn1.RawValue
+		rest, err := asn1.Unmarshal(b, &child)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		b = rest
+	}
+	return children, nil
+}
+
+// signedData is a parsed and verified PKCS#7 SignedData structure.
+type signedData struct {
+	ContentType asn1.ObjectIdentifier
+	Content     []byte // Contents of the encapsulated content, as covered by the message digest
+	Signer      *x509.Certificate
+	Signature   []byte
+	Unsigned    map[string][]byte // First value of each unsigned attribute
+}
+
+// parseSignedData parses a PKCS#7 SignedData content info and verifies its
+// signature: the message digest attribute must match the content, and the
+// signed attributes must be signed by the certificate the signer info names.
+// The certificate itself is not checked against any roots. Detached
+// signatures are checked against the given content.
+func parseSignedData(der, detached []byte) (*signedData, error) {
+	info, err := asn1Elements(der)
+	if err != nil || len(info) != 2 || info[1].Class != asn1.ClassContextSpecific {
+		return nil, errors.New("malformed content info")
+	}
+	var contentType asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(info[0].FullBytes, &contentType); err != nil || !contentType.Equal(oidSignedData) {
+		return nil, errors.New("not a PKCS#7 signed data structure")
+	}
+	fields, err := asn1Elements(info[1].Bytes)
+	if err != nil || len(fields) < 4 {
+		return nil, errors.New("malformed signed data")
+	}
+	sd := &signedData{Unsigned: make(map[string][]byte)}
+
+	// Encapsulated content: its type and the explicitly tagged content, unless
+	// the signature is detached
+	encap, err := asn1Children(fields[2].Bytes)
+	if err != nil || len(encap) == 0 || len(encap) > 2 {
+		return nil, errors.New("malformed encapsulated content")
+	}
+	if _, err := asn1.Unmarshal(encap[0].FullBytes, &sd.ContentType); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(encap) == 2:
+		var content asn1.RawValue
+		if _, err := asn1.Unmarshal(encap[1].Bytes, &content); err != nil {
+			return nil, err
+		}
+		sd.Content = content.Bytes
+	case detached != nil:
+		sd.Content = detached
+	default:
+		return nil, errors.New("detached signature without content")
+	}
+
+	// Certificates are optional and implicitly tagged [0]
+	var certs []*x509.Certificate
+	for _, field := range fields[3 : len(fields)-1] {
+		if field.Class == asn1.ClassContextSpecific && field.Tag == 0 {
+			if certs, err = x509.ParseCertificates(field.Bytes); err != nil {
+				return nil, fmt.Errorf("invalid certificates: %w", err)
+			}
+		}
+	}
+	signers, err := asn1Children(fields[len(fields)-1].Bytes)
+	if err != nil || len(signers) != 1 {
+		return nil, errors.New("expected exactly one signer")
+	}
+	si, err := asn1Children(signers[0].Bytes)
+	if err != nil || len(si) < 6 {
+		return nil, errors.New("malformed signer info")
+	}
+	var sid struct {
+		Issuer asn1.RawValue
+		Serial *big.Int
+	}
+	if _, err := asn1.Unmarshal(si[1].FullBytes, &sid); err != nil {
+		return nil, fmt.Errorf("unsupported signer identifier: %w", err)
+	}
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, sid.Issuer.FullBytes) && cert.SerialNumber.Cmp(sid.Serial) == 0 {
+			sd.Signer = cert
+		}
+	}
+	if sd.Signer == nil {
+		return nil, errors.New("signing certificate not included")
+	}
+	var digestAlgorithm pkix.AlgorithmIdentifier
+	if _, err := asn1.Unmarshal(si[2].FullBytes, &digestAlgorithm); err != nil {
+		return nil, err
+	}
+	hash, ok := digestAlgorithms[digestAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %v", digestAlgorithm.Algorithm)
+	}
+	rest := si[3:]
+	if rest[0].Class != asn1.ClassContextSpecific || rest[0].Tag != 0 {
+		return nil, errors.New("signed attributes missing")
+	}
+	signedAttrs := rest[0]
+	var encryption pkix.AlgorithmIdentifier
+	if _, err := asn1.Unmarshal(rest[1].FullBytes, &encryption); err != nil {
+		return nil, err
+	}
+	if _, err := asn1.Unmarshal(rest[2].FullBytes, &sd.Signature); err != nil {
+		return nil, err
+	}
+	if len(rest) > 3 && rest[3].Class == asn1.ClassContextSpecific && rest[3].Tag == 1 {
+		attrs, err := parseAttributes(rest[3].Bytes)
+		if err != nil {
+			return nil, err
+		}
+		sd.Unsigned = attrs
+	}
+	// The message digest attribute must match the content
+	attrs, err := parseAttributes(signedAttrs.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	var digest []byte
+	if _, err := asn1.Unmarshal(attrs[oidMessageDigest.String()], &digest); err != nil {
+		return nil, errors.New("message digest attribute missing")
+	}
+	h := hash.New()
+	h.Write(sd.Content)
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return nil, errors.New("message digest doesn't match the signed content")
+	}
+	// The signature covers the signed attributes encoded as a SET
+	set := append([]byte{}, signedAttrs.FullBytes...)
+	set[0] = 0x31
+	algorithm, err := signatureAlgorithm(hash, encryption.Algorithm, sd.Signer)
+	if err != nil {
+		return nil, err
+	}
+	if err := sd.Signer.CheckSignature(algorithm, set, sd.Signature); err != nil {
+		return nil, fmt.Errorf("signature verification failed: %w", err)
+	}
+	return sd, nil
+}
+
+// parseAttributes returns the first value of each attribute in a SET OF
+// attributes.
+func parseAttributes(b []byte) (map[string][]byte, error) {
+	children, err := asn1Children(b)
+	if err != nil {
+		return nil, fmt.Errorf("malformed attributes: %w", err)
+	}
+	attrs := make(map[string][]byte)
+	for _, child := range children {
+		var attr struct {
+			Type   asn1.ObjectIdentifier
+			Values asn1.RawValue
+		}
+		if _, err := asn1.Unmarshal(child.FullBytes, &attr); err != nil {
+			return nil, fmt.Errorf("malformed attribute: %w", err)
+		}
+		values, err := asn1Children(attr.Values.Bytes)
+		if err != nil || len(values) == 0 {
+			return nil, fmt.Errorf("attribute %v has no value", attr.Type)
+		}
+		attrs[attr.Type.String()] = values[0].FullBytes
+	}
+	return attrs, nil
+}
+
+// signatureAlgorithm maps the digest and signature algorithm of a signer info
+// to the x509 signature algorithm to verify it with.
+func signatureAlgorithm(hash crypto.Hash, encryption asn1.ObjectIdentifier, cert *x509.Certificate) (x509.SignatureAlgorithm, error) {
+	rsaAlgorithms := map[crypto.Hash]x509.SignatureAlgorithm{crypto.SHA256: x509.SHA256WithRSA, crypto.SHA384: x509.SHA384WithRSA, crypto.SHA512: x509.SHA512WithRSA}
+	ecdsaAlgorithms := map[crypto.Hash]x509.SignatureAlgorithm{crypto.SHA256: x509.ECDSAWithSHA256, crypto.SHA384: x509.ECDSAWithSHA384, crypto.SHA512: x509.ECDSAWithSHA512}
+
+	switch {
+	case encryption.Equal(oidRSAEncryption), encryption.Equal(oidSHA256WithRSA), encryption.Equal(oidSHA384WithRSA), encryption.Equal(oidSHA512WithRSA):
+		return rsaAlgorithms[hash], nil
+	case encryption.Equal(oidECPublicKey), encryption.Equal(oidECDSAWithSHA256), encryption.Equal(oidECDSAWithSHA384), encryption.Equal(oidECDSAWithSHA512):
+		return ecdsaAlgorithms[hash], nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm %v for %v key", encryption, cert.PublicKeyAlgorithm)
+}
+
+// checkTimestamp verifies that a timestamp token stamps the given signature,
+// returning the time it attests.
+func checkTimestamp(stamp *signedData, signature []byte) (time.Time, error) {
+	if !stamp.ContentType.Equal(oidTSTInfo) {
+		return time.Time{}, errors.New("timestamp token holds no TSTInfo")
+	}
+	var info struct {
+		Version        int
+		Policy         asn1.ObjectIdentifier
+		MessageImprint struct {
+			Algorithm pkix.AlgorithmIdentifier
+			Digest    []byte
+		}
+		Serial  *big.Int
+		GenTime time.Time `asn1:"generalized"`
+	}
+	if _, err := asn1.Unmarshal(stamp.Content, &info); err != nil {
+		return time.Time{}, fmt.Errorf("malformed TSTInfo: %w", err)
+	}
+	hash, ok := digestAlgorithms[info.MessageImprint.Algorithm.Algorithm.String()]
+	if !ok {
+		return time.Time{}, fmt.Errorf("unsupported timestamp digest algorithm %v", info.MessageImprint.Algorithm.Algorithm)
+	}
+	h := hash.New()
+	h.Write(signature)
+	if !bytes.Equal(h.Sum(nil), info.MessageImprint.Digest) {
+		return time.Time{}, errors.New("timestamp doesn't match the signature")
+	}
+	return info.GenTime, nil
+}
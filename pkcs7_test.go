@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+// Tests that a signer info lacking its signature is rejected rather than read
+// past its end.
+func TestParseSignedDataTruncatedSigner(t *testing.T) {
+	cert := newTestSigner(t, "xgo test signer").Chain[0]
+
+	attrs, _ := attribute(oidContentType, mustMarshal(t, oidData))
+	signerInfo := mustMarshal(t, struct {
+		Version         int
+		IssuerAndSerial struct {
+			Issuer asn1.RawValue
+			Serial *big.Int
+		}
+		DigestAlgorithm     asn1.RawValue
+		SignedAttributes    asn1.RawValue
+		EncryptionAlgorithm asn1.RawValue
+	}{
+		Version: 1,
+		IssuerAndSerial: struct {
+			Issuer asn1.RawValue
+			Serial *big.Int
+		}{asn1.RawValue{FullBytes: cert.RawIssuer}, cert.SerialNumber},
+		DigestAlgorithm:     asn1.RawValue{FullBytes: mustMarshal(t, struct{ Algorithm asn1.ObjectIdentifier }{oidSHA256})},
+		SignedAttributes:    asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+		EncryptionAlgorithm: asn1.RawValue{FullBytes: mustMarshal(t, struct{ Algorithm asn1.ObjectIdentifier }{oidECDSAWithSHA256})},
+	})
+	signedData := mustMarshal(t, struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      struct {
+			Type    asn1.ObjectIdentifier
+			Content asn1.RawValue
+		}
+		Certificates asn1.RawValue
+		SignerInfos  asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true},
+		ContentInfo: struct {
+			Type    asn1.ObjectIdentifier
+			Content asn1.RawValue
+		}{oidData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: mustMarshal(t, []byte("content"))}},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos:  asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signerInfo},
+	})
+	der := mustMarshal(t, struct {
+		Type    asn1.ObjectIdentifier
+		Content asn1.RawValue
+	}{oidSignedData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData}})
+
+	if _, err := parseSignedData(der, nil); err == nil {
+		t.Errorf("signer info without signature accepted")
+	}
+}
+
+// mustMarshal DER encodes a value, failing the test on error.
+func mustMarshal(t *testing.T, value any) []byte {
+	t.Helper()
+
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
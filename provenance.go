@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// provenanceFile is the name of the provenance attestation written to the
+// output folder.
+const provenanceFile = "xgo-provenance.intoto.jsonl"
+
+// provenanceBuildType identifies how to interpret the parameters of xgo builds.
+const provenanceBuildType = "https://src.techknowlogick.com/xgo/provenance/v1"
+
+// inTotoStatement is an in-toto v1 statement carrying a SLSA v1 provenance
+// predicate, see https://slsa.dev/spec/v1.0/provenance.
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition slsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      slsaRunDetails      `json:"runDetails"`
+}
+
+type slsaBuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   provenanceParameters `json:"externalParameters"`
+	ResolvedDependencies []slsaDescriptor     `json:"resolvedDependencies"`
+}
+
+type slsaDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type slsaRunDetails struct {
+	Builder  slsaBuilder  `json:"builder"`
+	Metadata slsaMetadata `json:"metadata"`
+}
+
+type slsaBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type slsaMetadata struct {
+	StartedOn  string `json:"startedOn"`
+	FinishedOn string `json:"finishedOn"`
+}
+
+// provenanceParameters are the invocation parameters recorded in the
+// provenance, those shaping the outputs under stable names. Only the names of
+// environment variables are recorded, as their values may well hold secrets.
+// Host specific settings (container arguments, volumes, certificate paths and
+// publishing destinations) are left out.
+type provenanceParameters struct {
+	Repository      string               `json:"repository"`
+	Packages        []string             `json:"packages,omitempty"`
+	Remote          string               `json:"remote,omitempty"`
+	Branch          string               `json:"branch,omitempty"`
+	Targets         []string             `json:"targets,omitempty"`
+	OutPrefix       string               `json:"outPrefix,omitempty"`
+	OutTemplate     string               `json:"outTemplate,omitempty"`
+	Dependencies    []string             `json:"dependencies,omitempty"`
+	DepsArgs        string               `json:"depsArgs,omitempty"`
+	Env             []string             `json:"env,omitempty"`
+	EnvPass         []string             `json:"envPass,omitempty"`
+	EnvSkip         []string             `json:"envSkip,omitempty"`
+	TargetOverrides []provenanceOverride `json:"targetOverrides,omitempty"`
+	BuildMode       string               `json:"buildMode,omitempty"`
+	Tags            string               `json:"tags,omitempty"`
+	LdFlags         string               `json:"ldflags,omitempty"`
+	GcFlags         string               `json:"gcflags,omitempty"`
+	Race            bool                 `json:"race"`
+	Trimpath        bool                 `json:"trimpath"`
+	BuildVCS        bool                 `json:"buildvcs"`
+	Obfuscate       bool                 `json:"obfuscate"`
+	GarbleFlags     string               `json:"garbleFlags,omitempty"`
+	Reproducible    bool                 `json:"reproducible"`
+	SourceDateEpoch int64                `json:"sourceDateEpoch,omitempty"`
+	Universal       bool                 `json:"universalDarwin"`
+	MaxGlibc        string               `json:"maxGlibc,omitempty"`
+	SBOM            string               `json:"sbom,omitempty"`
+	SignWindows     bool                 `json:"signWindows"`
+	SignDarwin      string               `json:"signDarwin,omitempty"` // adhoc or certificate
+	TimestampURL    string               `json:"timestampUrl,omitempty"`
+	PackageTypes    []string             `json:"packageTypes,omitempty"`
+}
+
+// provenanceOverride is a per-target override recorded in the provenance.
+type provenanceOverride struct {
+	Match   string   `json:"match"`
+	Env     []string `json:"env,omitempty"` // Variable names only
+	Tags    string   `json:"tags,omitempty"`
+	LdFlags string   `json:"ldflags,omitempty"`
+	GcFlags string   `json:"gcflags,omitempty"`
+}
+
+// newProvenanceParameters collects the recorded invocation parameters. It must
+// be called before compile, which rewrites the repository and packages of local
+// module builds to host paths.
+func newProvenanceParameters(config *ConfigFlags, flags *BuildFlags) provenanceParameters {
+	params := provenanceParameters{
+		Repository:      config.Repository,
+		Packages:        append([]string(nil), config.Packages...),
+		Remote:          config.Remote,
+		Branch:          config.Branch,
+		Targets:         nonEmpty(config.Targets),
+		OutPrefix:       config.Prefix,
+		OutTemplate:     config.Template,
+		Dependencies:    strings.Fields(config.Dependencies),
+		DepsArgs:        config.Arguments,
+		EnvPass:         nonEmpty(config.EnvPass),
+		EnvSkip:         nonEmpty(config.EnvSkip),
+		BuildMode:       flags.Mode,
+		Tags:            flags.Tags,
+		LdFlags:         flags.LdFlags,
+		GcFlags:         flags.GcFlags,
+		Race:            flags.Race,
+		Trimpath:        flags.Trimpath,
+		BuildVCS:        flags.BuildVCS,
+		Obfuscate:       flags.Obfuscate,
+		GarbleFlags:     flags.GarbleFlags,
+		Reproducible:    flags.Reproducible,
+		SourceDateEpoch: flags.SourceDateEpoch,
+		Universal:       config.Universal,
+		MaxGlibc:        config.MaxGlibc,
+		SBOM:            config.SBOM,
+		SignWindows:     config.SignWindows != "",
+		TimestampURL:    config.TimestampURL,
+		PackageTypes:    nonEmpty(config.PackageTypes),
+	}
+	for _, kv := range config.DockerEnv {
+		if name, _, _ := strings.Cut(kv, "="); name != "" {
+			params.Env = append(params.Env, name)
+		}
+	}
+	for _, override := range config.Overrides {
+		recorded := provenanceOverride{Match: override.Match, Tags: override.Tags, LdFlags: override.LdFlags, GcFlags: override.GcFlags}
+		for name := range override.Env {
+			recorded.Env = append(recorded.Env, name)
+		}
+		sort.Strings(recorded.Env)
+		params.TargetOverrides = append(params.TargetOverrides, recorded)
+	}
+	switch config.SignDarwin {
+	case "":
+	case adhocSigning:
+		params.SignDarwin = adhocSigning
+	default:
+		params.SignDarwin = "certificate"
+	}
+	return params
+}
+
+// nonEmpty drops the empty entries of a comma separated flag.
+func nonEmpty(values []string) []string {
+	var result []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// dsseEnvelope is a Dead Simple Signing Envelope wrapping the statement, see
+// https://github.com/secure-systems-lab/dsse.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid,omitempty"`
+	Sig   string `json:"sig"`
+}
+
+// loadSigningKey reads a PEM encoded Ed25519, ECDSA or RSA private key.
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in signing key %s", path)
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", path, err)
+	}
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing key algorithm %T in %s", key, path)
+	}
+}
+
+// newProvenance assembles the provenance statement of a finished build.
+func newProvenance(folder string, artifacts []Artifact, params provenanceParameters, config *ConfigFlags, git gitInfo, image string, started time.Time) (*inTotoStatement, error) {
+	statement := &inTotoStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		PredicateType: "https://slsa.dev/provenance/v1",
+	}
+	for _, artifact := range artifacts {
+		sum, err := fileSHA256(artifact.Path)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(folder, artifact.Path)
+		if err != nil {
+			return nil, err
+		}
+		statement.Subject = append(statement.Subject, inTotoSubject{Name: filepath.ToSlash(rel), Digest: map[string]string{"sha256": sum}})
+	}
+	definition := slsaBuildDefinition{
+		BuildType:          provenanceBuildType,
+		ExternalParameters: params,
+	}
+	// Resolve the sources, the build image and the C dependencies. Local
+	// checkouts without a remote are only identified by their commit, as their
+	// path is meaningless on any other host.
+	source := slsaDescriptor{Name: "source"}
+	if !isLocalRepository(params.Repository) {
+		source.URI = params.Repository
+	}
+	switch {
+	case git.Commit != "":
+		source.URI = ""
+		if git.Remote != "" {
+			source.URI = "git+" + git.Remote + "@" + git.Commit
+		}
+		source.Digest = map[string]string{"gitCommit": git.Commit}
+	case config.Remote != "":
+		source.URI = "git+" + config.Remote
+		if config.Branch != "" {
+			source.URI += "@refs/heads/" + config.Branch
+		}
+	}
+	definition.ResolvedDependencies = append(definition.ResolvedDependencies, source)
+
+	if repo, digest, ok := strings.Cut(image, "@"); ok {
+		algo, hash, _ := strings.Cut(digest, ":")
+		definition.ResolvedDependencies = append(definition.ResolvedDependencies, slsaDescriptor{
+			Name:   "image",
+			URI:    "oci://" + repo,
+			Digest: map[string]string{algo: hash},
+		})
+	}
+	deps, err := cDependencies(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash C dependencies: %w", err)
+	}
+	for _, dep := range deps {
+		definition.ResolvedDependencies = append(definition.ResolvedDependencies, slsaDescriptor{
+			Name:   dep.Name,
+			URI:    dep.URL,
+			Digest: map[string]string{"sha256": dep.SHA256},
+		})
+	}
+	statement.Predicate = slsaProvenance{
+		BuildDefinition: definition,
+		RunDetails: slsaRunDetails{
+			Builder: slsaBuilder{
+				ID:      "https://src.techknowlogick.com/xgo",
+				Version: map[string]string{"xgo": xgoVersion()},
+			},
+			Metadata: slsaMetadata{
+				StartedOn:  started.UTC().Format(time.RFC3339),
+				FinishedOn: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	}
+	return statement, nil
+}
+
+// writeProvenance wraps the statement into a DSSE envelope, signed if a key is
+// given, and writes it to the output folder as a single JSON line.
+func writeProvenance(folder string, statement *inTotoStatement, key crypto.Signer) error {
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return err
+	}
+	envelope := dsseEnvelope{
+		PayloadType: "application/vnd.in-toto+json",
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []dsseSignature{},
+	}
+	if key != nil {
+		signature, err := signDSSE(key, envelope.PayloadType, payload)
+		if err != nil {
+			return fmt.Errorf("failed to sign provenance: %w", err)
+		}
+		envelope.Signatures = append(envelope.Signatures, signature)
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(folder, provenanceFile), append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write provenance: %w", err)
+	}
+	return nil
+}
+
+// signDSSE signs the pre-authentication encoding of a DSSE payload. The key ID
+// is the hex encoded SHA-256 of the PKIX encoded public key.
+func signDSSE(key crypto.Signer, payloadType string, payload []byte) (dsseSignature, error) {
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+
+	var (
+		sig []byte
+		err error
+	)
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, []byte(pae), crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256([]byte(pae))
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return dsseSignature{}, err
+	}
+	public, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return dsseSignature{}, err
+	}
+	keyID := sha256.Sum256(public)
+	return dsseSignature{KeyID: hex.EncodeToString(keyID[:]), Sig: base64.StdEncoding.EncodeToString(sig)}, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/distribution/reference"
+	registrytypes "github.com/moby/moby/api/types/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// registryClient uploads content to a repository of an OCI distribution
+// registry, authenticating with the credentials docker would use for it.
+type registryClient struct {
+	base  *url.URL                 // Registry API endpoint (scheme and host)
+	repo  string                   // Repository path within the registry
+	tag   string                   // Tag the reference names, latest if none
+	auth  registrytypes.AuthConfig // Docker credentials for the registry
+	token string                   // Bearer token handed out by the registry
+	basic bool                     // Whether the registry asked for basic auth
+}
+
+// newRegistryClient creates a client for the repository of an image reference
+// (e.g. ghcr.io/org/app:v1), loading the credentials from the docker config.
+func newRegistryClient(ref string) (*registryClient, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %s: %w", ref, err)
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return nil, fmt.Errorf("image reference %s must name a tag, not a digest", ref)
+	}
+	tag := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	auth, err := registryAuthConfigForImage(ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load registry credentials: %w", err)
+	}
+	host := reference.Domain(named)
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	// Registries on the local machine are commonly served without TLS
+	scheme := "https"
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if ip := net.ParseIP(hostname); hostname == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+	return &registryClient{
+		base: &url.URL{Scheme: scheme, Host: host},
+		repo: reference.Path(named),
+		tag:  tag,
+		auth: auth,
+	}, nil
+}
+
+// endpoint returns the URL of an API path within the repository.
+func (c *registryClient) endpoint(path string) string {
+	return c.base.JoinPath("v2", c.repo, path).String()
+}
+
+// do sends a request to the registry, authenticating and retrying once if the
+// registry challenges it.
+func (c *registryClient) do(ctx context.Context, method, target string, header http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, target, reader)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		switch {
+		case c.token != "":
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		case c.auth.RegistryToken != "":
+			req.Header.Set("Authorization", "Bearer "+c.auth.RegistryToken)
+		case c.basic:
+			req.SetBasicAuth(c.auth.Username, c.auth.Password)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return res, nil
+		}
+		challenge := res.Header.Get("WWW-Authenticate")
+		res.Body.Close()
+
+		if err := c.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate answers an authentication challenge of the registry, either by
+// switching to basic auth or by fetching a bearer token for the requested scope.
+func (c *registryClient) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.auth.Username == "" {
+			return fmt.Errorf("registry %s requires credentials, log in with docker login", c.base.Host)
+		}
+		c.basic = true
+		return nil
+
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return fmt.Errorf("registry %s sent an invalid token realm %q", c.base.Host, params["realm"])
+		}
+		scope := params["scope"]
+		if scope == "" {
+			scope = "repository:" + c.repo + ":pull,push"
+		}
+		var req *http.Request
+		if c.auth.IdentityToken != "" {
+			// Identity tokens are OAuth2 refresh tokens exchanged for access
+			form := url.Values{
+				"grant_type":    {"refresh_token"},
+				"refresh_token": {c.auth.IdentityToken},
+				"service":       {params["service"]},
+				"scope":         {scope},
+				"client_id":     {"xgo"},
+			}
+			if req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm.String(), strings.NewReader(form.Encode())); err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			query := realm.Query()
+			if params["service"] != "" {
+				query.Set("service", params["service"])
+			}
+			query.Set("scope", scope)
+			realm.RawQuery = query.Encode()
+
+			if req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil); err != nil {
+				return err
+			}
+			if c.auth.Username != "" {
+				req.SetBasicAuth(c.auth.Username, c.auth.Password)
+			}
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to request registry token: %w", err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to request registry token: %w", registryError(res))
+		}
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+			return fmt.Errorf("failed to decode registry token: %w", err)
+		}
+		if c.token = token.Token; c.token == "" {
+			c.token = token.AccessToken
+		}
+		if c.token == "" {
+			return fmt.Errorf("registry %s handed out an empty token", c.base.Host)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("registry %s denied access without a supported challenge (%q)", c.base.Host, challenge)
+	}
+}
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and the
+// parameters of the challenge, unquoting the values.
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			// Quoted values may contain commas (e.g. scope="...:pull,push")
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key], rest = value[1:end+1], value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), ","))
+	}
+	return scheme, params
+}
+
+// pushBlob uploads a blob to the repository, unless the registry already has it.
+func (c *registryClient) pushBlob(ctx context.Context, desc ocispec.Descriptor, data []byte) error {
+	res, err := c.do(ctx, http.MethodHead, c.endpoint("blobs/"+desc.Digest.String()), nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	// Start an upload session and complete it in a single request
+	if res, err = c.do(ctx, http.MethodPost, c.endpoint("blobs/uploads/"), nil, nil); err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to start upload of %s: %w", desc.Digest, registryError(res))
+	}
+	location, err := c.base.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("registry sent an invalid upload location: %w", err)
+	}
+	query := location.Query()
+	query.Set("digest", desc.Digest.String())
+	location.RawQuery = query.Encode()
+
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if res, err = c.do(ctx, http.MethodPut, location.String(), header, data); err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to upload %s: %w", desc.Digest, registryError(res))
+	}
+	return nil
+}
+
+// pushManifest uploads a manifest to the repository under the given tag or digest.
+func (c *registryClient) pushManifest(ctx context.Context, ref string, desc ocispec.Descriptor, data []byte) error {
+	header := http.Header{"Content-Type": {desc.MediaType}}
+	res, err := c.do(ctx, http.MethodPut, c.endpoint("manifests/"+ref), header, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to upload manifest %s: %w", ref, registryError(res))
+	}
+	return nil
+}
+
+// registryError converts a failed registry response into an error, using the
+// message of the error body if the registry sent one.
+func registryError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+
+	var errs struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &errs) == nil && len(errs.Errors) > 0 {
+		return fmt.Errorf("%s: %s", res.Status, errs.Errors[0].Message)
+	}
+	return fmt.Errorf("%s", res.Status)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	registrytypes "github.com/moby/moby/api/types/registry"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testRegistry is an in-memory stand-in for a registry:2 style distribution
+// registry serving a single repository, challenging every unauthenticated
+// request for basic auth or a bearer token.
+type testRegistry struct {
+	*httptest.Server
+
+	repo   string // Repository the registry serves
+	bearer bool   // Whether to hand out bearer tokens instead of basic auth
+
+	lock      sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[string][]byte
+	types     map[string]string // Content type of every manifest
+	uploads   []digest.Digest   // Blobs uploaded, in order
+	scopes    []string          // Scopes tokens were requested for
+}
+
+// Credentials and token the test registry accepts.
+const (
+	testRegistryUser  = "xgo"
+	testRegistryPass  = "secret"
+	testRegistryToken = "token-for-xgo"
+)
+
+// newTestRegistry starts a registry serving the given repository.
+func newTestRegistry(t *testing.T, repo string, bearer bool) *testRegistry {
+	t.Helper()
+
+	r := &testRegistry{
+		repo:      repo,
+		bearer:    bearer,
+		blobs:     make(map[digest.Digest][]byte),
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// client returns a registry client for the repository, tagging as given.
+func (r *testRegistry) client(t *testing.T, tag string) *registryClient {
+	t.Helper()
+
+	base, err := url.Parse(r.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &registryClient{
+		base: base,
+		repo: r.repo,
+		tag:  tag,
+		auth: registrytypes.AuthConfig{Username: testRegistryUser, Password: testRegistryPass},
+	}
+}
+
+// serve handles the token endpoint and the distribution API of the repository.
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if req.URL.Path == "/token" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != testRegistryUser || pass != testRegistryPass {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		r.scopes = append(r.scopes, req.URL.Query().Get("scope"))
+		json.NewEncoder(w).Encode(map[string]string{"token": testRegistryToken})
+		return
+	}
+	if !r.authorized(req) {
+		if r.bearer {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:pull,push"`, r.URL, r.repo))
+		} else {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path, ok := strings.CutPrefix(req.URL.Path, "/v2/"+r.repo+"/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Method == http.MethodHead && strings.HasPrefix(path, "blobs/sha256:"):
+		if _, ok := r.blobs[digest.Digest(strings.TrimPrefix(path, "blobs/"))]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case req.Method == http.MethodPost && path == "blobs/uploads/":
+		// Relative location with a query of its own, as registry:2 sends it
+		w.Header().Set("Location", "/v2/"+r.repo+"/blobs/uploads/session?_state=opaque")
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodPut && path == "blobs/uploads/session":
+		dgst := digest.Digest(req.URL.Query().Get("digest"))
+		if req.URL.Query().Get("_state") != "opaque" || dgst != digest.FromBytes(body) {
+			http.Error(w, `{"errors":[{"code":"DIGEST_INVALID","message":"digest mismatch"}]}`, http.StatusBadRequest)
+			return
+		}
+		r.blobs[dgst] = body
+		r.uploads = append(r.uploads, dgst)
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodPut && strings.HasPrefix(path, "manifests/"):
+		ref := strings.TrimPrefix(path, "manifests/")
+		r.manifests[ref] = body
+		r.types[ref] = req.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// authorized reports whether a request carries the credentials or token the
+// registry hands out.
+func (r *testRegistry) authorized(req *http.Request) bool {
+	if r.bearer {
+		return req.Header.Get("Authorization") == "Bearer "+testRegistryToken
+	}
+	user, pass, ok := req.BasicAuth()
+	return ok && user == testRegistryUser && pass == testRegistryPass
+}
+
+// Tests that build outputs are pushed as an annotated OCI artifact manifest,
+// authenticating with basic auth or a bearer token and skipping stored blobs.
+func TestPushArtifacts(t *testing.T) {
+	for _, bearer := range []bool{false, true} {
+		t.Run(fmt.Sprintf("bearer=%v", bearer), func(t *testing.T) {
+			registry := newTestRegistry(t, "org/app", bearer)
+
+			folder := t.TempDir()
+			outputs := map[string]string{
+				"app-linux-amd64":      "linux binary",
+				"app-linux-musl-arm64": "musl binary",
+			}
+			for name, content := range outputs {
+				if err := os.WriteFile(filepath.Join(folder, name), []byte(content), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			linux, _ := lookupTarget("linux", "amd64")
+			musl, _ := lookupTarget("linux-musl", "arm64")
+			artifacts := []Artifact{
+				{Target: linux, Package: "cmd/app", Path: filepath.Join(folder, "app-linux-amd64")},
+				{Target: musl, Path: filepath.Join(folder, "app-linux-musl-arm64")},
+			}
+			// The registry already has the first output, which must not be uploaded again
+			existing := digest.FromString(outputs["app-linux-amd64"])
+			registry.blobs[existing] = []byte(outputs["app-linux-amd64"])
+
+			var (
+				git   = gitInfo{Commit: "0123456789abcdef", Remote: "https://example.com/org/app.git"}
+				flags = &BuildFlags{SourceDateEpoch: 1700000000}
+			)
+			if err := pushArtifacts(context.Background(), folder, registry.client(t, "v1"), artifacts, git, flags); err != nil {
+				t.Fatalf("failed to push artifacts: %v", err)
+			}
+			// Only the missing output and the empty config may have been uploaded
+			want := []digest.Digest{digest.FromString(outputs["app-linux-musl-arm64"]), ocispec.DescriptorEmptyJSON.Digest}
+			if fmt.Sprint(registry.uploads) != fmt.Sprint(want) {
+				t.Errorf("uploads mismatch: have %v, want %v", registry.uploads, want)
+			}
+			if bearer && (len(registry.scopes) == 0 || registry.scopes[0] != "repository:org/app:pull,push") {
+				t.Errorf("token scopes mismatch: have %v", registry.scopes)
+			}
+			if registry.types["v1"] != ocispec.MediaTypeImageManifest {
+				t.Fatalf("manifest content type mismatch: have %q, want %q", registry.types["v1"], ocispec.MediaTypeImageManifest)
+			}
+			var manifest ocispec.Manifest
+			if err := json.Unmarshal(registry.manifests["v1"], &manifest); err != nil {
+				t.Fatalf("failed to decode manifest: %v", err)
+			}
+			if manifest.ArtifactType != artifactsType {
+				t.Errorf("artifact type mismatch: have %q, want %q", manifest.ArtifactType, artifactsType)
+			}
+			if manifest.Config.Digest != ocispec.DescriptorEmptyJSON.Digest {
+				t.Errorf("config mismatch: have %s, want the empty descriptor", manifest.Config.Digest)
+			}
+			for key, value := range map[string]string{
+				ocispec.AnnotationCreated:  time.Unix(1700000000, 0).UTC().Format(time.RFC3339),
+				ocispec.AnnotationRevision: git.Commit,
+				ocispec.AnnotationSource:   git.Remote,
+			} {
+				if manifest.Annotations[key] != value {
+					t.Errorf("annotation %s mismatch: have %q, want %q", key, manifest.Annotations[key], value)
+				}
+			}
+			if len(manifest.Layers) != 2 {
+				t.Fatalf("layer count mismatch: have %d, want 2", len(manifest.Layers))
+			}
+			for i, layer := range []map[string]string{
+				{ocispec.AnnotationTitle: "app-linux-amd64", annotationOS: "linux", annotationArch: "amd64", annotationPackage: "cmd/app"},
+				{ocispec.AnnotationTitle: "app-linux-musl-arm64", annotationOS: "linux", annotationArch: "arm64", annotationLibc: "musl"},
+			} {
+				desc := manifest.Layers[i]
+				if fmt.Sprint(desc.Annotations) != fmt.Sprint(layer) {
+					t.Errorf("layer %d annotations mismatch: have %v, want %v", i, desc.Annotations, layer)
+				}
+				if content := outputs[layer[ocispec.AnnotationTitle]]; desc.Digest != digest.FromString(content) || desc.Size != int64(len(content)) {
+					t.Errorf("layer %d descriptor mismatch: have %s (%d bytes)", i, desc.Digest, desc.Size)
+				}
+				if desc.MediaType != artifactMediaType || desc.Platform == nil || desc.Platform.Architecture != layer[annotationArch] {
+					t.Errorf("layer %d type or platform mismatch: have %s, %v", i, desc.MediaType, desc.Platform)
+				}
+			}
+		})
+	}
+}
+
+// Tests that registries rejecting the credentials fail the push.
+func TestPushArtifactsUnauthorized(t *testing.T) {
+	registry := newTestRegistry(t, "org/app", false)
+
+	client := registry.client(t, "v1")
+	client.auth.Password = "wrong"
+
+	err := client.pushBlob(context.Background(), ocispec.DescriptorEmptyJSON, ocispec.DescriptorEmptyJSON.Data)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("error mismatch: have %v, want an unauthorized failure", err)
+	}
+	if len(registry.uploads) != 0 {
+		t.Errorf("blobs uploaded without credentials: %v", registry.uploads)
+	}
+}
+
+// Tests the parsing of registry authentication challenges.
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{`Basic realm="Registry Realm"`, "Basic", map[string]string{"realm": "Registry Realm"}},
+		{
+			`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:org/app:pull,push"`,
+			"Bearer", map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:org/app:pull,push"},
+		},
+		{`Bearer realm=https://ghcr.io/token, service=ghcr.io`, "Bearer", map[string]string{"realm": "https://ghcr.io/token", "service": "ghcr.io"}},
+	}
+	for _, tt := range tests {
+		scheme, params := parseChallenge(tt.header)
+		if scheme != tt.scheme || fmt.Sprint(params) != fmt.Sprint(tt.params) {
+			t.Errorf("%s: have %s %v, want %s %v", tt.header, scheme, params, tt.scheme, tt.params)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// WindowsResources are the resources embedded into Windows executables and
+// libraries through generated .syso files.
+type WindowsResources struct {
+	Icon           string             `yaml:"icon"`           // .ico file to use as the application icon
+	Manifest       string             `yaml:"manifest"`       // Application manifest, generated if empty
+	ExecutionLevel string             `yaml:"executionLevel"` // requestedExecutionLevel of the generated manifest
+	LongPathAware  bool               `yaml:"longPathAware"`  // Opt into long paths in the generated manifest
+	Version        WindowsVersionInfo `yaml:"version"`        // VERSIONINFO strings and numbers
+}
+
+// WindowsVersionInfo is the content of the VERSIONINFO resource. The file and
+// product versions default to the git tag of the repository.
+type WindowsVersionInfo struct {
+	FileVersion      string `yaml:"fileVersion"`
+	ProductVersion   string `yaml:"productVersion"`
+	CompanyName      string `yaml:"companyName"`
+	ProductName      string `yaml:"productName"`
+	FileDescription  string `yaml:"fileDescription"`
+	LegalCopyright   string `yaml:"legalCopyright"`
+	OriginalFilename string `yaml:"originalFilename"`
+	InternalName     string `yaml:"internalName"`
+	Comments         string `yaml:"comments"`
+}
+
+// resourceMachines maps Go architectures to their COFF machine type and the
+// relocation type of image relative addresses.
+var resourceMachines = map[string]struct{ Machine, Reloc uint16 }{
+	"386":   {pe.IMAGE_FILE_MACHINE_I386, 0x0007},  // IMAGE_REL_I386_DIR32NB
+	"amd64": {pe.IMAGE_FILE_MACHINE_AMD64, 0x0003}, // IMAGE_REL_AMD64_ADDR32NB
+	"arm64": {pe.IMAGE_FILE_MACHINE_ARM64, 0x0002}, // IMAGE_REL_ARM64_ADDR32NB
+}
+
+// Resource types and the language all resources are tagged with.
+const (
+	rtIcon      = 3
+	rtGroupIcon = 14
+	rtVersion   = 16
+	rtManifest  = 24
+
+	resourceLanguage = 0x0409 // en-US
+	resourceCodePage = 0x04b0 // Unicode
+)
+
+// resource is a single entry of the resource tree.
+type resource struct {
+	Type uint16
+	ID   uint16
+	Data []byte
+}
+
+// resolve makes the file paths of the resources relative to dir.
+func (r *WindowsResources) resolve(dir string) {
+	for _, file := range []*string{&r.Icon, &r.Manifest} {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(dir, *file)
+		}
+	}
+}
+
+// writeResourceObjects generates a COFF object holding the resources for every
+// Windows architecture in each package folder, returning the created files. Go
+// links *_windows_<arch>.syso files into the matching builds automatically.
+func writeResourceObjects(res *WindowsResources, dirs []string, targets []Target, git gitInfo, mode string) ([]string, error) {
+	resources, err := res.build(git, mode)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		created []string
+		seen    = make(map[string]bool)
+	)
+	for _, target := range targets {
+		machine, ok := resourceMachines[target.GoArch]
+		if target.OS != "windows" || !ok || seen[target.GoArch] {
+			continue
+		}
+		seen[target.GoArch] = true
+
+		object := resourceObject(machine.Machine, machine.Reloc, resources)
+		for _, dir := range dirs {
+			path := filepath.Join(dir, "xgo_windows_"+target.GoArch+".syso")
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+			if err != nil {
+				removeFiles(created)
+				return nil, fmt.Errorf("failed to create resource object: %w", err)
+			}
+			_, err = file.Write(object)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			created = append(created, path)
+			if err != nil {
+				removeFiles(created)
+				return nil, fmt.Errorf("failed to write resource object %s: %w", path, err)
+			}
+		}
+	}
+	return created, nil
+}
+
+// removeFiles deletes the generated files, ignoring those already gone.
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Failed to remove %s: %v\n", path, err)
+		}
+	}
+}
+
+// build assembles the icon, version and manifest resources.
+func (r *WindowsResources) build(git gitInfo, mode string) ([]resource, error) {
+	switch r.ExecutionLevel {
+	case "", "asInvoker", "highestAvailable", "requireAdministrator":
+	default:
+		return nil, fmt.Errorf("invalid execution level %q, expected asInvoker, highestAvailable or requireAdministrator", r.ExecutionLevel)
+	}
+	var resources []resource
+	if r.Icon != "" {
+		icons, err := iconResources(r.Icon)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, icons...)
+	}
+	library := mode == "shared" || mode == "c-shared"
+
+	version, err := r.Version.resource(git, library)
+	if err != nil {
+		return nil, err
+	}
+	resources = append(resources, version)
+
+	manifest := []byte(defaultManifest(r.ExecutionLevel, r.LongPathAware))
+	if r.Manifest != "" {
+		if manifest, err = os.ReadFile(r.Manifest); err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %w", err)
+		}
+	}
+	// Executables load manifest 1, libraries manifest 2
+	id := uint16(1)
+	if library {
+		id = 2
+	}
+	resources = append(resources, resource{Type: rtManifest, ID: id, Data: manifest})
+	return resources, nil
+}
+
+// iconResources splits an .ico file into its images (RT_ICON) and the group
+// directory referencing them (RT_GROUP_ICON).
+func iconResources(path string) ([]resource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read icon: %w", err)
+	}
+	if len(data) < 6 || binary.LittleEndian.Uint16(data[0:]) != 0 || binary.LittleEndian.Uint16(data[2:]) != 1 {
+		return nil, fmt.Errorf("%s is not an .ico file", path)
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+	if count == 0 || len(data) < 6+16*count {
+		return nil, fmt.Errorf("%s holds no icon images", path)
+	}
+	group := binary.LittleEndian.AppendUint16(nil, 0)
+	group = binary.LittleEndian.AppendUint16(group, 1)
+	group = binary.LittleEndian.AppendUint16(group, uint16(count))
+
+	var resources []resource
+	for i := 0; i < count; i++ {
+		entry := data[6+16*i : 6+16*(i+1)]
+		size, offset := binary.LittleEndian.Uint32(entry[8:]), binary.LittleEndian.Uint32(entry[12:])
+		if uint64(offset)+uint64(size) > uint64(len(data)) {
+			return nil, fmt.Errorf("image %d of %s is truncated", i, path)
+		}
+		// The group entry is the directory entry with the file offset replaced
+		// by the ID of the RT_ICON resource
+		group = append(group, entry[:12]...)
+		group = binary.LittleEndian.AppendUint16(group, uint16(i+1))
+		resources = append(resources, resource{Type: rtIcon, ID: uint16(i + 1), Data: data[offset : offset+size]})
+	}
+	return append(resources, resource{Type: rtGroupIcon, ID: 1, Data: group}), nil
+}
+
+// defaultManifest generates an application manifest declaring the execution
+// level and long path awareness, along with support for every Windows release
+// since Vista.
+func defaultManifest(level string, longPaths bool) string {
+	if level == "" {
+		level = "asInvoker"
+	}
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<assembly xmlns="urn:schemas-microsoft-com:asm.v1" manifestVersion="1.0">
+  <trustInfo xmlns="urn:schemas-microsoft-com:asm.v3">
+    <security>
+      <requestedPrivileges>
+        <requestedExecutionLevel level="` + level + `" uiAccess="false"/>
+      </requestedPrivileges>
+    </security>
+  </trustInfo>
+  <compatibility xmlns="urn:schemas-microsoft-com:compatibility.v1">
+    <application>
+      <supportedOS Id="{e2011457-1546-43c5-a5fe-008deee3d3f0}"/>
+      <supportedOS Id="{35138b9a-5d96-4fbd-8e2d-a2440225f93a}"/>
+      <supportedOS Id="{4a2f28e3-53b9-4441-ba9c-d69d4a4a6e38}"/>
+      <supportedOS Id="{1f676c76-80e1-4239-95bb-83d0f6d0da78}"/>
+      <supportedOS Id="{8e0f7a12-bfb3-4fe8-b9a5-48fd50a15a9a}"/>
+    </application>
+  </compatibility>
+`)
+	if longPaths {
+		b.WriteString(`  <application xmlns="urn:schemas-microsoft-com:asm.v3">
+    <windowsSettings>
+      <longPathAware xmlns="http://schemas.microsoft.com/SMI/2016/WindowsSettings">true</longPathAware>
+    </windowsSettings>
+  </application>
+`)
+	}
+	b.WriteString("</assembly>\n")
+	return b.String()
+}
+
+// numericVersion extracts up to four numeric components from a version (e.g.
+// v1.2.3-rc.1 yields 1.2.3.0).
+var numericVersion = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:\.(\d+))?`)
+
+// parseFileVersion converts a version into the four 16 bit components of a
+// VERSIONINFO version number.
+func parseFileVersion(version string) ([4]uint16, error) {
+	var parts [4]uint16
+	match := numericVersion.FindStringSubmatch(version)
+	if match == nil {
+		return parts, fmt.Errorf("version %q doesn't start with a number", version)
+	}
+	for i, field := range match[1:] {
+		if field == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return parts, fmt.Errorf("version %q has components larger than 65535", version)
+		}
+		parts[i] = uint16(n)
+	}
+	return parts, nil
+}
+
+// resource encodes the VS_VERSIONINFO structure.
+func (v WindowsVersionInfo) resource(git gitInfo, library bool) (resource, error) {
+	fileVersion, productVersion := v.FileVersion, v.ProductVersion
+	if fileVersion == "" {
+		fileVersion = "0.0.0.0"
+		if git.Tag != "" {
+			fileVersion = git.Tag
+		}
+	}
+	if productVersion == "" {
+		productVersion = fileVersion
+		if git.Version != "" {
+			productVersion = git.Version
+		}
+	}
+	fileNumbers, err := parseFileVersion(fileVersion)
+	if err != nil {
+		return resource{}, fmt.Errorf("invalid file version: %w", err)
+	}
+	productNumbers, _ := parseFileVersion(productVersion)
+
+	// VS_FIXEDFILEINFO
+	fileType := uint32(1) // VFT_APP
+	if library {
+		fileType = 2 // VFT_DLL
+	}
+	fixed := binary.LittleEndian.AppendUint32(nil, 0xfeef04bd)
+	for _, field := range []uint32{
+		0x00010000,
+		uint32(fileNumbers[0])<<16 | uint32(fileNumbers[1]), uint32(fileNumbers[2])<<16 | uint32(fileNumbers[3]),
+		uint32(productNumbers[0])<<16 | uint32(productNumbers[1]), uint32(productNumbers[2])<<16 | uint32(productNumbers[3]),
+		0x3f, 0, 0x00040004, fileType, 0, 0, 0,
+	} {
+		fixed = binary.LittleEndian.AppendUint32(fixed, field)
+	}
+	strs := map[string]string{
+		"FileVersion":      fmt.Sprintf("%d.%d.%d.%d", fileNumbers[0], fileNumbers[1], fileNumbers[2], fileNumbers[3]),
+		"ProductVersion":   strings.TrimPrefix(productVersion, "v"),
+		"CompanyName":      v.CompanyName,
+		"ProductName":      v.ProductName,
+		"FileDescription":  v.FileDescription,
+		"LegalCopyright":   v.LegalCopyright,
+		"OriginalFilename": v.OriginalFilename,
+		"InternalName":     v.InternalName,
+		"Comments":         v.Comments,
+	}
+	keys := make([]string, 0, len(strs))
+	for key, value := range strs {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var entries [][]byte
+	for _, key := range keys {
+		value := utf16Bytes(strs[key])
+		entries = append(entries, versionNode(key, 1, value, uint16(len(value)/2)))
+	}
+	table := versionNode(fmt.Sprintf("%04x%04x", resourceLanguage, resourceCodePage), 1, nil, 0, entries...)
+	stringInfo := versionNode("StringFileInfo", 1, nil, 0, table)
+
+	translation := binary.LittleEndian.AppendUint16(nil, resourceLanguage)
+	translation = binary.LittleEndian.AppendUint16(translation, resourceCodePage)
+	varInfo := versionNode("VarFileInfo", 1, nil, 0, versionNode("Translation", 0, translation, uint16(len(translation))))
+
+	root := versionNode("VS_VERSION_INFO", 0, fixed, uint16(len(fixed)), stringInfo, varInfo)
+	return resource{Type: rtVersion, ID: 1, Data: root}, nil
+}
+
+// versionNode encodes a node of the version information tree: its length,
+// value length and type, the NUL terminated UTF-16 key, the value and the
+// children, each aligned to 32 bits.
+func versionNode(key string, kind uint16, value []byte, valueLength uint16, children ...[]byte) []byte {
+	node := make([]byte, 6)
+	node = append(node, utf16Bytes(key)...)
+	node = pad32(node)
+	node = append(node, value...)
+	for _, child := range children {
+		node = append(pad32(node), child...)
+	}
+	binary.LittleEndian.PutUint16(node[0:], uint16(len(node)))
+	binary.LittleEndian.PutUint16(node[2:], valueLength)
+	binary.LittleEndian.PutUint16(node[4:], kind)
+	return node
+}
+
+// utf16Bytes encodes a string as NUL terminated little endian UTF-16.
+func utf16Bytes(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s + "\x00")) {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+// pad32 pads b with zeros to a multiple of four bytes.
+func pad32(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// resourceObject lays the resources out as a .rsrc section (type, ID and
+// language directories, then the data entries, then the data) and wraps it in
+// a COFF object. The data entries hold image relative addresses, so each gets
+// a relocation against the section symbol.
+func resourceObject(machine, relocType uint16, resources []resource) []byte {
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].Type != resources[j].Type {
+			return resources[i].Type < resources[j].Type
+		}
+		return resources[i].ID < resources[j].ID
+	})
+	var types []uint16
+	ids := make(map[uint16][]resource)
+	for _, res := range resources {
+		if len(ids[res.Type]) == 0 {
+			types = append(types, res.Type)
+		}
+		ids[res.Type] = append(ids[res.Type], res)
+	}
+	const (
+		dirSize   = 16
+		entrySize = 8
+		dataSize  = 16
+	)
+	// Compute the offset of every directory, data entry and blob
+	typeDirs := dirSize + entrySize*len(types)
+	langDirs := typeDirs
+	for _, typ := range types {
+		langDirs += dirSize + entrySize*len(ids[typ])
+	}
+	dataEntries := langDirs + (dirSize+entrySize)*len(resources)
+	blobs := dataEntries + dataSize*len(resources)
+
+	directory := func(b []byte, count int) []byte {
+		b = append(b, make([]byte, 12)...)
+		b = binary.LittleEndian.AppendUint16(b, 0)
+		return binary.LittleEndian.AppendUint16(b, uint16(count))
+	}
+	entry := func(b []byte, id uint16, offset int, subdir bool) []byte {
+		b = binary.LittleEndian.AppendUint32(b, uint32(id))
+		if subdir {
+			offset |= 1 << 31
+		}
+		return binary.LittleEndian.AppendUint32(b, uint32(offset))
+	}
+	var section []byte
+
+	section = directory(section, len(types))
+	next := typeDirs
+	for _, typ := range types {
+		section = entry(section, typ, next, true)
+		next += dirSize + entrySize*len(ids[typ])
+	}
+	next = langDirs
+	for _, typ := range types {
+		section = directory(section, len(ids[typ]))
+		for _, res := range ids[typ] {
+			section = entry(section, res.ID, next, true)
+			next += dirSize + entrySize
+		}
+	}
+	for i := range resources {
+		section = directory(section, 1)
+		section = entry(section, resourceLanguage, dataEntries+dataSize*i, false)
+	}
+	var (
+		relocs []int
+		offset = blobs
+	)
+	for _, res := range resources {
+		relocs = append(relocs, len(section))
+		section = binary.LittleEndian.AppendUint32(section, uint32(offset))
+		section = binary.LittleEndian.AppendUint32(section, uint32(len(res.Data)))
+		section = binary.LittleEndian.AppendUint32(section, 0)
+		section = binary.LittleEndian.AppendUint32(section, 0)
+		offset += (len(res.Data) + 7) &^ 7
+	}
+	for _, res := range resources {
+		section = append(section, res.Data...)
+		for len(section)%8 != 0 {
+			section = append(section, 0)
+		}
+	}
+	// File header, section header, section data, relocations, symbol table
+	const (
+		headerSize  = 20
+		sectionSize = 40
+		relocSize   = 10
+	)
+	relocStart := headerSize + sectionSize + len(section)
+	symbolStart := relocStart + relocSize*len(relocs)
+
+	var obj bytes.Buffer
+	binary.Write(&obj, binary.LittleEndian, pe.FileHeader{
+		Machine:              machine,
+		NumberOfSections:     1,
+		PointerToSymbolTable: uint32(symbolStart),
+		NumberOfSymbols:      1,
+	})
+	binary.Write(&obj, binary.LittleEndian, pe.SectionHeader32{
+		Name:                 [8]uint8{'.', 'r', 's', 'r', 'c'},
+		SizeOfRawData:        uint32(len(section)),
+		PointerToRawData:     headerSize + sectionSize,
+		PointerToRelocations: uint32(relocStart),
+		NumberOfRelocations:  uint16(len(relocs)),
+		Characteristics:      pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ,
+	})
+	obj.Write(section)
+	for _, reloc := range relocs {
+		binary.Write(&obj, binary.LittleEndian, pe.Reloc{VirtualAddress: uint32(reloc), SymbolTableIndex: 0, Type: relocType})
+	}
+	binary.Write(&obj, binary.LittleEndian, pe.COFFSymbol{
+		Name:          [8]uint8{'.', 'r', 's', 'r', 'c'},
+		SectionNumber: 1,
+		StorageClass:  3, // IMAGE_SYM_CLASS_STATIC
+	})
+	binary.Write(&obj, binary.LittleEndian, uint32(4)) // Empty string table
+	return obj.Bytes()
+}
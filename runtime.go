@@ -19,6 +19,10 @@ type ContainerRuntime interface {
 	// PullImage pulls the given image reference from a registry, streaming
 	// progress to stdout.
 	PullImage(ctx context.Context, ref string) error
+	// ImageDigest resolves an available image reference to a content addressed
+	// one (repo@sha256:...), falling back to the local image ID if the image
+	// was never pulled from or pushed to a registry.
+	ImageDigest(ctx context.Context, ref string) (string, error)
 	// RunContainer creates, starts and waits for a container described by opts.
 	RunContainer(ctx context.Context, opts RunOptions) error
 	// Close releases any resources held by the runtime (e.g. HTTP connections).
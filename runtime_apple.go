@@ -18,6 +18,13 @@ type appleContainerSystemStatus struct {
 	Status string `json:"status"`
 }
 
+type appleContainerImageDetail struct {
+	Name  string `json:"name"`
+	Index struct {
+		Digest string `json:"digest"`
+	} `json:"index"`
+}
+
 func newAppleContainersCLIRuntime() (*AppleContainersCLIRuntime, error) {
 	path, err := exec.LookPath("container")
 	if err != nil {
@@ -68,6 +75,25 @@ func (a *AppleContainersCLIRuntime) PullImage(ctx context.Context, ref string) e
 	return cmd.Run()
 }
 
+func (a *AppleContainersCLIRuntime) ImageDigest(ctx context.Context, ref string) (string, error) {
+	out, err := exec.CommandContext(ctx, a.binary, "image", "inspect", ref).Output()
+	if err != nil {
+		return "", err
+	}
+	var details []appleContainerImageDetail
+	if err := json.Unmarshal(out, &details); err != nil {
+		return "", fmt.Errorf("parsing apple container image details: %w", err)
+	}
+	if len(details) == 0 || details[0].Index.Digest == "" {
+		return "", fmt.Errorf("no digest reported for image %s", ref)
+	}
+	name, _, _ := strings.Cut(details[0].Name, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name + "@" + details[0].Index.Digest, nil
+}
+
 func (a *AppleContainersCLIRuntime) RunContainer(ctx context.Context, opts RunOptions) error {
 	args := []string{"run", "--rm"}
 
@@ -78,29 +78,62 @@ func (d *DockerAPIRuntime) PullImage(ctx context.Context, ref string) error {
 	return jsonmessage.DisplayJSONMessagesStream(resp, os.Stdout, fd, isTerminal, nil)
 }
 
+func (d *DockerAPIRuntime) ImageDigest(ctx context.Context, ref string) (string, error) {
+	result, err := d.cli.ImageInspect(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	// Prefer the digest of the repository the reference points to
+	if named, err := reference.ParseNormalizedNamed(ref); err == nil {
+		for _, digest := range result.RepoDigests {
+			if strings.HasPrefix(digest, reference.FamiliarName(named)+"@") || strings.HasPrefix(digest, named.Name()+"@") {
+				return digest, nil
+			}
+		}
+	}
+	if len(result.RepoDigests) > 0 {
+		return result.RepoDigests[0], nil
+	}
+	return result.ID, nil
+}
+
 func registryAuthTokenForImage(ref string) (string, error) {
 	return registryAuthTokenForImageFromConfig(dockerconfig.LoadDefaultConfigFile(os.Stderr), ref)
 }
 
 func registryAuthTokenForImageFromConfig(cfg *configfile.ConfigFile, ref string) (string, error) {
-	registryRef, err := reference.ParseNormalizedNamed(ref)
+	authConfig, err := registryAuthConfigFromConfig(cfg, ref)
 	if err != nil {
 		return "", err
 	}
+	return mobyauthconfig.Encode(authConfig)
+}
+
+// registryAuthConfigForImage returns the docker credentials of the registry
+// hosting the given image, for talking to the registry directly.
+func registryAuthConfigForImage(ref string) (registrytypes.AuthConfig, error) {
+	return registryAuthConfigFromConfig(dockerconfig.LoadDefaultConfigFile(os.Stderr), ref)
+}
+
+func registryAuthConfigFromConfig(cfg *configfile.ConfigFile, ref string) (registrytypes.AuthConfig, error) {
+	registryRef, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return registrytypes.AuthConfig{}, err
+	}
 
 	authConfig, err := cfg.GetAuthConfig(registryAuthConfigKey(reference.Domain(registryRef)))
 	if err != nil {
-		return "", err
+		return registrytypes.AuthConfig{}, err
 	}
 
-	return mobyauthconfig.Encode(registrytypes.AuthConfig{
+	return registrytypes.AuthConfig{
 		Username:      authConfig.Username,
 		Password:      authConfig.Password,
 		ServerAddress: authConfig.ServerAddress,
 		Auth:          authConfig.Auth,
 		IdentityToken: authConfig.IdentityToken,
 		RegistryToken: authConfig.RegistryToken,
-	})
+	}, nil
 }
 
 func registryAuthConfigKey(domainName string) string {
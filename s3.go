@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// s3PartSize is the smallest part size of multipart uploads, files up to this
+// size are uploaded in a single request.
+const s3PartSize = 16 << 20
+
+// s3MaxParts is the highest number of parts S3 allows in a multipart upload.
+const s3MaxParts = 10000
+
+// checksumsFile is the name of the checksum list written next to the outputs
+// before uploading them, in the format of sha256sum.
+const checksumsFile = "xgo-checksums.txt"
+
+// s3Credentials are the AWS access keys requests are signed with.
+type s3Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// s3Client uploads objects into a bucket of S3 or S3-compatible storage,
+// signing requests with AWS Signature Version 4.
+type s3Client struct {
+	bucket   string
+	endpoint *url.URL // Service endpoint, addressing the bucket by path if custom
+	custom   bool     // Whether the endpoint was configured rather than AWS
+	region   string
+	creds    s3Credentials
+}
+
+// renderUploadURL expands the version control templates of an -upload URL
+// (e.g. s3://bucket/releases/{{.Version}}/) and splits it into the bucket and
+// the key prefix of the uploads.
+func renderUploadURL(raw string, git gitInfo) (string, string, error) {
+	tmpl, err := template.New("upload").Option("missingkey=error").Parse(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid upload template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, git); err != nil {
+		return "", "", fmt.Errorf("failed to render upload URL: %w", err)
+	}
+	rest, ok := strings.CutPrefix(buf.String(), "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("upload URL %s must start with s3://", buf.String())
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("upload URL %s names no bucket", buf.String())
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return bucket, prefix, nil
+}
+
+// newS3Client creates a client for a bucket, loading the credentials and the
+// region from the environment or the AWS profile (AWS_PROFILE, or default).
+// The endpoint defaults to AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL if set,
+// and to AWS otherwise.
+func newS3Client(bucket, endpoint string) (*s3Client, error) {
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	home, _ := os.UserHomeDir()
+	credentialsPath := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsPath == "" {
+		credentialsPath = filepath.Join(home, ".aws", "credentials")
+	}
+	configPath := os.Getenv("AWS_CONFIG_FILE")
+	if configPath == "" {
+		configPath = filepath.Join(home, ".aws", "config")
+	}
+	credentials, err := readINI(credentialsPath)
+	if err != nil {
+		return nil, err
+	}
+	config, err := readINI(configPath)
+	if err != nil {
+		return nil, err
+	}
+	// The config file names its sections "profile NAME", except for the default
+	section := config["profile "+profile]
+	if profile == "default" && section == nil {
+		section = config["default"]
+	}
+	// Environment credentials take precedence over the profile's
+	creds := s3Credentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		for _, values := range []map[string]string{credentials[profile], section} {
+			if values["aws_access_key_id"] != "" {
+				creds = s3Credentials{
+					AccessKey:    values["aws_access_key_id"],
+					SecretKey:    values["aws_secret_access_key"],
+					SessionToken: values["aws_session_token"],
+				}
+				break
+			}
+		}
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return nil, fmt.Errorf("no S3 credentials found, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or configure the %s profile", profile)
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = section["region"]
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	client := &s3Client{bucket: bucket, region: region, creds: creds}
+
+	for _, candidate := range []string{endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")} {
+		if candidate != "" {
+			endpoint = candidate
+			break
+		}
+	}
+	if endpoint != "" {
+		if client.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/")); err != nil || client.endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %s", endpoint)
+		}
+		client.custom = true
+	} else {
+		client.endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, region)}
+	}
+	return client, nil
+}
+
+// readINI parses an AWS configuration file into its sections, returning no
+// sections if the file doesn't exist.
+func readINI(path string) (map[string]map[string]string, error) {
+	sections := make(map[string]map[string]string)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return sections, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AWS configuration: %w", err)
+	}
+	var current map[string]string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			if sections[name] == nil {
+				sections[name] = make(map[string]string)
+			}
+			current = sections[name]
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && current != nil {
+			current[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+	}
+	return sections, nil
+}
+
+// s3Escape encodes a string as SigV4 requires, leaving only the unreserved
+// characters (and slashes, if asked to) unescaped.
+func s3Escape(s string, slash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && slash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// s3Query encodes query parameters in the canonical (sorted) form.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// objectURL returns the URL of an object, or of the bucket for an empty key.
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	object := "/" + key
+	if c.custom {
+		object = "/" + c.bucket + object
+	}
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + object
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3Query(query)
+	return &u
+}
+
+// sign adds an AWS Signature Version 4 authorization to a request, covering
+// the host, content and x-amz-* headers.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.creds.SessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "x-amz-") || key == "content-md5" || key == "content-type" || key == "range" {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.RawQuery)
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payloadHash)
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	// Derive the signing key from the secret and the scope, the last round
+	// signs the string with it
+	key := []byte("AWS4" + c.creds.SecretKey)
+	for _, part := range []string{day, c.region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.creds.AccessKey, scope, signed, hex.EncodeToString(key)))
+}
+
+// do sends a signed request for an object (or the bucket for an empty key).
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.objectURL(key, query).String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	payload := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(payload[:]), time.Now())
+
+	return http.DefaultClient.Do(req)
+}
+
+// s3Error converts a failed S3 response into an error, using the message of
+// the error document if the service sent one.
+func s3Error(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+
+	var doc struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &doc) == nil && doc.Code != "" {
+		return fmt.Errorf("%s: %s (%s)", res.Status, doc.Message, doc.Code)
+	}
+	return fmt.Errorf("%s", res.Status)
+}
+
+// s3Parts splits a file into the parts it is uploaded in, returning the MD5
+// digest of each and the ETag S3 assigns to the complete object.
+func s3Parts(path string, size int64) (int64, [][]byte, string, error) {
+	partSize := int64(s3PartSize)
+	if size > partSize*s3MaxParts {
+		partSize = (size + s3MaxParts - 1) / s3MaxParts
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	defer file.Close()
+
+	var sums [][]byte
+	for {
+		hasher := md5.New()
+		n, err := io.CopyN(hasher, file, partSize)
+		if err != nil && err != io.EOF {
+			return 0, nil, "", fmt.Errorf("failed to hash %s: %w", path, err)
+		}
+		if n > 0 || len(sums) == 0 {
+			sums = append(sums, hasher.Sum(nil))
+		}
+		if n < partSize {
+			break
+		}
+	}
+	// Single part objects are tagged by their MD5, multipart ones by the MD5 of
+	// the part digests and the number of parts
+	if size <= partSize {
+		return partSize, sums, hex.EncodeToString(sums[0]), nil
+	}
+	combined := md5.Sum(bytes.Join(sums, nil))
+	return partSize, sums, fmt.Sprintf("%s-%d", hex.EncodeToString(combined[:]), len(sums)), nil
+}
+
+// upload stores a file under the given key, skipping it if the object already
+// has the same content. Large files are uploaded in parts, continuing any
+// unfinished upload of the same key left behind by an earlier run.
+func (c *s3Client) upload(ctx context.Context, key, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	partSize, sums, etag, err := s3Parts(path, info.Size())
+	if err != nil {
+		return err
+	}
+	res, err := c.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK && strings.Trim(res.Header.Get("ETag"), `"`) == etag {
+		fmt.Printf("Skipping s3://%s/%s, already up to date\n", c.bucket, key)
+		return nil
+	}
+	if len(sums) == 1 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		header := http.Header{
+			"Content-Type": {"application/octet-stream"},
+			"Content-Md5":  {base64.StdEncoding.EncodeToString(sums[0])},
+		}
+		res, err := c.do(ctx, http.MethodPut, key, nil, header, data)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to upload %s: %w", key, s3Error(res))
+		}
+		fmt.Printf("Uploaded s3://%s/%s\n", c.bucket, key)
+		return nil
+	}
+	return c.uploadMultipart(ctx, key, path, partSize, sums)
+}
+
+// s3Part is a part of a multipart upload, as listed and completed.
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+// uploadMultipart uploads a file in parts, reusing the parts of an unfinished
+// upload of the key that match the local content.
+func (c *s3Client) uploadMultipart(ctx context.Context, key, path string, partSize int64, sums [][]byte) error {
+	id, uploaded, err := c.resumableUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		res, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, http.Header{"Content-Type": {"application/octet-stream"}}, nil)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to start upload of %s: %w", key, s3Error(res))
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+			return fmt.Errorf("failed to decode upload of %s: %w", key, err)
+		}
+		id = result.UploadID
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var (
+		parts   []s3Part
+		resumed int
+	)
+	for i, sum := range sums {
+		number := i + 1
+		etag := `"` + hex.EncodeToString(sum) + `"`
+		if part, ok := uploaded[number]; ok && part.ETag == etag {
+			parts = append(parts, s3Part{PartNumber: number, ETag: etag})
+			resumed++
+			continue
+		}
+		data := make([]byte, partSize)
+		n, err := file.ReadAt(data, int64(i)*partSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum)}}
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {id}}
+
+		res, err := c.do(ctx, http.MethodPut, key, query, header, data[:n])
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to upload part %d of %s: %w", number, key, s3Error(res))
+		}
+		parts = append(parts, s3Part{PartNumber: number, ETag: res.Header.Get("ETag")})
+	}
+	// Assemble the object from the parts. The service may report a failure in
+	// the body of a successful response, so check both.
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	res, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {id}}, http.Header{"Content-Type": {"application/xml"}}, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to complete upload of %s: %w", key, s3Error(res))
+	}
+	result, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(result, []byte("<Error>")) {
+		res.Body = io.NopCloser(bytes.NewReader(result))
+		return fmt.Errorf("failed to complete upload of %s: %w", key, s3Error(res))
+	}
+	if resumed > 0 {
+		fmt.Printf("Uploaded s3://%s/%s (%d parts, %d resumed)\n", c.bucket, key, len(parts), resumed)
+	} else {
+		fmt.Printf("Uploaded s3://%s/%s (%d parts)\n", c.bucket, key, len(parts))
+	}
+	return nil
+}
+
+// resumableUpload finds the most recent unfinished multipart upload of a key,
+// returning its id and the parts uploaded so far, or an empty id if none.
+func (c *s3Client) resumableUpload(ctx context.Context, key string) (string, map[int]s3Part, error) {
+	res, err := c.do(ctx, http.MethodGet, "", url.Values{"uploads": {""}, "prefix": {key}}, nil, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("failed to list unfinished uploads: %w", s3Error(res))
+	}
+	var listing struct {
+		Uploads []struct {
+			Key       string    `xml:"Key"`
+			UploadID  string    `xml:"UploadId"`
+			Initiated time.Time `xml:"Initiated"`
+		} `xml:"Upload"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&listing); err != nil {
+		return "", nil, fmt.Errorf("failed to decode unfinished uploads: %w", err)
+	}
+	var (
+		id     string
+		latest time.Time
+	)
+	for _, upload := range listing.Uploads {
+		if upload.Key == key && (id == "" || upload.Initiated.After(latest)) {
+			id, latest = upload.UploadID, upload.Initiated
+		}
+	}
+	if id == "" {
+		return "", nil, nil
+	}
+	// Gather the parts already uploaded, a page at a time
+	parts := make(map[int]s3Part)
+	for marker := "0"; ; {
+		res, err := c.do(ctx, http.MethodGet, key, url.Values{"uploadId": {id}, "part-number-marker": {marker}}, nil, nil)
+		if err != nil {
+			return "", nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			err := s3Error(res)
+			res.Body.Close()
+			return "", nil, fmt.Errorf("failed to list uploaded parts of %s: %w", key, err)
+		}
+		var page struct {
+			Parts       []s3Part `xml:"Part"`
+			IsTruncated bool     `xml:"IsTruncated"`
+			NextMarker  string   `xml:"NextPartNumberMarker"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to decode uploaded parts of %s: %w", key, err)
+		}
+		for _, part := range page.Parts {
+			parts[part.PartNumber] = part
+		}
+		if !page.IsTruncated || page.NextMarker == "" || page.NextMarker == marker {
+			break
+		}
+		marker = page.NextMarker
+	}
+	return id, parts, nil
+}
+
+// writeChecksums lists the SHA-256 digest of every output in the output folder.
+func writeChecksums(folder string, files []string) error {
+	var list strings.Builder
+	for _, file := range files {
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(folder, file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&list, "%s  %s\n", sum, filepath.ToSlash(rel))
+	}
+	if err := os.WriteFile(filepath.Join(folder, checksumsFile), []byte(list.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write checksums: %w", err)
+	}
+	return nil
+}
+
+// uploadOutputs stores the outputs of the build and the records describing
+// them in the bucket, keyed by their path within the output folder. The
+// records are uploaded last, so their presence marks a complete upload.
+func uploadOutputs(ctx context.Context, client *s3Client, prefix, folder string, outputs, records []string) error {
+	if err := writeChecksums(folder, outputs); err != nil {
+		return err
+	}
+	files := append(append(append([]string{}, outputs...), filepath.Join(folder, checksumsFile)), records...)
+	for _, file := range files {
+		rel, err := filepath.Rel(folder, file)
+		if err != nil {
+			return err
+		}
+		if err := client.upload(ctx, prefix+filepath.ToSlash(rel), file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// sbomFormats maps the supported -sbom formats to the suffix of the documents.
+var sbomFormats = map[string]string{
+	"spdx":      ".spdx.json",
+	"cyclonedx": ".cdx.json",
+}
+
+// sbomSubject gathers everything known about an artifact for its SBOM.
+type sbomSubject struct {
+	Name    string               // File name of the artifact
+	SHA256  string               // Hex encoded SHA-256 of the artifact
+	Library bool                 // Whether the artifact is a library rather than an executable
+	Info    *buildinfo.BuildInfo // Go build information, nil if it cannot be read
+	Deps    []cDependency        // C dependencies built into the artifact
+	Image   string               // Content addressed image the artifact was built in
+	Created time.Time            // Creation time of the document
+}
+
+// cDependency is a C library archive given with -deps or -deps-file.
+type cDependency struct {
+	Name    string     // Library name from the manifest, or derived from the archive name
+	Version string     // Library version derived from the archive name
+	URL     string     // Download location of the archive
+	SHA256  string     // Hex encoded SHA-256 of the archive
+	Dep     Dependency // Manifest entry of the library, zero for -deps archives
+}
+
+// depsVersionPattern splits archive names like gmp-6.1.0.tar.bz2 into the name
+// and version of the library.
+var depsVersionPattern = regexp.MustCompile(`^(.+?)[-_]v?([0-9][0-9A-Za-z.+~-]*?)(\.tar(\.[a-z0-9]+)?|\.t[gbx]z|\.zip)?$`)
+
+// cDependencies hashes the cached dependency archives of a build, named as in
+// the dependency manifest if there is one.
+func cDependencies(config *ConfigFlags) ([]cDependency, error) {
+	deps, err := decodeDependencies(config.DepsManifest)
+	if err != nil {
+		return nil, err
+	}
+	if deps == nil {
+		for _, dep := range strings.Split(config.Dependencies, " ") {
+			if url := strings.TrimSpace(dep); url != "" {
+				deps = append(deps, Dependency{URL: url})
+			}
+		}
+	}
+	var result []cDependency
+	for _, dep := range deps {
+		sum, err := fileSHA256(filepath.Join(depsCache, filepath.Base(dep.URL)))
+		if err != nil {
+			return nil, err
+		}
+		name, version := filepath.Base(dep.URL), ""
+		if match := depsVersionPattern.FindStringSubmatch(name); match != nil {
+			name, version = match[1], match[2]
+		}
+		if dep.Name != "" {
+			name = dep.Name
+		}
+		result = append(result, cDependency{Name: name, Version: version, URL: dep.URL, SHA256: sum, Dep: dep})
+	}
+	return result, nil
+}
+
+// cDependenciesOf returns the C dependencies built for the target of an
+// artifact, leaving out those the manifest restricts to other targets.
+func cDependenciesOf(deps []cDependency, target Target) []cDependency {
+	var result []cDependency
+	for _, dep := range deps {
+		if dep.Dep.builtFor(target) {
+			result = append(result, dep)
+		}
+	}
+	return result
+}
+
+// writeSBOMs writes an SBOM in the requested format next to every artifact,
+// returning their paths.
+func writeSBOMs(format string, artifacts []Artifact, config *ConfigFlags, flags *BuildFlags, image string) ([]string, error) {
+	suffix, ok := sbomFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported SBOM format %q, expected spdx or cyclonedx", format)
+	}
+	deps, err := cDependencies(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash C dependencies: %w", err)
+	}
+	created := time.Now().UTC()
+	if flags.SourceDateEpoch != 0 {
+		created = time.Unix(flags.SourceDateEpoch, 0).UTC()
+	}
+	var written []string
+	for _, artifact := range artifacts {
+		sum, err := fileSHA256(artifact.Path)
+		if err != nil {
+			return nil, err
+		}
+		subject := &sbomSubject{
+			Name:    filepath.Base(artifact.Path),
+			SHA256:  sum,
+			Library: flags.Mode != "" && flags.Mode != "default" && flags.Mode != "exe" && flags.Mode != "pie",
+			Deps:    cDependenciesOf(deps, artifact.Target),
+			Image:   image,
+			Created: created,
+		}
+		// Archives (c-archive) carry no build information, document them without
+		if subject.Info, err = buildinfo.ReadFile(artifact.Path); err != nil {
+			fmt.Printf("No Go build information in %s: %v\n", subject.Name, err)
+		}
+		var document any
+		if format == "spdx" {
+			document = newSPDXDocument(subject)
+		} else {
+			document = newCycloneDXDocument(subject)
+		}
+		data, err := json.MarshalIndent(document, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(artifact.Path+suffix, append(data, '\n'), 0o644); err != nil {
+			return nil, fmt.Errorf("failed to write SBOM for %s: %w", subject.Name, err)
+		}
+		written = append(written, artifact.Path+suffix)
+	}
+	return written, nil
+}
+
+// sbomModules lists the Go modules built into the artifact, with replacements
+// applied, followed by the standard library.
+func sbomModules(info *buildinfo.BuildInfo) []*debug.Module {
+	if info == nil {
+		return nil
+	}
+	var modules []*debug.Module
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		modules = append(modules, dep)
+	}
+	return append(modules, &debug.Module{Path: "std", Version: strings.TrimPrefix(info.GoVersion, "go")})
+}
+
+// mainModule returns the path and version of the artifact's main module.
+func (s *sbomSubject) mainModule() (string, string) {
+	if s.Info == nil {
+		return "", ""
+	}
+	return s.Info.Main.Path, s.Info.Main.Version
+}
+
+// goModulePURL formats the package URL of a Go module.
+func goModulePURL(path, version string) string {
+	if version == "" || version == "(devel)" {
+		return "pkg:golang/" + path
+	}
+	return "pkg:golang/" + path + "@" + version
+}
+
+// moduleSumProperty names the go.sum hash of a module in CycloneDX documents.
+// The h1: hash covers a summary of the module's files rather than any archive,
+// so it can't be given as a plain SHA-256 digest.
+const moduleSumProperty = "golang:sum"
+
+// imagePURL formats the package URL of the build image.
+func imagePURL(image string) string {
+	repo, digest, ok := strings.Cut(image, "@")
+	if !ok {
+		return ""
+	}
+	return "pkg:oci/" + filepath.Base(repo) + "@" + strings.ReplaceAll(digest, ":", "%3A") + "?repository_url=" + repo
+}
+
+// xgoVersion returns the module version of the running xgo binary.
+func xgoVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// SPDX 2.3 document, see https://spdx.github.io/spdx-spec/v2.3/
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+	Purpose          string            `json:"primaryPackagePurpose,omitempty"`
+	Comment          string            `json:"comment,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	Category string `json:"referenceCategory"`
+	Type     string `json:"referenceType"`
+	Locator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+// newSPDXDocument assembles the SPDX document of an artifact.
+func newSPDXDocument(s *sbomSubject) *spdxDocument {
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              s.Name,
+		DocumentNamespace: "https://src.techknowlogick.com/xgo/spdx/" + s.Name + "-" + s.SHA256,
+		CreationInfo: spdxCreationInfo{
+			Created:  s.Created.Format(time.RFC3339),
+			Creators: []string{"Tool: xgo-" + xgoVersion()},
+		},
+	}
+	purpose := "APPLICATION"
+	if s.Library {
+		purpose = "LIBRARY"
+	}
+	path, version := s.mainModule()
+	artifact := spdxPackage{
+		SPDXID:           "SPDXRef-Artifact",
+		Name:             s.Name,
+		VersionInfo:      version,
+		DownloadLocation: "NOASSERTION",
+		Checksums:        []spdxChecksum{{Algorithm: "SHA256", Value: s.SHA256}},
+		Purpose:          purpose,
+	}
+	if path != "" {
+		artifact.ExternalRefs = []spdxExternalRef{{Category: "PACKAGE-MANAGER", Type: "purl", Locator: goModulePURL(path, version)}}
+	}
+	doc.Packages = append(doc.Packages, artifact)
+	doc.Relationships = append(doc.Relationships, spdxRelationship{Element: doc.SPDXID, Type: "DESCRIBES", Related: artifact.SPDXID})
+
+	for i, module := range sbomModules(s.Info) {
+		pkg := spdxPackage{
+			SPDXID:           fmt.Sprintf("SPDXRef-Module-%d", i),
+			Name:             module.Path,
+			VersionInfo:      module.Version,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs:     []spdxExternalRef{{Category: "PACKAGE-MANAGER", Type: "purl", Locator: goModulePURL(module.Path, module.Version)}},
+			Purpose:          "LIBRARY",
+		}
+		if module.Sum != "" {
+			pkg.Comment = "go.sum hash " + module.Sum
+		}
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{Element: artifact.SPDXID, Type: "CONTAINS", Related: pkg.SPDXID})
+	}
+	for i, dep := range s.Deps {
+		pkg := spdxPackage{
+			SPDXID:           fmt.Sprintf("SPDXRef-CDependency-%d", i),
+			Name:             dep.Name,
+			VersionInfo:      dep.Version,
+			DownloadLocation: dep.URL,
+			Checksums:        []spdxChecksum{{Algorithm: "SHA256", Value: dep.SHA256}},
+			Purpose:          "LIBRARY",
+		}
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{Element: artifact.SPDXID, Type: "STATIC_LINK", Related: pkg.SPDXID})
+	}
+	if s.Image != "" {
+		repo, digest, _ := strings.Cut(s.Image, "@")
+		pkg := spdxPackage{
+			SPDXID:           "SPDXRef-BuildImage",
+			Name:             repo,
+			VersionInfo:      digest,
+			DownloadLocation: "NOASSERTION",
+			Purpose:          "CONTAINER",
+		}
+		if purl := imagePURL(s.Image); purl != "" {
+			pkg.ExternalRefs = []spdxExternalRef{{Category: "PACKAGE-MANAGER", Type: "purl", Locator: purl}}
+		}
+		doc.CreationInfo.Creators = append(doc.CreationInfo.Creators, "Tool: "+s.Image)
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{Element: pkg.SPDXID, Type: "BUILD_TOOL_OF", Related: artifact.SPDXID})
+	}
+	return doc
+}
+
+// CycloneDX 1.5 document, see https://cyclonedx.org/docs/1.5/json/
+type cdxDocument struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type               string        `json:"type"`
+	BOMRef             string        `json:"bom-ref,omitempty"`
+	Name               string        `json:"name"`
+	Version            string        `json:"version,omitempty"`
+	PURL               string        `json:"purl,omitempty"`
+	Hashes             []cdxHash     `json:"hashes,omitempty"`
+	ExternalReferences []cdxExternal `json:"externalReferences,omitempty"`
+	Properties         []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxHash struct {
+	Algorithm string `json:"alg"`
+	Content   string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxExternal struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// newCycloneDXDocument assembles the CycloneDX document of an artifact.
+func newCycloneDXDocument(s *sbomSubject) *cdxDocument {
+	// Derive the serial number from the artifact, keeping reproducible builds
+	// reproducible (RFC 9562 version 8 UUID)
+	id := sha256.Sum256([]byte(s.Name + "\x00" + s.SHA256))
+	id[6] = id[6]&0x0f | 0x80
+	id[8] = id[8]&0x3f | 0x80
+
+	kind := "application"
+	if s.Library {
+		kind = "library"
+	}
+	path, version := s.mainModule()
+	artifact := cdxComponent{
+		Type:    kind,
+		BOMRef:  "artifact",
+		Name:    s.Name,
+		Version: version,
+		Hashes:  []cdxHash{{Algorithm: "SHA-256", Content: s.SHA256}},
+	}
+	if path != "" {
+		artifact.PURL = goModulePURL(path, version)
+	}
+	doc := &cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: s.Created.Format(time.RFC3339),
+			Tools:     cdxTools{Components: []cdxComponent{{Type: "application", Name: "xgo", Version: xgoVersion()}}},
+			Component: artifact,
+		},
+		Components: []cdxComponent{},
+	}
+	dependency := cdxDependency{Ref: artifact.BOMRef, DependsOn: []string{}}
+
+	for _, module := range sbomModules(s.Info) {
+		component := cdxComponent{
+			Type:    "library",
+			BOMRef:  goModulePURL(module.Path, module.Version),
+			Name:    module.Path,
+			Version: module.Version,
+			PURL:    goModulePURL(module.Path, module.Version),
+		}
+		if module.Sum != "" {
+			component.Properties = []cdxProperty{{Name: moduleSumProperty, Value: module.Sum}}
+		}
+		doc.Components = append(doc.Components, component)
+		dependency.DependsOn = append(dependency.DependsOn, component.BOMRef)
+	}
+	for _, dep := range s.Deps {
+		component := cdxComponent{
+			Type:               "library",
+			BOMRef:             "deps:" + dep.URL,
+			Name:               dep.Name,
+			Version:            dep.Version,
+			Hashes:             []cdxHash{{Algorithm: "SHA-256", Content: dep.SHA256}},
+			ExternalReferences: []cdxExternal{{Type: "distribution", URL: dep.URL}},
+		}
+		doc.Components = append(doc.Components, component)
+		dependency.DependsOn = append(dependency.DependsOn, component.BOMRef)
+	}
+	if s.Image != "" {
+		repo, digest, _ := strings.Cut(s.Image, "@")
+		doc.Metadata.Tools.Components = append(doc.Metadata.Tools.Components, cdxComponent{
+			Type:    "container",
+			Name:    repo,
+			Version: digest,
+			PURL:    imagePURL(s.Image),
+		})
+	}
+	doc.Dependencies = []cdxDependency{dependency}
+	return doc
+}
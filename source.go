@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sourceLayout collects the host folders a local module build needs within the
+// container. The module is mounted below /source, and every other folder is
+// mounted at the same position relative to it, so relative references between
+// them (go.work use directives, local replace directives) stay valid.
+type sourceLayout struct {
+	Module   string   // Folder of the module being built
+	Dirs     []string // Additional folders mounted read-write (workspace modules)
+	ReadOnly []string // Additional folders mounted read-only (local replacements)
+	Files    []string // Additional single files (go.work, go.work.sum)
+}
+
+// resolveSourceLayout determines everything a local build of the module in
+// moduleDir needs mounted: the module itself, the rest of its workspace and
+// the folders local replace directives point to outside of those.
+func resolveSourceLayout(moduleDir string) (*sourceLayout, *goWorkspace, error) {
+	layout := &sourceLayout{Module: moduleDir}
+
+	workspace, err := findWorkspace(moduleDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Replace directives of every module in the workspace apply, along with
+	// those of the go.work file itself
+	modules := []string{moduleDir}
+	if workspace != nil {
+		layout.Dirs = workspace.Uses
+		layout.Files = []string{workspace.File, workspace.File + ".sum"}
+		modules = append(modules, workspace.Uses...)
+	}
+	var files []string
+	for _, module := range modules {
+		files = append(files, filepath.Join(module, "go.mod"))
+	}
+	if workspace != nil {
+		files = append(files, workspace.File)
+	}
+	for _, file := range files {
+		dirs, err := localReplacements(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, dir := range dirs {
+			if !containsPath(modules, dir) && !containsPath(layout.ReadOnly, dir) {
+				layout.ReadOnly = append(layout.ReadOnly, dir)
+			}
+		}
+	}
+	return layout, workspace, nil
+}
+
+// root returns the host folder mapped to /source: the deepest folder containing
+// everything that needs mounting.
+func (l *sourceLayout) root() string {
+	paths := append([]string{l.Module}, l.Dirs...)
+	paths = append(paths, l.ReadOnly...)
+	for _, file := range l.Files {
+		paths = append(paths, filepath.Dir(file))
+	}
+	return commonDir(paths)
+}
+
+// containerPath returns where a host path is visible within the container.
+func (l *sourceLayout) containerPath(host string) string {
+	rel, _ := filepath.Rel(l.root(), host)
+	return path.Join("/source", filepath.ToSlash(rel))
+}
+
+// sourcePath returns the location of the module below /source.
+func (l *sourceLayout) sourcePath() string {
+	rel, _ := filepath.Rel(l.root(), l.Module)
+	return filepath.ToSlash(rel)
+}
+
+// binds returns the volume mounts for the layout. Every folder is mounted once,
+// skipping those nested within another mount, and read-write folders take
+// precedence over read-only ones.
+func (l *sourceLayout) binds() []string {
+	writable := append([]string{l.Module}, l.Dirs...)
+	sort.Strings(writable)
+	readOnly := append([]string(nil), l.ReadOnly...)
+	sort.Strings(readOnly)
+
+	var (
+		binds   []string
+		mounted []string
+	)
+	for _, dir := range writable {
+		if containsPath(mounted, dir) {
+			continue
+		}
+		mounted = append(mounted, dir)
+		binds = append(binds, toDockerPath(dir)+":"+l.containerPath(dir))
+	}
+	for _, dir := range readOnly {
+		if containsPath(mounted, dir) {
+			continue
+		}
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		mounted = append(mounted, dir)
+		binds = append(binds, toDockerPath(dir)+":"+l.containerPath(dir)+":ro")
+	}
+	for _, file := range l.Files {
+		if containsPath(mounted, file) {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		binds = append(binds, toDockerPath(file)+":"+l.containerPath(file))
+	}
+	return binds
+}
+
+// containsPath reports whether target is one of dirs or located below one.
+func containsPath(dirs []string, target string) bool {
+	for _, dir := range dirs {
+		if rel, err := filepath.Rel(dir, target); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// commonDir returns the deepest folder containing all the given paths.
+func commonDir(paths []string) string {
+	common := paths[0]
+	for _, p := range paths[1:] {
+		for !containsPath([]string{common}, p) {
+			parent := filepath.Dir(common)
+			if parent == common {
+				break
+			}
+			common = parent
+		}
+	}
+	return common
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+)
+
+// Target is a single cross compilation target supported by the xgo image. The
+// registry below mirrors the target blocks in docker/build/build.sh, so any
+// change to the set of targets there must be reflected here too.
+type Target struct {
+	OS       string // Go operating system (GOOS)
+	Arch     string // Architecture as named by xgo (e.g. amd64, arm-7)
+	GoArch   string // Go architecture (GOARCH)
+	GoArm    string // Go ARM version (GOARM), empty for non-arm targets
+	Platform string // Platform version (Windows NT, macOS deployment target, FreeBSD release)
+	Race     bool   // Whether the build script honours -race for this target
+	FloatABI string // ARM float ABI of the C toolchain (soft, hard), empty for non-arm targets
+	Libc     string // C library variant of linux targets (musl), empty for the default one
+}
+
+// String returns the target in the os/arch form accepted by -targets.
+func (t Target) String() string {
+	return t.osName() + "/" + t.Arch
+}
+
+// osName returns the operating system as named in -targets, which for linux
+// includes the C library variant (e.g. linux-musl).
+func (t Target) osName() string {
+	if t.Libc != "" {
+		return t.OS + "-" + t.Libc
+	}
+	return t.OS
+}
+
+// targetRegistry lists every target in the order build.sh compiles them. The
+// platform of windows and darwin targets is the default one, and is replaced
+// by the version requested in -targets (e.g. windows-10.0/*) on resolution.
+var targetRegistry = []Target{
+	{OS: "linux", Arch: "amd64", GoArch: "amd64", Race: true},
+	{OS: "linux", Arch: "386", GoArch: "386"},
+	{OS: "linux", Arch: "arm-5", GoArch: "arm", GoArm: "5", FloatABI: "soft"},
+	{OS: "linux", Arch: "arm-6", GoArch: "arm", GoArm: "6", FloatABI: "soft"},
+	{OS: "linux", Arch: "arm-7", GoArch: "arm", GoArm: "7", FloatABI: "soft"},
+	{OS: "linux", Arch: "arm64", GoArch: "arm64"},
+	{OS: "linux", Arch: "mips64", GoArch: "mips64"},
+	{OS: "linux", Arch: "mips64le", GoArch: "mips64le"},
+	{OS: "linux", Arch: "mips", GoArch: "mips"},
+	{OS: "linux", Arch: "s390x", GoArch: "s390x"},
+	{OS: "linux", Arch: "riscv64", GoArch: "riscv64"},
+	{OS: "linux", Arch: "ppc64le", GoArch: "ppc64le"},
+	{OS: "linux", Arch: "mipsle", GoArch: "mipsle"},
+	{OS: "linux", Arch: "amd64", GoArch: "amd64", Libc: "musl"},
+	{OS: "linux", Arch: "arm64", GoArch: "arm64", Libc: "musl"},
+	{OS: "windows", Arch: "amd64", GoArch: "amd64", Platform: "4.0", Race: true},
+	{OS: "windows", Arch: "386", GoArch: "386", Platform: "4.0"},
+	{OS: "windows", Arch: "arm64", GoArch: "arm64", Platform: "4.0"},
+	{OS: "darwin", Arch: "amd64", GoArch: "amd64", Platform: "10.12", Race: true},
+	{OS: "darwin", Arch: "arm64", GoArch: "arm64", Platform: "10.12", Race: true},
+	{OS: "freebsd", Arch: "amd64", GoArch: "amd64", Platform: "14"},
+}
+
+// resolveTargets expands the -targets patterns into the concrete targets that
+// build.sh will compile, following the same matching rules as the script. A
+// target requested multiple times is only returned once.
+func resolveTargets(patterns []string) []Target {
+	if len(patterns) == 1 && patterns[0] == "" {
+		patterns = []string{"*/*"}
+	}
+	var (
+		resolved []Target
+		seen     = make(map[string]bool)
+	)
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		pattern = strings.ReplaceAll(pattern, "*", ".")
+		xgoos, xgoarch := cutField(pattern, "/", 1), cutField(pattern, "/", 2)
+
+		for _, target := range targetRegistry {
+			if !matchTargetOS(target, xgoos) || !matchTargetArch(target, xgoarch) {
+				continue
+			}
+			if target.OS == "windows" || target.OS == "darwin" {
+				if platform := cutField(xgoos, "-", 2); platform != "" && platform != "." && platform != target.OS {
+					target.Platform = platform
+				}
+			}
+			if key := target.osName() + "-" + target.Platform + "/" + target.Arch; !seen[key] {
+				seen[key] = true
+				resolved = append(resolved, target)
+			}
+		}
+	}
+	return resolved
+}
+
+// matchTargetOS reports whether the operating system part of a -targets
+// pattern selects the given target. The C library variant of linux targets is
+// part of the operating system (linux-musl), plain linux only selects glibc.
+// Variant targets are opt-in, so only selected when named literally and not
+// by wildcards (e.g. */*).
+func matchTargetOS(target Target, xgoos string) bool {
+	if target.Libc != "" {
+		return xgoos == target.osName()
+	}
+	if xgoos == "." {
+		return true
+	}
+	if target.OS == "linux" {
+		return xgoos == target.osName()
+	}
+	return strings.HasPrefix(xgoos, target.OS)
+}
+
+// matchTargetArch reports whether the architecture part of a -targets pattern
+// selects the given target. A plain "arm" on linux selects arm-5, as it does in
+// build.sh.
+func matchTargetArch(target Target, xgoarch string) bool {
+	if xgoarch == "." || xgoarch == target.Arch {
+		return true
+	}
+	return target.OS == "linux" && target.Libc == "" && target.Arch == "arm-5" && xgoarch == "arm"
+}
+
+// cutField mimics `cut -d sep -f n`: fields are counted from 1, and a string
+// without any separator is returned whole.
+func cutField(s, sep string, n int) string {
+	if !strings.Contains(s, sep) {
+		return s
+	}
+	fields := strings.Split(s, sep)
+	if n > len(fields) {
+		return ""
+	}
+	return fields[n-1]
+}
+
+// targetExtension returns the file extension build.sh appends to outputs for
+// the given operating system and build mode.
+func targetExtension(goos, mode string) string {
+	switch mode {
+	case "archive", "c-archive":
+		if goos == "windows" {
+			return ".lib"
+		}
+		return ".a"
+	case "shared", "c-shared":
+		switch goos {
+		case "windows":
+			return ".dll"
+		case "darwin":
+			return ".dylib"
+		}
+		return ".so"
+	}
+	if goos == "windows" {
+		return ".exe"
+	}
+	return ""
+}
+
+// scriptSuffix returns the suffix build.sh appends to the output name for the
+// given target, e.g. "-windows-4.0-amd64.exe".
+func scriptSuffix(target Target, race bool, mode string) string {
+	r := ""
+	if race && target.Race {
+		r = "-race"
+	}
+	ext := targetExtension(target.OS, mode)
+
+	switch target.OS {
+	case "windows", "darwin":
+		return "-" + target.OS + "-" + target.Platform + "-" + target.Arch + r + ext
+	case "freebsd":
+		return "-freebsd" + target.Platform + "-" + target.Arch + r + ext
+	}
+	return "-" + target.osName() + "-" + target.Arch + r + ext
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+)
+
+// universalArch is the architecture name of merged macOS binaries.
+const universalArch = "universal"
+
+// universalSliceAlign is the log2 alignment of the slices in a fat binary. The
+// 16KB page size of arm64 is used for every slice, as lipo does.
+const universalSliceAlign = 14
+
+// universalSlices are the architectures merged into a universal binary, in
+// the order their slices are written.
+var universalSlices = []string{"amd64", "arm64"}
+
+// universalTargets returns the universal pseudo target of every darwin
+// platform version for which all slices are built.
+func universalTargets(targets []Target) []Target {
+	arches := make(map[string]map[string]bool)
+	var platforms []string
+	for _, target := range targets {
+		if target.OS != "darwin" {
+			continue
+		}
+		if arches[target.Platform] == nil {
+			arches[target.Platform] = make(map[string]bool)
+			platforms = append(platforms, target.Platform)
+		}
+		arches[target.Platform][target.Arch] = true
+	}
+	var universal []Target
+	for _, platform := range platforms {
+		complete := true
+		for _, arch := range universalSlices {
+			complete = complete && arches[platform][arch]
+		}
+		if complete {
+			universal = append(universal, Target{OS: "darwin", Arch: universalArch, Platform: platform, Race: true})
+		}
+	}
+	return universal
+}
+
+// mergeUniversal combines the amd64 and arm64 darwin outputs of every package
+// and platform version into a Mach-O universal binary, returning the merged
+// artifacts. Outputs missing a slice (e.g. because the build skipped it) are
+// left alone.
+func mergeUniversal(folder string, artifacts []Artifact, git gitInfo, config *ConfigFlags, flags *BuildFlags) ([]Artifact, error) {
+	var tmpl *template.Template
+	if config.Template != "" {
+		var err error
+		if tmpl, err = parseOutputTemplate(config.Template); err != nil {
+			return nil, err
+		}
+	}
+	packages := config.Packages
+	if len(packages) == 0 {
+		packages = []string{""}
+	}
+	names := make(map[string]string)
+	for i, name := range outputNames(config) {
+		names[packages[i]] = name
+	}
+	// Group the slices by package and platform version
+	slices := make(map[string]map[string]Artifact)
+	for _, artifact := range artifacts {
+		if artifact.Target.OS != "darwin" {
+			continue
+		}
+		key := artifact.Package + "\x00" + artifact.Target.Platform
+		if slices[key] == nil {
+			slices[key] = make(map[string]Artifact)
+		}
+		slices[key][artifact.Target.Arch] = artifact
+	}
+	var merged []Artifact
+	for _, target := range universalTargets(resolveTargets(config.Targets)) {
+		for _, pkg := range packages {
+			group := slices[pkg+"\x00"+target.Platform]
+
+			var parts []Artifact
+			for _, arch := range universalSlices {
+				if part, ok := group[arch]; ok {
+					parts = append(parts, part)
+				}
+			}
+			if len(parts) != len(universalSlices) {
+				continue
+			}
+			rel, err := outputPath(tmpl, names[pkg], git, target, flags)
+			if err != nil {
+				return nil, err
+			}
+			artifact := Artifact{Target: target, Package: pkg, Path: filepath.Join(folder, filepath.FromSlash(rel)), Header: parts[0].Header}
+			if err := writeUniversal(artifact.Path, parts); err != nil {
+				return nil, fmt.Errorf("failed to create universal binary %s: %w", rel, err)
+			}
+			for _, part := range parts {
+				artifact.Libraries = mergeSorted(artifact.Libraries, part.Libraries)
+				artifact.Disallowed = mergeSorted(artifact.Disallowed, part.Disallowed)
+			}
+			fmt.Printf("Created universal binary %s\n", artifact.Path)
+			merged = append(merged, artifact)
+		}
+	}
+	return merged, nil
+}
+
+// writeUniversal writes a Mach-O fat binary holding the given thin slices and
+// reads it back to make sure every slice is where the fat header says.
+func writeUniversal(path string, parts []Artifact) error {
+	type slice struct {
+		header macho.FatArchHeader
+		path   string
+	}
+	var (
+		entries  []slice
+		filetype macho.Type
+		offset   = uint64(1) << universalSliceAlign
+	)
+	for _, part := range parts {
+		file, err := macho.Open(part.Path)
+		if err != nil {
+			return fmt.Errorf("%s is not a thin Mach-O file: %w", filepath.Base(part.Path), err)
+		}
+		header := file.FileHeader
+		file.Close()
+
+		if want := machoCpus[part.Target.GoArch]; header.Cpu != want {
+			return fmt.Errorf("%s has CPU type %v, expected %v", filepath.Base(part.Path), header.Cpu, want)
+		}
+		if filetype != 0 && header.Type != filetype {
+			return fmt.Errorf("%s is a %v, the other slices are %v", filepath.Base(part.Path), header.Type, filetype)
+		}
+		filetype = header.Type
+
+		info, err := os.Stat(part.Path)
+		if err != nil {
+			return err
+		}
+		if offset+uint64(info.Size()) > 1<<32 {
+			return fmt.Errorf("slices exceed the 4GB limit of 32 bit fat headers")
+		}
+		entries = append(entries, slice{
+			header: macho.FatArchHeader{
+				Cpu:    header.Cpu,
+				SubCpu: header.SubCpu,
+				Offset: uint32(offset),
+				Size:   uint32(info.Size()),
+				Align:  universalSliceAlign,
+			},
+			path: part.Path,
+		})
+		offset = (offset + uint64(info.Size()) + 1<<universalSliceAlign - 1) &^ (1<<universalSliceAlign - 1)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o755)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Fat headers are always big endian, regardless of the slices
+	header := []uint32{macho.MagicFat, uint32(len(entries))}
+	for _, entry := range entries {
+		header = append(header, uint32(entry.header.Cpu), entry.header.SubCpu, entry.header.Offset, entry.header.Size, entry.header.Align)
+	}
+	if err := binary.Write(out, binary.BigEndian, header); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := out.Seek(int64(entry.header.Offset), io.SeekStart); err != nil {
+			return err
+		}
+		in, err := os.Open(entry.path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	cpus := make([]macho.Cpu, len(entries))
+	for i, entry := range entries {
+		cpus[i] = entry.header.Cpu
+	}
+	return checkUniversal(path, cpus)
+}
+
+// checkUniversal verifies that a fat binary parses, holds slices for the given
+// CPU types and that each slice is a valid Mach-O file of the type its fat
+// header entry claims.
+func checkUniversal(path string, cpus []macho.Cpu) error {
+	fat, err := macho.OpenFat(path)
+	if err != nil {
+		return fmt.Errorf("invalid fat binary: %w", err)
+	}
+	defer fat.Close()
+
+	if len(fat.Arches) != len(cpus) {
+		return fmt.Errorf("fat binary holds %d slices, expected %d", len(fat.Arches), len(cpus))
+	}
+	for i, arch := range fat.Arches {
+		if arch.Cpu != cpus[i] || arch.File.Cpu != arch.Cpu {
+			return fmt.Errorf("slice at offset %d has CPU type %v, header claims %v", arch.Offset, arch.File.Cpu, arch.Cpu)
+		}
+	}
+	return nil
+}
+
+// mergeSorted merges two sorted string lists, dropping duplicates.
+func mergeSorted(a, b []string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			merged = append(merged, s)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Magic numbers identifying the formats of CGO dependency archives.
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicBzip2 = []byte("BZh")
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicZip   = []byte("PK\x03\x04")
+	magicTar   = []byte("ustar") // At offset 257, shared by the ustar, POSIX and GNU formats
+)
+
+// unpackDependencies implements xgo unpack: it extracts CGO dependency
+// archives into a folder, detecting their format by content rather than name.
+// build.sh runs it inside the image on the archives cached by -deps. Archives
+// of a dependency manifest are each unpacked into their own folder, named so
+// that the folders list in build order.
+func unpackDependencies(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: %s unpack <folder> [archive...]", os.Args[0])
+	}
+	dest := args[0]
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return err
+	}
+	deps, err := manifestDependencies()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]string)
+	for i, dep := range deps {
+		dirs[filepath.Base(dep.URL)] = dependencyDir(i, dep.Name)
+	}
+	for _, archive := range args[1:] {
+		if dir, ok := dirs[filepath.Base(archive)]; ok {
+			err = unpackDependency(archive, dest, dir)
+		} else {
+			err = unpackArchive(archive, dest)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to unpack %s: %w", filepath.Base(archive), err)
+		}
+	}
+	return nil
+}
+
+// unpackDependency extracts a dependency archive into the folder dir within
+// dest. The single top level folder most source archives wrap their content in
+// is dropped, so the sources end up directly in dir.
+func unpackDependency(archive, dest, dir string) error {
+	scratch, err := os.MkdirTemp(dest, ".unpack-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	if err := unpackArchive(archive, scratch); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(scratch)
+	if err != nil {
+		return err
+	}
+	root := scratch
+	if len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(scratch, entries[0].Name())
+	}
+	if err := os.RemoveAll(filepath.Join(dest, dir)); err != nil {
+		return err
+	}
+	return os.Rename(root, filepath.Join(dest, dir))
+}
+
+// archiveFormat detects the format of a dependency archive from its leading
+// bytes: zip, tar, or a tarball compressed with gzip, bzip2, xz or zstd.
+func archiveFormat(r *bufio.Reader) (string, error) {
+	head, _ := r.Peek(len(magicXz))
+	switch {
+	case bytes.HasPrefix(head, magicZip):
+		return "zip", nil
+	case bytes.HasPrefix(head, magicGzip):
+		return "gzip", nil
+	case bytes.HasPrefix(head, magicBzip2):
+		return "bzip2", nil
+	case bytes.HasPrefix(head, magicXz):
+		return "xz", nil
+	case bytes.HasPrefix(head, magicZstd):
+		return "zstd", nil
+	}
+	header, _ := r.Peek(257 + len(magicTar))
+	if bytes.HasPrefix(header[min(len(header), 257):], magicTar) {
+		return "tar", nil
+	}
+	return "", fmt.Errorf("unknown archive format, expected a tarball (optionally gzip, bzip2, xz or zstd compressed) or a zip archive")
+}
+
+// downloadDependency fetches a dependency archive into path. The archive is
+// written to a temporary file first and only moved into place once complete,
+// so failed downloads never end up in the cache.
+func downloadDependency(url, path string) error {
+	res, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("server responded with %s", res.Status)
+	}
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if _, err := io.Copy(out, res.Body); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
+
+// checkDependency makes sure a file is a dependency archive xgo can unpack.
+func checkDependency(archive string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = archiveFormat(bufio.NewReader(file))
+	return err
+}
+
+// unpackArchive extracts a dependency archive into dest.
+func unpackArchive(archive, dest string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+	format, err := archiveFormat(buffered)
+	if err != nil {
+		return err
+	}
+	var stream io.Reader
+	switch format {
+	case "zip":
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		return extractZip(file, info.Size(), dest)
+
+	case "gzip":
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		stream = gz
+
+	case "bzip2":
+		stream = bzip2.NewReader(buffered)
+
+	case "xz":
+		if stream, err = xz.NewReader(buffered); err != nil {
+			return err
+		}
+	case "zstd":
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		stream = zr
+
+	default:
+		stream = buffered
+	}
+	return extractTar(stream, dest)
+}
+
+// unpackTarget resolves the location of an archive entry within dest,
+// rejecting entries that would end up outside of it. Entries beneath links
+// extracted earlier are rejected too, as links can be chained to point outside
+// of dest in ways a lexical check can't see (e.g. a -> . and b -> a/..).
+func unpackTarget(dest, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entry %s points outside of the archive", name)
+	}
+	dir := dest
+	for _, part := range strings.Split(filepath.Dir(clean), string(filepath.Separator)) {
+		if part == "." {
+			break
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("entry %s is placed beneath link %s", name, dir)
+		}
+	}
+	return filepath.Join(dest, clean), nil
+}
+
+// checkLink rejects links that would point outside of dest, as later entries
+// could otherwise be written through them.
+func checkLink(dest, target, link string) error {
+	if filepath.IsAbs(link) {
+		return fmt.Errorf("link %s points to absolute path %s", target, link)
+	}
+	rel, err := filepath.Rel(dest, filepath.Join(filepath.Dir(target), link))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("link %s points outside of the archive", target)
+	}
+	return nil
+}
+
+// writeEntry creates a file from an archive entry, keeping its permissions and
+// modification time so build systems don't consider generated files stale.
+func writeEntry(target string, mode os.FileMode, modified time.Time, content io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	// Replace anything in the way, as a later entry overrides an earlier one
+	os.Remove(target)
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode.Perm()|0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, content); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(target, modified, modified)
+}
+
+// extractTar extracts a tarball into dest.
+func extractTar(stream io.Reader, dest string) error {
+	tr := tar.NewReader(stream)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		target, err := unpackTarget(dest, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(header.Mode).Perm()|0o700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeEntry(target, os.FileMode(header.Mode), header.ModTime, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := checkLink(dest, target, header.Linkname); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := unpackTarget(dest, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		default:
+			// Devices and FIFOs have no place in source archives
+		}
+	}
+}
+
+// extractZip extracts a zip archive into dest.
+func extractZip(file io.ReaderAt, size int64, dest string) error {
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return err
+	}
+	for _, entry := range archive.File {
+		target, err := unpackTarget(dest, entry.Name)
+		if err != nil {
+			return err
+		}
+		mode := entry.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, mode.Perm()|0o700); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			content, err := entry.Open()
+			if err != nil {
+				return err
+			}
+			link, err := io.ReadAll(content)
+			content.Close()
+			if err != nil {
+				return err
+			}
+			if err := checkLink(dest, target, string(link)); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(string(link), target); err != nil {
+				return err
+			}
+		default:
+			// Entries without permissions are made readable
+			if mode.Perm() == 0 {
+				mode |= 0o644
+			}
+			content, err := entry.Open()
+			if err != nil {
+				return err
+			}
+			err = writeEntry(target, mode, entry.Modified, content)
+			content.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
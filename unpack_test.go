@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests that dependencies are only cached once completely downloaded, and
+// that error pages are never cached.
+func TestDownloadDependency(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dep.tar.gz" {
+			http.Error(w, "<html>not found</html>", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("archive"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "missing.tar.gz")
+	if err := downloadDependency(server.URL+"/missing.tar.gz", path); err == nil {
+		t.Errorf("missing dependency downloaded")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("failed download left %d files in the cache", len(entries))
+	}
+	path = filepath.Join(dir, "dep.tar.gz")
+	if err := downloadDependency(server.URL+"/dep.tar.gz", path); err != nil {
+		t.Fatalf("failed to download dependency: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "archive" {
+		t.Errorf("cached dependency mismatch: have %q (%v), want %q", data, err, "archive")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("download left %d files in the cache, want 1", len(entries))
+	}
+}
+
+// Tests that links chained to point outside of the destination can't be
+// written through.
+func TestExtractTarChainedLinks(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a/.."},
+		{Name: "b/x", Typeflag: tar.TypeReg, Mode: 0o644, Size: 7},
+	} {
+		if err := tw.WriteHeader(entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Typeflag == tar.TypeReg {
+			tw.Write([]byte("escaped"))
+		}
+	}
+	tw.Close()
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	if err := extractTar(&buf, dest); err == nil {
+		t.Errorf("entry beneath a link extracted")
+	}
+	if _, err := os.Stat(filepath.Join(root, "x")); err == nil {
+		t.Errorf("entry written outside of the destination")
+	}
+}
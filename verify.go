@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// verifyBuild implements xgo verify: it repeats the build recorded in a
+// manifest in a fresh container and compares the outputs target by target.
+func verifyBuild(ctx context.Context, args []string) error {
+	path := manifestFile
+	switch len(args) {
+	case 0:
+	case 1:
+		path = args[0]
+	default:
+		return fmt.Errorf("usage: %s verify [manifest]", os.Args[0])
+	}
+	manifest, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+	if !manifest.Reproducible {
+		return fmt.Errorf("manifest %s isn't of a reproducible build, rebuild with -reproducible", path)
+	}
+	if manifest.Dirty {
+		return fmt.Errorf("manifest %s was built from uncommitted changes, which can't be rebuilt", path)
+	}
+	// Make sure the sources are still those the manifest was built from
+	if manifest.Commit != "" && len(manifest.Args) == 1 {
+		repo := manifest.Args[0]
+		if !filepath.IsAbs(repo) {
+			repo = filepath.Join(manifest.Dir, repo)
+		}
+		if git := readGitInfo(repo); git.Commit != manifest.Commit {
+			return fmt.Errorf("repository is at commit %q, but the manifest was built from %s", git.Commit, manifest.Commit)
+		}
+	}
+	// Rebuild into a scratch folder, pinned to the image of the original build
+	folder, err := os.MkdirTemp("", "xgo-verify-")
+	if err != nil {
+		return fmt.Errorf("failed to create scratch folder: %w", err)
+	}
+	defer os.RemoveAll(folder)
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate xgo executable: %w", err)
+	}
+	// The recorded flags never publish or sign, so only the outputs are rebuilt
+	rebuildArgs := append(append([]string{}, manifest.Flags...), "-dest", folder)
+	if strings.Contains(manifest.Image, "@") {
+		rebuildArgs = append(rebuildArgs, "-image", manifest.Image)
+	}
+	rebuildArgs = append(rebuildArgs, manifest.Args...)
+
+	fmt.Printf("Rebuilding %s...\n", path)
+	cmd := exec.CommandContext(ctx, self, rebuildArgs...)
+	cmd.Dir = manifest.Dir
+	if manifest.SourceDateEpoch != 0 {
+		// Pin the rebuild to the original timestamp, which may have been overridden
+		cmd.Env = append(os.Environ(), fmt.Sprintf("SOURCE_DATE_EPOCH=%d", manifest.SourceDateEpoch))
+	}
+	if err := run(cmd); err != nil {
+		return fmt.Errorf("rebuild failed: %w", err)
+	}
+	rebuilt, err := readManifest(filepath.Join(folder, manifestFile))
+	if err != nil {
+		return err
+	}
+	return compareManifests(manifest, rebuilt)
+}
+
+// compareManifests reports, per target, whether the rebuild produced the same
+// outputs as the original build, failing if any of them differ.
+func compareManifests(original, rebuilt *Manifest) error {
+	key := func(artifact ManifestArtifact) string {
+		if artifact.Package == "" {
+			return artifact.Target
+		}
+		return artifact.Target + " (" + artifact.Package + ")"
+	}
+	sums := make(map[string]string)
+	for _, artifact := range rebuilt.Artifacts {
+		sums[key(artifact)] = artifact.SHA256
+	}
+	var failed []string
+	for _, artifact := range original.Artifacts {
+		name := key(artifact)
+		sum, ok := sums[name]
+		delete(sums, name)
+
+		switch {
+		case !ok:
+			fmt.Printf("%s: missing from rebuild\n", name)
+			failed = append(failed, name)
+		case sum != artifact.SHA256:
+			fmt.Printf("%s: differs (%s, rebuilt %s)\n", name, artifact.SHA256, sum)
+			failed = append(failed, name)
+		default:
+			fmt.Printf("%s: reproducible\n", name)
+		}
+	}
+	extra := make([]string, 0, len(sums))
+	for name := range sums {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		fmt.Printf("%s: only produced by rebuild\n", name)
+		failed = append(failed, name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d outputs not reproducible: %s", len(failed), len(original.Artifacts)+len(extra), strings.Join(failed, ", "))
+	}
+	return nil
+}
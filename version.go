@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// gitInfo is the version control metadata of the local repository being built,
+// available to -ldflags and -out-template. All fields are empty if the sources
+// are not a git checkout (or git is unavailable).
+type gitInfo struct {
+	Version         string // Revision description (git describe --tags --always --dirty)
+	Tag             string // Most recent tag reachable from the commit, empty if none
+	Commit          string // Full commit hash
+	ShortCommit     string // Abbreviated commit hash
+	Dirty           bool   // Whether the working tree has uncommitted changes
+	CommitDate      string // Committer date in RFC 3339 format (UTC)
+	CommitTimestamp int64  // Committer date as Unix seconds
+	Remote          string // URL of the origin remote, empty if none
+}
+
+// readGitInfo gathers the version control metadata of the checkout in dir.
+func readGitInfo(dir string) gitInfo {
+	var info gitInfo
+
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if info.Commit = git("rev-parse", "HEAD"); info.Commit == "" {
+		return gitInfo{}
+	}
+	info.ShortCommit = git("rev-parse", "--short", "HEAD")
+	info.Version = git("describe", "--tags", "--always", "--dirty")
+	info.Tag = git("describe", "--tags", "--abbrev=0")
+	info.Dirty = git("status", "--porcelain", "--untracked-files=no") != ""
+	info.Remote = git("remote", "get-url", "origin")
+
+	if stamp, err := strconv.ParseInt(git("log", "-1", "--format=%ct"), 10, 64); err == nil {
+		info.CommitTimestamp = stamp
+		info.CommitDate = time.Unix(stamp, 0).UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+// stampLdFlags expands the -ldflags template for every target. If the result is
+// the same for all of them it replaces the global linker flags, otherwise each
+// target gets its rendered flags as an override, ahead of the user's own ones
+// so those still append to it. Flags without template actions are untouched.
+func stampLdFlags(config *ConfigFlags, flags *BuildFlags, git gitInfo) error {
+	if !strings.Contains(flags.LdFlags, "{{") {
+		return nil
+	}
+	tmpl, err := template.New("ldflags").Option("missingkey=error").Parse(flags.LdFlags)
+	if err != nil {
+		return fmt.Errorf("invalid ldflags template: %w", err)
+	}
+	// The linker flags are set per target, not per package, so the output name
+	// is only known when building a single one
+	name := ""
+	if names := outputNames(config); len(names) == 1 {
+		name = path.Base(names[0])
+	}
+	var (
+		overrides TargetOverrides
+		rendered  = make(map[string]bool)
+	)
+	for _, target := range resolveTargets(config.Targets) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, newTemplateFields(target, name, git, flags)); err != nil {
+			return fmt.Errorf("failed to render ldflags for %s: %w", describeTarget(target), err)
+		}
+		overrides = append(overrides, TargetOverride{Match: describeTarget(target), LdFlags: buf.String()})
+		rendered[buf.String()] = true
+	}
+	if len(rendered) == 1 {
+		flags.LdFlags = overrides[0].LdFlags
+		return nil
+	}
+	flags.LdFlags = ""
+	config.Overrides = append(overrides, config.Overrides...)
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+)
+
+// goWorkspace describes the Go workspace (go.work) a local module is part of.
+type goWorkspace struct {
+	File string   // Absolute path of the go.work file
+	Uses []string // Absolute paths of the workspace's use directories
+}
+
+// findWorkspace locates the go.work file governing the module in moduleDir the
+// same way the go tool does: an explicit GOWORK wins (with "off" disabling
+// workspaces), otherwise the module folder and its parents are searched. It
+// returns nil if the module is not built in workspace mode.
+func findWorkspace(moduleDir string) (*goWorkspace, error) {
+	file := os.Getenv("GOWORK")
+	switch {
+	case file == "off":
+		return nil, nil
+	case file != "":
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve GOWORK (%s): %w", file, err)
+		}
+		file = abs
+	default:
+		for dir := moduleDir; ; dir = filepath.Dir(dir) {
+			if stat, err := os.Stat(filepath.Join(dir, "go.work")); err == nil && !stat.IsDir() {
+				file = filepath.Join(dir, "go.work")
+				break
+			}
+			if parent := filepath.Dir(dir); len(parent) >= len(dir) {
+				return nil, nil
+			}
+		}
+	}
+	return parseWorkspace(file)
+}
+
+// parseWorkspace reads a go.work file and resolves its use directories.
+func parseWorkspace(file string) (*goWorkspace, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workspace file: %w", err)
+	}
+	work, err := modfile.ParseWork(file, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse workspace file: %w", err)
+	}
+	workspace := &goWorkspace{File: file}
+	for _, use := range work.Use {
+		dir := filepath.FromSlash(use.Path)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(file), dir)
+		}
+		workspace.Uses = append(workspace.Uses, filepath.Clean(dir))
+	}
+	return workspace, nil
+}
+
+// localReplacements returns the folders that local replace directives in the
+// given go.mod or go.work file point to. Relative paths are resolved against
+// the folder of the file; replacements with a module version are skipped.
+func localReplacements(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	var replaces []*modfile.Replace
+	if filepath.Base(file) == "go.mod" {
+		mod, err := modfile.Parse(file, data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+		replaces = mod.Replace
+	} else {
+		work, err := modfile.ParseWork(file, data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+		replaces = work.Replace
+	}
+	var dirs []string
+	for _, replace := range replaces {
+		if replace.New.Version != "" || !modfile.IsDirectoryPath(replace.New.Path) {
+			continue
+		}
+		dir := filepath.FromSlash(replace.New.Path)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(file), dir)
+		}
+		dirs = append(dirs, filepath.Clean(dir))
+	}
+	return dirs, nil
+}
@@ -9,12 +9,12 @@ package main // import "src.techknowlogick.com/xgo"
 
 import (
 	"context"
+	"crypto"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go/build"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -23,6 +23,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Path where to cache external dependencies
@@ -49,37 +50,87 @@ var (
 // Command line arguments to fine tune the compilation
 var (
 	goVersion   = flag.String("go", "latest", "Go release to use for cross compilation")
-	srcPackage  = flag.String("pkg", "", "Sub-package to build if not root import")
+	srcPackage  = flag.String("pkg", "", "Comma separated sub-packages to build if not root import (./cmd/... selects every main package)")
 	srcRemote   = flag.String("remote", "", "Version control remote repository to build")
 	srcBranch   = flag.String("branch", "", "Version control branch to build")
 	outPrefix   = flag.String("out", "", "Prefix to use for output naming (empty = package name)")
+	outTemplate = flag.String("out-template", "", "Template to use for output naming (e.g. {{.Name}}_{{.OS}}_{{.Arch}}{{.Ext}})")
 	outFolder   = flag.String("dest", "", "Destination folder to put binaries in (created if missing, empty = current)")
 	crossDeps   = flag.String("deps", "", "CGO dependencies (configure/make based archives)")
 	crossArgs   = flag.String("depsargs", "", "CGO dependency configure arguments")
+	depsFile    = flag.String("deps-file", "", "YAML manifest of the CGO dependencies to build in dependency order (e.g. xgo-deps.yaml)")
 	targets     = flag.String("targets", "*/*", "Comma separated targets to build for")
 	dockerImage = flag.String("image", "", "Use custom docker image instead of official distribution")
 	dockerEnv   = flag.String("env", "", "Comma separated custom environments added to docker run -e")
+	envPass     = flag.String("env-pass", "", "Comma separated patterns of extra host environment variables to forward (e.g. MYAPP_*)")
+	envSkip     = flag.String("env-skip", "", "Comma separated patterns of Go environment variables not to forward from the host")
 	dockerArgs  = flag.String("dockerargs", "", "Comma separated arguments added to docker run")
 	volumes     = flag.String("volumes", "", "Comma separated list of volume mounts in format source:target[:mode]")
 	hooksDir    = flag.String("hooksdir", "", "Directory with user hook scripts (setup.sh, build.sh)")
 	forwardSsh  = flag.Bool("ssh", false, "Enable ssh agent forwarding")
 	runtimeFlag = flag.String("runtime", "auto", "Container runtime to use (auto, docker, podman, apple)")
+	configFile  = flag.String("config", "", "YAML configuration file with additional build settings")
+	sbomFormat  = flag.String("sbom", "", "SBOM format to write next to every artifact (spdx, cyclonedx)")
+	provenance  = flag.Bool("provenance", false, "Write an in-toto SLSA provenance attestation for the artifacts")
+	signingKey  = flag.String("provenance-key", "", "PEM private key to sign the provenance attestation with (implies -provenance)")
+	maxGlibc    = flag.String("max-glibc", "", "Highest glibc version Linux artifacts may require (e.g. 2.17)")
+	universal   = flag.Bool("universal-darwin", false, "Merge the darwin amd64 and arm64 outputs into a universal binary")
+	signWindows = flag.String("sign-windows", "", "PKCS#12 certificate to Authenticode sign the Windows outputs with")
+	signPass    = flag.String("sign-windows-pass", "", "Password of the signing certificate (env:NAME or file:PATH)")
+	signDarwin  = flag.String("sign-darwin", "", "Code sign the macOS outputs ad-hoc (adhoc) or with a PKCS#12 certificate")
+	darwinPass  = flag.String("sign-darwin-pass", "", "Password of the macOS signing certificate (env:NAME or file:PATH)")
+	linuxPkgs   = flag.String("linux-packages", "", "Comma separated distribution packages to build from the Linux outputs (deb, rpm, apk)")
+	ociLayout   = flag.String("oci-layout", "", "Folder to write a multi-arch OCI image layout of the Linux outputs into")
+	ociBase     = flag.String("oci-base", "", "Tarball to use as the base layer of the OCI images")
+	ociPush     = flag.String("oci-push", "", "Registry reference to push the OCI image layout to (e.g. ghcr.io/org/app:v1)")
+	pushOutputs = flag.String("push-artifacts", "", "Registry reference to push the outputs to as an OCI artifact (e.g. ghcr.io/org/app-bin:v1)")
+	uploadURL   = flag.String("upload", "", "S3 location to upload the outputs, checksums and manifest to (e.g. s3://bucket/releases/{{.Version}}/)")
+	uploadHost  = flag.String("upload-endpoint", "", "Endpoint of S3-compatible storage to upload to (e.g. http://localhost:9000 for MinIO)")
+	timestamp   = flag.String("timestamp-url", "", "RFC 3161 timestamp server to countersign Windows and macOS signatures with")
+	targetEnv   stringList
 )
 
+func init() {
+	flag.Var(&targetEnv, "target-env", "Per-target environment in format GLOB:NAME=VALUE (repeatable, e.g. windows/*:CGO_LDFLAGS=-lws2_32)")
+}
+
 // ConfigFlags is a simple set of flags to define the environment and dependencies.
 type ConfigFlags struct {
 	Repository   string   // Root import path to build
-	Package      string   // Sub-package to build if not root import
+	Packages     []string // Sub-packages to build if not root import
 	Prefix       string   // Prefix to use for output naming
+	Template     string   // Template to use for output naming
 	Remote       string   // Version control remote repository to build
 	Branch       string   // Version control branch to build
 	Dependencies string   // CGO dependencies (configure/make based archives)
 	Arguments    string   // CGO dependency configure arguments
+	DepsManifest string   // Dependency manifest in build order, JSON encoded for build.sh
 	Targets      []string // Targets to build for
 	DockerEnv    []string // Custom environments added to docker run -e
+	EnvPass      []string // Patterns of extra host environment variables to forward
+	EnvSkip      []string // Patterns of Go environment variables not to forward
 	DockerArgs   []string // Custom options added to docker run
 	Volumes      []string // Volume mounts for docker run -v
 	ForwardSsh   bool     // Enable ssh agent forwarding
+	SBOM         string   // SBOM format to write next to every artifact
+	Provenance   bool     // Write an in-toto SLSA provenance attestation
+	MaxGlibc     string   // Highest glibc version Linux artifacts may require
+	Universal    bool     // Merge the darwin amd64 and arm64 outputs into a universal binary
+	SignWindows  string   // PKCS#12 certificate to Authenticode sign the Windows outputs with
+	SignDarwin   string   // Code sign the macOS outputs ad-hoc (adhoc) or with a PKCS#12 certificate
+	TimestampURL string   // RFC 3161 timestamp server to countersign Windows and macOS signatures with
+	PackageTypes []string // Distribution packages to build from the Linux outputs
+	OCILayout    string   // Folder to write a multi-arch OCI image layout into
+	OCIBase      string   // Tarball to use as the base layer of the OCI images
+	OCIPush      string   // Registry reference to push the OCI image layout to
+	PushOutputs  string   // Registry reference to push the outputs to as an OCI artifact
+	Upload       string   // S3 location to upload the outputs, checksums and manifest to
+	UploadHost   string   // Endpoint of S3-compatible storage to upload to
+
+	Overrides TargetOverrides   // Per-target environment and build flag overrides
+	Libraries *LibraryPolicy    // Allowed shared libraries, nil if not configured
+	Resources *WindowsResources // Resources embedded into Windows outputs, nil if not configured
+	Packaging *LinuxPackages    // Distribution packages description, nil if not configured
 }
 
 // Command line arguments to pass to go build
@@ -88,13 +139,14 @@ var (
 	buildSteps    = flag.Bool("x", false, "Print the command as executing the builds")
 	buildRace     = flag.Bool("race", false, "Enable data race detection (supported only on amd64)")
 	buildTags     = flag.String("tags", "", "List of build tags to consider satisfied during the build")
-	buildLdFlags  = flag.String("ldflags", "", "Arguments to pass on each go tool link invocation")
+	buildLdFlags  = flag.String("ldflags", "", "Arguments to pass on each go tool link invocation (may use {{.Version}} style templates)")
 	buildGcFlags  = flag.String("gcflags", "", "Arguments to pass on each go tool compile invocation")
 	buildMode     = flag.String("buildmode", "default", "Indicates which kind of object file to build")
 	buildTrimpath = flag.Bool("trimpath", false, "Indicates if trimpath should be applied to build")
 	buildBuildVCS = flag.Bool("buildvcs", true, "Whether to stamp binaries with version control information")
 	obfuscate     = flag.Bool("obfuscate", false, "Obfuscate build using garble")
 	garbleFlags   = flag.String("garbleflags", "", "Arguments to pass to garble (e.g. -seed=random)")
+	reproducible  = flag.Bool("reproducible", false, "Build bit-for-bit reproducible binaries and write a manifest for xgo verify")
 )
 
 // BuildFlags is a simple collection of flags to fine tune a build.
@@ -110,6 +162,9 @@ type BuildFlags struct {
 	BuildVCS    bool   // Whether to stamp binaries with version control information
 	Obfuscate   bool   // Obfuscate build using garble
 	GarbleFlags string // Arguments to pass to garble
+
+	Reproducible    bool  // Pin paths, build IDs and timestamps for reproducible output
+	SourceDateEpoch int64 // Timestamp to build with (SOURCE_DATE_EPOCH), zero if unset
 }
 
 func prepareOutputFolder(dest string) (string, error) {
@@ -143,20 +198,52 @@ func prepareOutputFolder(dest string) (string, error) {
 	return folder, nil
 }
 
-func main() {
-	// Retrieve the CLI flags and the execution environment
-	flag.Parse()
+// subcommand is a command xgo runs instead of a build.
+type subcommand struct {
+	run     func(ctx context.Context, args []string) error
+	failure string // Message prefixing the error if the command fails
+}
+
+// subcommands are the commands xgo runs if one is named as its very first
+// argument, before any flag. The names are reserved there, a repository folder
+// of the same name is built by passing its path (e.g. ./verify) instead.
+var subcommands = map[string]subcommand{
+	// Rebuild and compare a reproducible build
+	"verify": {verifyBuild, "Verification failed"},
+
+	// Extract the CGO dependency archives, called by the build script
+	"unpack": {func(_ context.Context, args []string) error { return unpackDependencies(args) }, "Failed to unpack dependencies"},
 
+	// Generate the CMake and Meson cross files, called by the dependency builder
+	"cross-files": {func(_ context.Context, args []string) error { return writeCrossFiles(args) }, "Failed to generate cross files"},
+
+	// List the dependencies to build for a target, called by the dependency builder
+	"deps-plan": {func(_ context.Context, args []string) error { return planDependencies(args) }, "Failed to plan dependency builds"},
+}
+
+func main() {
 	// Cancel all container operations on Ctrl-C (SIGINT/SIGTERM).
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
+	// Run a subcommand instead of a build if one was requested
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd.run(ctx, os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v.", cmd.failure, err)
+			}
+			return
+		}
+	}
+	// Retrieve the CLI flags and the execution environment
+	flag.Parse()
+
 	xgoInXgo := os.Getenv("XGO_IN_XGO") == "1"
 	if xgoInXgo {
 		depsCache = "/deps-cache"
 	}
 	// Only use docker images if we're not already inside out own image
-	image := ""
+	image, imageDigest := "", ""
 
 	var rt ContainerRuntime
 	if !xgoInXgo {
@@ -170,7 +257,7 @@ func main() {
 		fmt.Printf("Using container runtime: %s\n\n", name)
 		// Validate the command line arguments
 		if len(flag.Args()) != 1 {
-			log.Fatalf("Usage: %s [options] <go import path>", os.Args[0])
+			log.Fatalf("Usage: %s [options] <go import path> or %s verify [manifest]", os.Args[0], os.Args[0])
 		}
 		// Select the image to use, either official or custom
 		image = dockerDist + *goVersion
@@ -192,6 +279,31 @@ func main() {
 		default:
 			fmt.Println("found.")
 		}
+		// Pin the exact image for reproducible builds to be rebuilt with, and
+		// for the SBOMs and provenance to name as build tool
+		if *reproducible || *sbomFormat != "" || *provenance || *signingKey != "" {
+			if imageDigest, err = rt.ImageDigest(ctx, image); err != nil {
+				log.Fatalf("Failed to resolve docker image digest: %v.", err)
+			}
+		}
+	}
+	// Order the dependencies of the manifest, which are then fetched like -deps
+	var (
+		deps     []Dependency
+		manifest = make(map[string]Dependency)
+	)
+	if *depsFile != "" {
+		if *crossDeps != "" || *crossArgs != "" {
+			log.Fatalf("Dependency manifest cannot be combined with -deps or -depsargs.")
+		}
+		var err error
+		if deps, err = loadDepsManifest(*depsFile); err != nil {
+			log.Fatalf("%v.", err)
+		}
+		for _, dep := range deps {
+			manifest[dep.URL] = dep
+		}
+		*crossDeps = dependencyURLs(deps)
 	}
 	// Cache all external dependencies to prevent always hitting the internet
 	if *crossDeps != "" {
@@ -203,45 +315,158 @@ func main() {
 			if url := strings.TrimSpace(dep); len(url) > 0 {
 				path := filepath.Join(depsCache, filepath.Base(url))
 
+				// Download cached archives again if the manifest expects another one
+				if err := checkDependencySum(path, manifest[url]); err != nil && !os.IsNotExist(err) {
+					fmt.Printf("Cached dependency %s is outdated (%v).\n", path, err)
+					os.Remove(path)
+				}
 				if _, err := os.Stat(path); err != nil {
 					fmt.Printf("Downloading new dependency: %s...\n", url)
-
-					out, err := os.Create(path)
-					if err != nil {
-						log.Fatalf("Failed to create dependency file: %v.", err)
-					}
-					res, err := http.Get(url)
-					if err != nil {
-						log.Fatalf("Failed to retrieve dependency: %v.", err)
+					if err := downloadDependency(url, path); err != nil {
+						log.Fatalf("Failed to download dependency %s: %v.", url, err)
 					}
-					defer res.Body.Close()
-
-					if _, err := io.Copy(out, res.Body); err != nil {
-						log.Fatalf("Failed to download dependency: %v", err)
-					}
-					out.Close()
-
 					fmt.Printf("New dependency cached: %s.\n", path)
 				} else {
 					fmt.Printf("Dependency already cached: %s.\n", path)
 				}
+				// Drop unusable archives from the cache, so the next run fetches them again
+				if err := checkDependency(path); err != nil {
+					os.Remove(path)
+					log.Fatalf("Unsupported dependency %s: %v.", url, err)
+				}
+				if err := checkDependencySum(path, manifest[url]); err != nil {
+					os.Remove(path)
+					log.Fatalf("Corrupt dependency %s: %v.", url, err)
+				}
 			}
 		}
 	}
 	// Assemble the cross compilation environment and build options
 	config := &ConfigFlags{
 		Repository:   flag.Args()[0],
-		Package:      *srcPackage,
+		Packages:     splitPackages(*srcPackage),
 		Remote:       *srcRemote,
 		Branch:       *srcBranch,
 		Prefix:       *outPrefix,
+		Template:     *outTemplate,
 		Dependencies: *crossDeps,
 		Arguments:    *crossArgs,
 		Targets:      strings.Split(*targets, ","),
 		DockerEnv:    strings.Split(*dockerEnv, ","),
+		EnvPass:      strings.Split(*envPass, ","),
+		EnvSkip:      strings.Split(*envSkip, ","),
 		DockerArgs:   strings.Split(*dockerArgs, ","),
 		Volumes:      strings.Split(*volumes, ","),
 		ForwardSsh:   *forwardSsh,
+		SBOM:         *sbomFormat,
+		Provenance:   *provenance || *signingKey != "",
+		MaxGlibc:     *maxGlibc,
+		Universal:    *universal,
+		SignWindows:  *signWindows,
+		SignDarwin:   *signDarwin,
+		TimestampURL: *timestamp,
+		OCILayout:    *ociLayout,
+		OCIBase:      *ociBase,
+		OCIPush:      *ociPush,
+		PushOutputs:  *pushOutputs,
+		Upload:       *uploadURL,
+		UploadHost:   *uploadHost,
+	}
+	if deps != nil {
+		data, err := json.Marshal(deps)
+		if err != nil {
+			log.Fatalf("Failed to encode dependency manifest: %v.", err)
+		}
+		config.DepsManifest = string(data)
+	}
+	if _, ok := sbomFormats[config.SBOM]; config.SBOM != "" && !ok {
+		log.Fatalf("Unsupported SBOM format (%s), expected spdx or cyclonedx.", config.SBOM)
+	}
+	if _, err := parseVersion(config.MaxGlibc); config.MaxGlibc != "" && err != nil {
+		log.Fatalf("Invalid glibc ceiling: %v.", err)
+	}
+	fileConfig, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("%v.", err)
+	}
+	var key crypto.Signer
+	if *signingKey != "" {
+		if key, err = loadSigningKey(*signingKey); err != nil {
+			log.Fatalf("%v.", err)
+		}
+	}
+	// Certificate signatures embed signing and timestamp times, and ECDSA ones
+	// are randomized, so signed outputs can never be rebuilt bit-for-bit
+	if *reproducible && (config.SignWindows != "" || (config.SignDarwin != "" && config.SignDarwin != adhocSigning)) {
+		log.Fatalf("Certificate signing can't be combined with -reproducible, only -sign-darwin adhoc can.")
+	}
+	var signer, darwinSigner *codeSigner
+	if config.SignWindows != "" {
+		password, err := readPassword(*signPass)
+		if err != nil {
+			log.Fatalf("Failed to read signing certificate password: %v.", err)
+		}
+		if signer, err = loadCodeSigner(config.SignWindows, password); err != nil {
+			log.Fatalf("%v.", err)
+		}
+	}
+	if config.SignDarwin != "" && config.SignDarwin != adhocSigning {
+		password, err := readPassword(*darwinPass)
+		if err != nil {
+			log.Fatalf("Failed to read macOS signing certificate password: %v.", err)
+		}
+		if darwinSigner, err = loadCodeSigner(config.SignDarwin, password); err != nil {
+			log.Fatalf("%v.", err)
+		}
+	}
+	if config.TimestampURL != "" && signer == nil && darwinSigner == nil {
+		log.Fatalf("Timestamping requires a signing certificate (-sign-windows or -sign-darwin).")
+	}
+	config.Overrides = fileConfig.Targets
+	config.Libraries = fileConfig.Libraries
+	if config.Resources = fileConfig.Windows; config.Resources != nil {
+		config.Resources.resolve(filepath.Dir(*configFile))
+	}
+	if config.PackageTypes, err = parsePackageFormats(*linuxPkgs); err != nil {
+		log.Fatalf("%v.", err)
+	}
+	if config.Packaging = fileConfig.Packages; config.Packaging != nil {
+		config.Packaging.resolve(filepath.Dir(*configFile))
+		if err := config.Packaging.validate(); err != nil {
+			log.Fatalf("Invalid package configuration: %v.", err)
+		}
+	} else if len(config.PackageTypes) > 0 {
+		log.Fatalf("Linux packages need a packages section in the -config file.")
+	}
+	var (
+		baseLayer *ociLayer
+		registry  *registryClient
+		publisher *registryClient
+	)
+	if config.OCILayout == "" && (config.OCIBase != "" || config.OCIPush != "") {
+		log.Fatalf("OCI image options (-oci-base, -oci-push) need an -oci-layout folder.")
+	}
+	if config.OCIBase != "" {
+		if baseLayer, err = readBaseLayer(config.OCIBase); err != nil {
+			log.Fatalf("%v.", err)
+		}
+	}
+	if config.OCIPush != "" {
+		if registry, err = newRegistryClient(config.OCIPush); err != nil {
+			log.Fatalf("%v.", err)
+		}
+	}
+	if config.PushOutputs != "" {
+		if publisher, err = newRegistryClient(config.PushOutputs); err != nil {
+			log.Fatalf("%v.", err)
+		}
+	}
+	for _, value := range targetEnv {
+		override, err := parseTargetEnv(value)
+		if err != nil {
+			log.Fatalf("%v.", err)
+		}
+		config.Overrides = append(config.Overrides, override)
 	}
 	flags := &BuildFlags{
 		Verbose:     *buildVerbose,
@@ -255,6 +480,78 @@ func main() {
 		BuildVCS:    *buildBuildVCS,
 		Obfuscate:   *obfuscate,
 		GarbleFlags: *garbleFlags,
+
+		Reproducible: *reproducible,
+	}
+	if config.Universal && (flags.Mode == "archive" || flags.Mode == "c-archive") {
+		log.Fatalf("Universal binaries can't be created from %s outputs.", flags.Mode)
+	}
+	if len(config.PackageTypes) > 0 && flags.Mode != "default" && flags.Mode != "exe" && flags.Mode != "pie" {
+		log.Fatalf("Linux packages can't be created from %s outputs.", flags.Mode)
+	}
+	if config.OCILayout != "" && flags.Mode != "default" && flags.Mode != "exe" && flags.Mode != "pie" {
+		log.Fatalf("OCI images can't be created from %s outputs.", flags.Mode)
+	}
+	// Expand package patterns and make sure the outputs won't overwrite each other
+	if isLocalRepository(config.Repository) {
+		packages, err := expandPackages(config.Repository, config.Packages)
+		if err != nil {
+			log.Fatalf("Failed to resolve packages: %v.", err)
+		}
+		config.Packages = packages
+	} else {
+		for _, pack := range config.Packages {
+			if pack == "..." || strings.HasSuffix(pack, "/...") {
+				log.Fatalf("Package patterns (%s) are only supported for local repositories.", pack)
+			}
+		}
+	}
+	names := []string{"name"}
+	if len(config.Packages) > 1 {
+		if config.Prefix != "" {
+			log.Fatalf("Output prefix (-out) cannot be used when building multiple packages, use -out-template instead.")
+		}
+		names = packageNames(config.Repository, config.Packages)
+	}
+	// Gather the version control metadata for stamping the binaries and outputs
+	var git gitInfo
+	if isLocalRepository(config.Repository) {
+		git = readGitInfo(config.Repository)
+	}
+	var (
+		uploader     *s3Client
+		uploadPrefix string
+	)
+	if config.Upload != "" {
+		bucket, prefix, err := renderUploadURL(config.Upload, git)
+		if err != nil {
+			log.Fatalf("%v.", err)
+		}
+		if uploader, err = newS3Client(bucket, config.UploadHost); err != nil {
+			log.Fatalf("%v.", err)
+		}
+		uploadPrefix = prefix
+	}
+	outputTargets := resolveTargets(config.Targets)
+	if config.Universal {
+		outputTargets = append(outputTargets, universalTargets(outputTargets)...)
+	}
+	if err := validateOutputs(config.Template, names, git, outputTargets, flags); err != nil {
+		log.Fatalf("Invalid output naming: %v.", err)
+	}
+	if err := stampLdFlags(config, flags, git); err != nil {
+		log.Fatalf("Invalid linker flags: %v.", err)
+	}
+	// Strip everything that varies between otherwise identical builds
+	if flags.Reproducible {
+		flags.Trimpath = true
+		flags.LdFlags = joinNonEmpty([]string{flags.LdFlags, "-buildid="})
+		flags.SourceDateEpoch = git.CommitTimestamp
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			if flags.SourceDateEpoch, err = strconv.ParseInt(epoch, 10, 64); err != nil {
+				log.Fatalf("Invalid SOURCE_DATE_EPOCH (%s): %v.", epoch, err)
+			}
+		}
 	}
 	folder, err := prepareOutputFolder(*outFolder)
 	if err != nil {
@@ -272,15 +569,182 @@ func main() {
 		}
 		config.DockerArgs = append(config.DockerArgs, "--mount", fmt.Sprintf(`type=bind,source=%s,target=/hooksdir`, dir))
 	}
+	// Generate the Windows resource objects, they are removed once built
+	var resources []string
+	if config.Resources != nil {
+		if !isLocalRepository(config.Repository) {
+			log.Fatalf("Windows resources are only supported for local repositories.")
+		}
+		var dirs []string
+		for _, pack := range config.Packages {
+			dirs = append(dirs, filepath.Join(config.Repository, filepath.FromSlash(pack)))
+		}
+		if len(dirs) == 0 {
+			dirs = []string{config.Repository}
+		}
+		if resources, err = writeResourceObjects(config.Resources, dirs, resolveTargets(config.Targets), git, flags.Mode); err != nil {
+			log.Fatalf("Failed to generate Windows resources: %v.", err)
+		}
+	}
+	// Record the invocation as given, compile rewrites local module paths
+	parameters := newProvenanceParameters(config, flags)
+
 	// Execute the cross compilation, either in a container or the current system
+	started := time.Now()
 	if !xgoInXgo {
 		err = compile(ctx, rt, image, config, flags, folder)
 	} else {
 		err = compileContained(config, flags, folder)
 	}
+	removeFiles(resources)
 	if err != nil {
 		log.Fatalf("Failed to cross compile package: %v.", err)
 	}
+	// Locate the produced binaries and move them to their final names
+	if xgoInXgo {
+		// The build script always writes to /build inside the image
+		folder = "/build"
+	}
+	artifacts, err := collectArtifacts(folder, git, config, flags)
+	if err != nil {
+		log.Fatalf("Failed to collect build outputs: %v.", err)
+	}
+	// Make sure every output really was built for the target its name claims
+	if err := checkArtifacts(artifacts, flags.Mode); err != nil {
+		log.Fatalf("Build outputs failed sanity checks: %v", err)
+	}
+	// Report the shared libraries each output depends on
+	if err := inspectLibraries(artifacts, config.Libraries, flags.Mode); err != nil {
+		log.Fatalf("%v.", err)
+	}
+	if config.Libraries != nil && config.Libraries.Enforce {
+		if err := libraryViolations(artifacts); err != nil {
+			log.Fatalf("Build outputs failed library checks: %v", err)
+		}
+	}
+	// Report the glibc symbol versions each Linux output needs
+	if err := checkGlibc(artifacts, config.MaxGlibc, flags.Mode); err != nil {
+		log.Fatalf("Build outputs failed glibc checks: %v", err)
+	}
+	// Code sign the macOS outputs if requested, before merging the slices
+	if config.SignDarwin != "" {
+		if err := signDarwinArtifacts(ctx, artifacts, darwinSigner, config.TimestampURL, flags.Mode); err != nil {
+			log.Fatalf("Failed to sign macOS outputs: %v.", err)
+		}
+	}
+	// Merge the macOS outputs into universal binaries if requested
+	if config.Universal {
+		merged, err := mergeUniversal(folder, artifacts, git, config, flags)
+		if err != nil {
+			log.Fatalf("Failed to merge universal binaries: %v.", err)
+		}
+		artifacts = append(artifacts, merged...)
+	}
+	if config.SignDarwin != "" {
+		if err := verifyDarwinSignatures(artifacts, flags.Mode); err != nil {
+			log.Fatalf("Build outputs failed signature checks: %v", err)
+		}
+	}
+	// Authenticode sign the Windows outputs if requested, and verify the result
+	if signer != nil {
+		if err := signWindowsArtifacts(ctx, artifacts, signer, config.TimestampURL, flags.Mode); err != nil {
+			log.Fatalf("Failed to sign Windows outputs: %v.", err)
+		}
+		if err := verifyWindowsSignatures(artifacts, flags.Mode); err != nil {
+			log.Fatalf("Build outputs failed signature checks: %v", err)
+		}
+	}
+	// Package the Linux outputs for their distributions if requested
+	var packages, sboms []string
+	if len(config.PackageTypes) > 0 {
+		if packages, err = buildLinuxPackages(folder, artifacts, git, config, flags); err != nil {
+			log.Fatalf("Failed to build Linux packages: %v.", err)
+		}
+	}
+	// Assemble the Linux outputs into a multi-arch image if requested, pushing
+	// it straight to a registry without going through docker build
+	if config.OCILayout != "" {
+		tag := "latest"
+		if registry != nil {
+			tag = registry.tag
+		}
+		image, err := writeOCILayout(config.OCILayout, tag, baseLayer, artifacts, git, config, flags)
+		if err != nil {
+			log.Fatalf("Failed to write OCI image layout: %v.", err)
+		}
+		if registry != nil {
+			if err := pushOCIImage(ctx, config.OCILayout, registry, image); err != nil {
+				log.Fatalf("Failed to push OCI image: %v.", err)
+			}
+		}
+	}
+	// Publish the outputs to a registry if requested
+	if publisher != nil {
+		if err := pushArtifacts(ctx, folder, publisher, artifacts, git, flags); err != nil {
+			log.Fatalf("Failed to push artifacts: %v.", err)
+		}
+	}
+	// Document the contents of every artifact if requested
+	if config.SBOM != "" {
+		if sboms, err = writeSBOMs(config.SBOM, artifacts, config, flags, imageDigest); err != nil {
+			log.Fatalf("Failed to generate SBOMs: %v.", err)
+		}
+	}
+	// Attest where the artifacts came from if requested
+	if config.Provenance {
+		statement, err := newProvenance(folder, artifacts, parameters, config, git, imageDigest, started)
+		if err != nil {
+			log.Fatalf("Failed to assemble provenance: %v.", err)
+		}
+		if err := writeProvenance(folder, statement, key); err != nil {
+			log.Fatalf("%v.", err)
+		}
+	}
+	// Record the build for later verification if it's meant to be reproducible,
+	// for auditing its shared libraries if a policy is configured, or to
+	// describe the upload
+	if flags.Reproducible || config.Libraries != nil || uploader != nil {
+		dir, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("Failed to retrieve the working directory: %v.", err)
+		}
+		manifest := &Manifest{
+			Dir:             dir,
+			Flags:           recordedFlags(os.Args[1 : len(os.Args)-flag.NArg()]),
+			Reproducible:    flags.Reproducible,
+			Args:            flag.Args(),
+			Image:           imageDigest,
+			Commit:          git.Commit,
+			Dirty:           git.Dirty,
+			SourceDateEpoch: flags.SourceDateEpoch,
+		}
+		if manifest.Artifacts, err = newManifestArtifacts(folder, artifacts); err != nil {
+			log.Fatalf("Failed to hash build outputs: %v.", err)
+		}
+		if err := writeManifest(folder, manifest); err != nil {
+			log.Fatalf("%v.", err)
+		}
+	}
+	// Upload the outputs along with their checksums and build records if requested
+	if uploader != nil {
+		var outputs, records []string
+		for _, artifact := range artifacts {
+			outputs = append(outputs, artifact.Path)
+			if artifact.Header != "" {
+				outputs = append(outputs, artifact.Header)
+			}
+		}
+		outputs = append(outputs, packages...)
+
+		records = append(records, sboms...)
+		if config.Provenance {
+			records = append(records, filepath.Join(folder, provenanceFile))
+		}
+		records = append(records, filepath.Join(folder, manifestFile))
+		if err := uploadOutputs(ctx, uploader, uploadPrefix, folder, outputs, records); err != nil {
+			log.Fatalf("Failed to upload outputs: %v.", err)
+		}
+	}
 }
 
 // compile cross builds a requested package according to the given build specs
@@ -288,8 +752,7 @@ func main() {
 func compile(ctx context.Context, rt ContainerRuntime, image string, config *ConfigFlags, flags *BuildFlags, folder string) error {
 	// We need to consider our module-aware status
 	go111module := os.Getenv("GO111MODULE")
-	localBuild := strings.HasPrefix(filepath.FromSlash(config.Repository), string(filepath.Separator)) || strings.HasPrefix(config.Repository, ".") || filepath.IsAbs(config.Repository)
-	if !localBuild {
+	if !isLocalRepository(config.Repository) {
 		fmt.Printf("Cross compiling non-local repository: %s...\n", config.Repository)
 		opts := toRunOptions(image, config, flags, folder)
 		if go111module == "" {
@@ -331,10 +794,12 @@ func compile(ctx context.Context, rt ContainerRuntime, image string, config *Con
 
 				if usesModules {
 					sourcePath, _ := filepath.Rel(goModDir, absRepository)
-					if config.Package == "" {
-						config.Package = sourcePath
+					if len(config.Packages) == 0 {
+						config.Packages = []string{sourcePath}
 					} else {
-						config.Package = filepath.Join(sourcePath, config.Package)
+						for i, pack := range config.Packages {
+							config.Packages[i] = filepath.Join(sourcePath, pack)
+						}
 					}
 
 					config.Repository = goModDir
@@ -352,8 +817,9 @@ func compile(ctx context.Context, rt ContainerRuntime, image string, config *Con
 	}
 
 	// Assemble and run the cross compilation command
-	fmt.Printf("Cross compiling local repository: %s : %s...\n", config.Repository, config.Package)
+	fmt.Printf("Cross compiling local repository: %s : %s...\n", config.Repository, strings.Join(config.Packages, ", "))
 	opts := toRunOptions(image, config, flags, folder)
+	repository := config.Repository
 
 	if usesModules {
 		opts.Env = append(opts.Env, "GO111MODULE=on")
@@ -365,16 +831,37 @@ func compile(ctx context.Context, rt ContainerRuntime, image string, config *Con
 
 		fmt.Printf("Enabled Go module support\n")
 
-		// Map this repository to the /source folder
 		absRepository, err := filepath.Abs(config.Repository)
 		if err != nil {
 			log.Fatalf("Failed to locate requested module repository: %v.", err)
 		}
+		// The build script names root packages after this, as packageNames does
+		repository = absRepository
 
-		opts.Binds = append(opts.Binds, toDockerPath(absRepository)+":/source")
+		// Map this repository to the /source folder, along with the rest of the
+		// workspace if the module is part of one and any local replacements
+		layout, workspace, err := resolveSourceLayout(absRepository)
+		if err != nil {
+			log.Fatalf("Failed to resolve module layout: %v.", err)
+		}
+		opts.Binds = append(opts.Binds, layout.binds()...)
+		if sourcePath := layout.sourcePath(); sourcePath != "." {
+			opts.Env = append(opts.Env, "SOURCE_PATH="+sourcePath)
+		}
+		vendorRoot := absRepository
+		if workspace != nil {
+			opts.Env = append(opts.Env, "GOWORK="+layout.containerPath(workspace.File))
+			vendorRoot = filepath.Dir(workspace.File)
+			fmt.Printf("Enabled Go workspace support (%s)\n", workspace.File)
+		} else if os.Getenv("GOWORK") == "off" {
+			opts.Env = append(opts.Env, "GOWORK=off")
+		}
+		for _, dir := range layout.ReadOnly {
+			fmt.Printf("Mounting local replacement %s\n", dir)
+		}
 
 		// Check if there is a vendor folder, and if so, use it
-		vendorPath := filepath.Join(absRepository, "vendor")
+		vendorPath := filepath.Join(vendorRoot, "vendor")
 		vendorfolder, err := os.Stat(vendorPath)
 		if err == nil && vendorfolder.Mode().IsDir() {
 			opts.Env = append(opts.Env, "FLAG_MOD=vendor")
@@ -388,11 +875,17 @@ func compile(ctx context.Context, rt ContainerRuntime, image string, config *Con
 		opts.Env = append(opts.Env, env...)
 	}
 
-	opts.Cmd = []string{config.Repository}
+	opts.Cmd = []string{repository}
 
 	return rt.RunContainer(ctx, opts)
 }
 
+// isLocalRepository reports whether the repository to build was given as a
+// local file system path rather than an import path.
+func isLocalRepository(repo string) bool {
+	return strings.HasPrefix(filepath.FromSlash(repo), string(filepath.Separator)) || strings.HasPrefix(repo, ".") || filepath.IsAbs(repo)
+}
+
 // toRunOptions builds a RunOptions from config, flags and folder.
 func toRunOptions(image string, config *ConfigFlags, flags *BuildFlags, folder string) RunOptions {
 	gocache := filepath.Join(depsCache, "gocache")
@@ -410,9 +903,10 @@ func toRunOptions(image string, config *ConfigFlags, flags *BuildFlags, folder s
 		Env: []string{
 			"REPO_REMOTE=" + config.Remote,
 			"REPO_BRANCH=" + config.Branch,
-			"PACK=" + filepath.ToSlash(config.Package),
+			"PACK=" + packEnv(config.Packages),
 			"DEPS=" + config.Dependencies,
 			"ARGS=" + config.Arguments,
+			"DEPS_MANIFEST=" + config.DepsManifest,
 			"OUT=" + config.Prefix,
 			fmt.Sprintf("FLAG_V=%v", flags.Verbose),
 			fmt.Sprintf("FLAG_X=%v", flags.Steps),
@@ -425,12 +919,17 @@ func toRunOptions(image string, config *ConfigFlags, flags *BuildFlags, folder s
 			fmt.Sprintf("FLAG_BUILDVCS=%v", flags.BuildVCS),
 			fmt.Sprintf("FLAG_OBFUSCATE=%v", flags.Obfuscate),
 			fmt.Sprintf("GARBLE_FLAGS=%s", flags.GarbleFlags),
+			fmt.Sprintf("FLAG_REPRODUCIBLE=%v", flags.Reproducible),
 			"TARGETS=" + strings.Replace(strings.Join(config.Targets, " "), "*", ".", -1),
-			fmt.Sprintf("GOPROXY=%s", os.Getenv("GOPROXY")),
-			fmt.Sprintf("GOPRIVATE=%s", os.Getenv("GOPRIVATE")),
-			fmt.Sprintf("GOEXPERIMENT=%s", os.Getenv("GOEXPERIMENT")),
 		},
 	}
+	if flags.SourceDateEpoch != 0 {
+		opts.Env = append(opts.Env, fmt.Sprintf("SOURCE_DATE_EPOCH=%d", flags.SourceDateEpoch))
+	}
+
+	// Forward the Go environment of the host and the per-target overrides
+	opts.Env = append(opts.Env, hostEnv(config)...)
+	opts.Env = append(opts.Env, targetOverrideEnv(resolveTargets(config.Targets), config.Overrides, flags)...)
 
 	// Set custom environment variables
 	for _, s := range config.DockerEnv {
@@ -478,6 +977,16 @@ func toRunOptions(image string, config *ConfigFlags, flags *BuildFlags, folder s
 	return opts
 }
 
+// packEnv joins the packages to build into the space separated form expected
+// by build.sh.
+func packEnv(packages []string) string {
+	slashed := make([]string, len(packages))
+	for i, pack := range packages {
+		slashed[i] = filepath.ToSlash(pack)
+	}
+	return strings.Join(slashed, " ")
+}
+
 // goPathExports returns volume binds and environment variables needed to share
 // the host GOPATH with the container (for non-module builds).
 func goPathExports() (binds []string, env []string) {
@@ -574,9 +1083,10 @@ func compileContained(config *ConfigFlags, flags *BuildFlags, folder string) err
 	env := []string{
 		"REPO_REMOTE=" + config.Remote,
 		"REPO_BRANCH=" + config.Branch,
-		"PACK=" + config.Package,
+		"PACK=" + packEnv(config.Packages),
 		"DEPS=" + config.Dependencies,
 		"ARGS=" + config.Arguments,
+		"DEPS_MANIFEST=" + config.DepsManifest,
 		"OUT=" + config.Prefix,
 		fmt.Sprintf("FLAG_V=%v", flags.Verbose),
 		fmt.Sprintf("FLAG_X=%v", flags.Steps),
@@ -589,8 +1099,13 @@ func compileContained(config *ConfigFlags, flags *BuildFlags, folder string) err
 		fmt.Sprintf("FLAG_BUILDVCS=%v", flags.BuildVCS),
 		fmt.Sprintf("FLAG_OBFUSCATE=%v", flags.Obfuscate),
 		fmt.Sprintf("GARBLE_FLAGS=%s", flags.GarbleFlags),
+		fmt.Sprintf("FLAG_REPRODUCIBLE=%v", flags.Reproducible),
 		"TARGETS=" + strings.Replace(strings.Join(config.Targets, " "), "*", ".", -1),
 	}
+	if flags.SourceDateEpoch != 0 {
+		env = append(env, fmt.Sprintf("SOURCE_DATE_EPOCH=%d", flags.SourceDateEpoch))
+	}
+	env = append(env, targetOverrideEnv(resolveTargets(config.Targets), config.Overrides, flags)...)
 	if local {
 		env = append(env, "EXT_GOPATH=/non-existent-path-to-signal-local-build")
 	}
@@ -598,7 +1113,7 @@ func compileContained(config *ConfigFlags, flags *BuildFlags, folder string) err
 	fmt.Printf("Cross compiling %s...\n", config.Repository)
 
 	cmd := exec.Command("/build.sh", config.Repository)
-	cmd.Env = append(os.Environ(), env...)
+	cmd.Env = append(append(filterEnv(os.Environ(), config), hostEnv(config)...), env...)
 
 	return run(cmd)
 }